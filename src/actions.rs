@@ -0,0 +1,136 @@
+//! A menu of what to do with the chosen project, instead of always switching
+//! to it
+
+use eyre::{Result, WrapErr};
+use std::{borrow::Cow, path::Path, sync::Arc};
+
+use crate::{
+    browse, bulk,
+    confirm::confirm,
+    launch_with, open_project, record_switch,
+    state::State,
+    tmux::{OnExisting, Tmux},
+    Args, Config, ProjectPath, SkimOptionsFromEnv,
+};
+
+#[derive(Debug, Clone, Copy)]
+enum Action {
+    Switch,
+    NewWindow,
+    Editor,
+    Browse,
+    /// only offered for shallow and partial clones
+    Unshallow,
+    Kill,
+}
+
+const ACTIONS: &[Action] = &[
+    Action::Switch,
+    Action::NewWindow,
+    Action::Editor,
+    Action::Browse,
+    Action::Unshallow,
+    Action::Kill,
+];
+
+impl Action {
+    fn label(self) -> &'static str {
+        match self {
+            Action::Switch => "switch",
+            Action::NewWindow => "new window",
+            Action::Editor => "editor",
+            Action::Browse => "browse remote",
+            Action::Unshallow => "fetch full history",
+            Action::Kill => "kill session",
+        }
+    }
+}
+
+struct ActionItem(Action);
+
+impl skim::SkimItem for ActionItem {
+    fn text(&self) -> Cow<str> {
+        Cow::Borrowed(self.0.label())
+    }
+}
+
+fn choose(project: &ProjectPath) -> Option<Action> {
+    let (tx, rx): (skim::SkimItemSender, skim::SkimItemReceiver) = crossbeam_channel::unbounded();
+    let incomplete = bulk::Incomplete::of(Path::new(&project.full_path));
+    for action in ACTIONS {
+        if matches!(action, Action::Unshallow) && !incomplete.any() {
+            continue;
+        }
+        let _ = tx.send(Arc::new(ActionItem(*action)));
+    }
+    drop(tx);
+
+    let header = format!("{}: enter to run, esc to cancel", project.session_name);
+    let mut options = skim::SkimOptions::from_env();
+    options.header = Some(&header);
+    let result = skim::Skim::run_with(&options, Some(rx))?;
+    if result.is_abort {
+        return None;
+    }
+    let item = result.selected_items.first()?;
+    item.as_any()
+        .downcast_ref::<ActionItem>()
+        .map(|item| item.0)
+}
+
+/// Open a project in a new window of its session, even if `on_existing`
+/// would have gone to the session as it is
+fn new_window(cfg: &Config, args: &Args, state: &State, project: &ProjectPath) -> Result<()> {
+    if let Some((outcome, session_name)) =
+        launch_with(cfg, args, state, project, None, OnExisting::NewWindow, None)?
+    {
+        outcome.report(&session_name);
+        record_switch(args, state, project, session_name);
+    }
+    Ok(())
+}
+
+fn editor(cfg: &Config, args: &Args, state: &State, project: &ProjectPath) -> Result<()> {
+    if let Some((outcome, session_name)) =
+        launch_with(cfg, args, state, project, Some("."), cfg.on_existing, None)?
+    {
+        outcome.report(&session_name);
+        record_switch(args, state, project, session_name);
+    }
+    Ok(())
+}
+
+/// Show the menu for `project` and run the chosen action
+pub(crate) fn run(cfg: &Config, args: &Args, state: &State, project: &ProjectPath) -> Result<()> {
+    let action = match choose(project) {
+        Some(action) => action,
+        None => return Ok(()),
+    };
+    match action {
+        Action::Switch => open_project(cfg, args, state, project),
+        Action::NewWindow => new_window(cfg, args, state, project),
+        Action::Editor => editor(cfg, args, state, project),
+        Action::Browse => browse::run(project, args.dry_run),
+        Action::Unshallow => {
+            println!("fetching the full history of {}", project.session_name);
+            bulk::complete(Path::new(&project.full_path), args.dry_run)
+                .wrap_err("fetching full history")
+        }
+        Action::Kill if cfg.is_protected(project) => {
+            println!("not killing protected session {}", project.session_name);
+            Ok(())
+        }
+        Action::Kill => {
+            let question = format!("kill session {}?", project.session_name);
+            if confirm(&question, args.yes || args.dry_run)?
+                && Tmux::new(project)
+                    .dry_run(args.dry_run)
+                    .kill()
+                    .wrap_err("killing session")?
+            {
+                println!("killed session {}", project.session_name);
+            }
+            Ok(())
+        }
+    }
+}
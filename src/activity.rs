@@ -0,0 +1,77 @@
+//! Time spent per project, worked out from tmux's record of when each
+//! session last saw input. `project track` samples it and is meant to run
+//! from the status line, e.g. `set -ag status-right '#(project track)'`,
+//! which tmux repeats every status-interval.
+
+use eyre::Result;
+use std::time::Duration;
+
+use crate::{state::State, tmux};
+
+/// Gaps between activity longer than this are time away from the keyboard
+pub(crate) const DEFAULT_AFK_AFTER: Duration = Duration::from_secs(5 * 60);
+
+/// Seconds to credit for activity moving from `previous` to `latest`, which
+/// is nothing for a first sighting or after a break longer than `afk_after`
+fn credit(previous: Option<u64>, latest: u64, afk_after: u64) -> u64 {
+    match previous {
+        Some(previous) if latest > previous && latest - previous <= afk_after => latest - previous,
+        _ => 0,
+    }
+}
+
+/// The UTC date of a unix timestamp as YYYY-MM-DD
+pub(crate) fn day(secs: u64) -> String {
+    // civil_from_days from http://howardhinnant.github.io/date_algorithms.html
+    let z = (secs / 86400) as i64 + 719468;
+    let era = z.div_euclid(146097);
+    let doe = z.rem_euclid(146097);
+    let yoe = (doe - doe / 1460 + doe / 36524 - doe / 146096) / 365;
+    let doy = doe - (365 * yoe + yoe / 4 - yoe / 100);
+    let mp = (5 * doy + 2) / 153;
+    let d = doy - (153 * mp + 2) / 5 + 1;
+    let m = if mp < 10 { mp + 3 } else { mp - 9 };
+    let y = yoe + era * 400 + i64::from(m <= 2);
+    format!("{:04}-{:02}-{:02}", y, m, d)
+}
+
+/// Sample the activity of the sessions this tool created, crediting any
+/// new activity to their projects
+pub(crate) fn record(state: &State, afk_after: Duration) -> Result<()> {
+    for session in tmux::sessions()? {
+        let full_path = match session.project_path {
+            Some(full_path) => full_path,
+            None => continue,
+        };
+        let previous = state.last_activity(&session.name);
+        if previous == Some(session.activity) {
+            continue;
+        }
+        let secs = credit(previous, session.activity, afk_after.as_secs());
+        state.record_activity(&session.name, session.activity);
+        if secs > 0 {
+            state.add_time(&full_path, &day(session.activity), secs);
+        }
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn crediting() {
+        assert_eq!(credit(None, 1000, 300), 0);
+        assert_eq!(credit(Some(1000), 1120, 300), 120);
+        assert_eq!(credit(Some(1000), 2000, 300), 0);
+        assert_eq!(credit(Some(1000), 1000, 300), 0);
+    }
+
+    #[test]
+    fn days() {
+        assert_eq!(day(0), "1970-01-01");
+        assert_eq!(day(951_782_400), "2000-02-29");
+        assert_eq!(day(1_791_072_000 + 86399), "2026-10-04");
+    }
+}
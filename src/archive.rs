@@ -0,0 +1,108 @@
+use eyre::{Result, WrapErr};
+use std::{
+    path::{Path, PathBuf},
+    process::Command,
+};
+
+use serde::{Deserialize, Serialize};
+
+use crate::{confirm::confirm, expand_path, tmux::Tmux, Cache, Config};
+
+#[derive(Debug, Serialize, Deserialize)]
+pub(crate) struct ArchiveConfig {
+    #[serde(deserialize_with = "expand_path")]
+    pub(crate) root: PathBuf,
+    /// store archived projects as compressed tarballs rather than directories
+    #[serde(default)]
+    tarball: bool,
+}
+
+fn move_dir(src: &Path, dst: &Path) -> Result<()> {
+    if std::fs::rename(src, dst).is_ok() {
+        return Ok(());
+    }
+    // rename cannot cross file systems, so fall back to mv which copies
+    let status = Command::new("mv")
+        .arg(src)
+        .arg(dst)
+        .status()
+        .wrap_err("running mv")?;
+    if !status.success() {
+        eyre::bail!("moving {} failed: {}", src.display(), status);
+    }
+    Ok(())
+}
+
+fn tar_dir(src: &Path, dst: &Path) -> Result<()> {
+    let parent = src.parent().unwrap_or_else(|| Path::new("/"));
+    let name = src
+        .file_name()
+        .ok_or_else(|| eyre::eyre!("{} has no file name", src.display()))?;
+    let status = Command::new("tar")
+        .arg("-czf")
+        .arg(dst)
+        .arg("-C")
+        .arg(parent)
+        .arg(name)
+        .status()
+        .wrap_err("running tar")?;
+    if !status.success() {
+        eyre::bail!("creating {} failed: {}", dst.display(), status);
+    }
+    std::fs::remove_dir_all(src).wrap_err_with(|| format!("removing {}", src.display()))
+}
+
+pub(crate) fn run(cfg: &Config, cache: &Cache, query: &str, yes: bool) -> Result<()> {
+    let archive = cfg
+        .archive
+        .as_ref()
+        .ok_or_else(|| eyre::eyre!("no [archive] section in the config file"))?;
+    let project = cache
+        .lookup(query)
+        .ok_or_else(|| eyre::eyre!("no project matching {:?}", query))?;
+    if cfg.is_protected(&project) {
+        eyre::bail!(
+            "{} is protected, remove it from `protected` in the config file to archive it",
+            project.session_name
+        );
+    }
+
+    let src = PathBuf::from(&project.full_path);
+    let name = src
+        .file_name()
+        .ok_or_else(|| eyre::eyre!("{} has no file name", src.display()))?
+        .to_string_lossy()
+        .into_owned();
+    let dst = if archive.tarball {
+        archive.root.join(format!("{}.tar.gz", name))
+    } else {
+        archive.root.join(&name)
+    };
+    if dst.exists() {
+        eyre::bail!("{} already exists", dst.display());
+    }
+    let question = format!(
+        "kill session {} and archive {} to {}?",
+        project.session_name,
+        src.display(),
+        dst.display()
+    );
+    if !confirm(&question, yes)? {
+        return Ok(());
+    }
+
+    if Tmux::new(&project).kill().wrap_err("killing session")? {
+        println!("killed session {}", project.session_name);
+    }
+
+    std::fs::create_dir_all(&archive.root).wrap_err("creating archive root")?;
+    if archive.tarball {
+        tar_dir(&src, &dst)?;
+    } else {
+        move_dir(&src, &dst)?;
+    }
+    cache.remove(&project.full_path);
+    println!("archived {} to {}", src.display(), dst.display());
+
+    Ok(())
+}
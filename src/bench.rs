@@ -0,0 +1,91 @@
+use eyre::{Result, WrapErr};
+use std::time::{Duration, Instant};
+
+use crate::{cache_file, discover_projects, storage, text, CacheInner, Config, RootDir};
+
+struct RootTiming {
+    projects: usize,
+    cold: Duration,
+    warm: Duration,
+}
+
+fn time_scan(dir: &RootDir, offline: bool) -> (usize, Duration) {
+    let start = Instant::now();
+    let projects = discover_projects(dir, Vec::new(), offline).count();
+    (projects, start.elapsed())
+}
+
+fn time_root(dir: &RootDir, offline: bool) -> RootTiming {
+    // the first walk has to populate the OS file system caches, so the second
+    // walk over the same tree shows how fast a scan is once everything is hot
+    let (projects, cold) = time_scan(dir, offline);
+    let (_, warm) = time_scan(dir, offline);
+    RootTiming {
+        projects,
+        cold,
+        warm,
+    }
+}
+
+fn time_cache_load() -> Result<(usize, Duration)> {
+    let start = Instant::now();
+    let txt = match storage::read(&cache_file()?) {
+        Ok(txt) => txt,
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok((0, start.elapsed())),
+        Err(e) => return Err(e).wrap_err("reading cache file"),
+    };
+    let inner: CacheInner = serde_json::from_str(&txt).wrap_err("parsing cache file")?;
+    Ok((inner.paths.len(), start.elapsed()))
+}
+
+pub(crate) fn run(cfg: &Config, offline: bool) -> Result<()> {
+    let width = cfg
+        .root_dirs
+        .iter()
+        .map(|dir| text::width(&dir.path.display().to_string()))
+        .max()
+        .unwrap_or(0)
+        .max("root".len());
+
+    println!(
+        "{:<width$}  {:>8}  {:>10}  {:>10}",
+        "root",
+        "projects",
+        "cold",
+        "warm",
+        width = width
+    );
+
+    let mut total = RootTiming {
+        projects: 0,
+        cold: Duration::ZERO,
+        warm: Duration::ZERO,
+    };
+    for dir in &cfg.root_dirs {
+        let timing = time_root(dir, offline);
+        println!(
+            "{}  {:>8}  {:>10.2?}  {:>10.2?}",
+            text::pad(&dir.path.display().to_string(), width),
+            timing.projects,
+            timing.cold,
+            timing.warm,
+        );
+        total.projects += timing.projects;
+        total.cold += timing.cold;
+        total.warm += timing.warm;
+    }
+    println!(
+        "{:<width$}  {:>8}  {:>10.2?}  {:>10.2?}",
+        "total",
+        total.projects,
+        total.cold,
+        total.warm,
+        width = width
+    );
+
+    let (entries, elapsed) = time_cache_load().wrap_err("loading cache")?;
+    println!();
+    println!("cache load: {:.2?} ({} entries)", elapsed, entries);
+
+    Ok(())
+}
@@ -0,0 +1,61 @@
+//! First run: offer to write a starter config file rather than failing
+//! because there is none
+
+use eyre::{Result, WrapErr};
+use std::{
+    io::{BufRead, Write},
+    path::Path,
+};
+
+use crate::{discover, tmux::is_interactive, Config};
+
+/// Used when `project discover` finds nothing to suggest
+const PLACEHOLDER_ROOTS: &str = r#"
+# every git repository beneath each root is a project
+[[root_dirs]]
+path = "~/work"
+"#;
+
+fn starter(roots: Option<String>) -> String {
+    format!(
+        "# see config.toml.example in the repository for every setting\n{}",
+        roots.as_deref().unwrap_or(PLACEHOLDER_ROOTS)
+    )
+}
+
+/// Ask to create the missing config file at `path`, returning the new
+/// config. Without a terminal to ask on, fail with a sample to copy instead.
+pub(crate) fn offer(path: &Path) -> Result<Config> {
+    let missing = || {
+        eyre::eyre!(
+            "no config file at {}, create one such as:\n{}",
+            path.display(),
+            starter(None)
+        )
+    };
+    if !is_interactive() {
+        return Err(missing());
+    }
+
+    eprint!(
+        "no config file at {}, create one with roots found in your home directory? [Y/n] ",
+        path.display()
+    );
+    std::io::stderr().flush()?;
+    let mut answer = String::new();
+    std::io::stdin()
+        .lock()
+        .read_line(&mut answer)
+        .wrap_err("reading answer")?;
+    if !matches!(answer.trim(), "" | "y" | "Y" | "yes") {
+        return Err(missing());
+    }
+
+    let contents = starter(discover::starter_roots());
+    if let Some(dir) = path.parent() {
+        std::fs::create_dir_all(dir).wrap_err("creating config directory")?;
+    }
+    std::fs::write(path, &contents).wrap_err("writing config file")?;
+    eprintln!("wrote {}:\n{}", path.display(), contents);
+    Config::open(path.to_path_buf())
+}
@@ -0,0 +1,40 @@
+//! `project browse`: open a project's repository on the web
+
+use eyre::{Result, WrapErr};
+use std::{
+    path::Path,
+    process::{Command, Stdio},
+};
+
+use crate::{git, ProjectPath};
+
+/// Open `url` in the default browser
+pub(crate) fn open_url(url: &str, dry_run: bool) -> Result<()> {
+    let opener = if cfg!(target_os = "macos") {
+        "open"
+    } else {
+        "xdg-open"
+    };
+    if dry_run {
+        println!("{} {}", opener, url);
+        return Ok(());
+    }
+    let status = Command::new(opener)
+        .arg(url)
+        .stdout(Stdio::null())
+        .stderr(Stdio::null())
+        .status()
+        .wrap_err_with(|| format!("running {}", opener))?;
+    if !status.success() {
+        eyre::bail!("{} {} exited with {}", opener, url, status);
+    }
+    Ok(())
+}
+
+pub(crate) fn run(project: &ProjectPath, dry_run: bool) -> Result<()> {
+    let remote = git::origin_url(Path::new(&project.full_path))
+        .ok_or_else(|| eyre::eyre!("{} has no origin remote", project.full_path))?;
+    let url = git::web_url(&remote)
+        .ok_or_else(|| eyre::eyre!("no web address for the remote {}", remote))?;
+    open_url(&url, dry_run)
+}
@@ -0,0 +1,402 @@
+//! Cloning many repositories at once for `project mirror` and `project
+//! sync-manifest`: a few at a time, retrying failures with backoff, and
+//! carrying on where an interrupted run stopped
+
+use eyre::{Result, WrapErr};
+use serde::{Deserialize, Serialize};
+use std::{
+    collections::{BTreeMap, BTreeSet},
+    path::{Path, PathBuf},
+    process::Command,
+    time::Duration,
+};
+
+use crate::{cache_file, duration::HumanDuration, index::fnv, ssh};
+
+#[derive(Debug, Serialize, Deserialize)]
+#[serde(default)]
+pub(crate) struct CloneConfig {
+    /// clones and pulls running at once
+    pub(crate) jobs: usize,
+    /// attempts after the first before a repository counts as failed
+    pub(crate) retries: u32,
+    /// the wait before the first retry, doubling for each one after
+    pub(crate) backoff: HumanDuration,
+    /// clone only this many commits of history, e.g. 1
+    pub(crate) depth: Option<u32>,
+    /// leave objects out of clones until they are needed, e.g. "blob:none"
+    pub(crate) filter: Option<String>,
+    /// aliases from ~/.ssh/config to clone through, keyed by the host in
+    /// repository URLs, e.g. "github.com" = "github-work"
+    pub(crate) ssh_hosts: BTreeMap<String, String>,
+}
+
+impl Default for CloneConfig {
+    fn default() -> Self {
+        Self {
+            jobs: 4,
+            retries: 2,
+            backoff: HumanDuration(Duration::from_secs(2)),
+            depth: None,
+            filter: None,
+            ssh_hosts: BTreeMap::new(),
+        }
+    }
+}
+
+/// A repository to clone, or to update if it is there already
+pub(crate) struct Job {
+    pub(crate) url: String,
+    pub(crate) branch: Option<String>,
+    pub(crate) dst: PathBuf,
+}
+
+fn git(dir: Option<&Path>, args: &[&str]) -> Result<()> {
+    let mut cmd = Command::new("git");
+    if let Some(dir) = dir {
+        cmd.current_dir(dir);
+    }
+    // several run at once, so their output is kept for errors rather than
+    // interleaved on the terminal
+    let output = cmd.args(args).output().wrap_err("running git")?;
+    if !output.status.success() {
+        let stderr = String::from_utf8_lossy(&output.stderr);
+        eyre::bail!(
+            "git {} failed: {}",
+            args.first().unwrap_or(&""),
+            stderr.trim().lines().last().unwrap_or_default()
+        );
+    }
+    Ok(())
+}
+
+fn git_stdout(dir: &Path, args: &[&str]) -> String {
+    Command::new("git")
+        .current_dir(dir)
+        .args(args)
+        .output()
+        .ok()
+        .filter(|output| output.status.success())
+        .map(|output| String::from_utf8_lossy(&output.stdout).trim().to_string())
+        .unwrap_or_default()
+}
+
+/// How a clone made with `depth` or `filter` is missing history or objects
+#[derive(Debug, Default, Clone, Copy)]
+pub(crate) struct Incomplete {
+    shallow: bool,
+    partial: bool,
+}
+
+impl Incomplete {
+    pub(crate) fn of(dir: &Path) -> Self {
+        Self {
+            shallow: git_stdout(dir, &["rev-parse", "--is-shallow-repository"]) == "true",
+            partial: !git_stdout(
+                dir,
+                &["config", "--get", "remote.origin.partialclonefilter"],
+            )
+            .is_empty(),
+        }
+    }
+
+    pub(crate) fn any(self) -> bool {
+        self.shallow || self.partial
+    }
+}
+
+/// The first git to support `fetch --refetch`
+const REFETCH_VERSION: (u32, u32) = (2, 36);
+
+/// The major and minor version of git, from e.g. "git version 2.39.2"
+fn parse_version(out: &str) -> Option<(u32, u32)> {
+    let version = out.split_whitespace().nth(2)?;
+    let mut parts = version.split('.').map(|part| part.parse().ok());
+    Some((parts.next()??, parts.next()??))
+}
+
+/// Fetch the history, branches and objects a shallow or partial clone left
+/// out. Partial clones need git 2.36 or later, for `fetch --refetch`.
+pub(crate) fn complete(dir: &Path, dry_run: bool) -> Result<()> {
+    let incomplete = Incomplete::of(dir);
+    if !incomplete.any() {
+        return Ok(());
+    }
+    if incomplete.partial {
+        let out = git_stdout(dir, &["--version"]);
+        if parse_version(&out).map_or(true, |version| version < REFETCH_VERSION) {
+            eyre::bail!(
+                "fetching what a partial clone left out needs git {}.{} or later, found {:?}",
+                REFETCH_VERSION.0,
+                REFETCH_VERSION.1,
+                out
+            );
+        }
+    }
+    // shallow clones only track the branch they cloned
+    let all_branches = [
+        "config",
+        "remote.origin.fetch",
+        "+refs/heads/*:refs/remotes/origin/*",
+    ];
+    let mut args = vec!["fetch", "--quiet", "origin"];
+    if incomplete.shallow {
+        args.push("--unshallow");
+    }
+    if incomplete.partial {
+        // without a filter a refetch brings in everything the first one left
+        args.push("--refetch");
+    }
+    if dry_run {
+        println!("git {}", all_branches.join(" "));
+        if incomplete.partial {
+            println!("git config --unset remote.origin.partialclonefilter");
+        }
+        println!("git {}", args.join(" "));
+        return Ok(());
+    }
+    git(Some(dir), &all_branches)?;
+    if incomplete.partial {
+        git(
+            Some(dir),
+            &["config", "--unset", "remote.origin.partialclonefilter"],
+        )?;
+    }
+    git(Some(dir), &args)
+}
+
+/// Where `dst` is cloned before it is complete, so an interrupted clone is
+/// never mistaken for a finished one
+fn partial(dst: &Path) -> PathBuf {
+    let name = dst.file_name().unwrap_or_default().to_string_lossy();
+    dst.with_file_name(format!(".{}.partial", name))
+}
+
+/// Clone `url` to `dst`, or bring an existing clone up to date without
+/// touching local commits or changes, returning which it did
+pub(crate) fn clone_or_update(
+    cfg: &CloneConfig,
+    url: &str,
+    branch: Option<&str>,
+    dst: &Path,
+) -> Result<&'static str> {
+    if dst.exists() {
+        if !dst.join(".git").exists() {
+            eyre::bail!("{} exists and is not a git repository", dst.display());
+        }
+        git(Some(dst), &["pull", "--ff-only", "--quiet"])?;
+        return Ok("updated");
+    }
+    let partial = partial(dst);
+    if partial.exists() {
+        std::fs::remove_dir_all(&partial)
+            .wrap_err_with(|| format!("removing unfinished clone {}", partial.display()))?;
+    }
+    if let Some(parent) = dst.parent() {
+        std::fs::create_dir_all(parent)
+            .wrap_err_with(|| format!("creating {}", parent.display()))?;
+    }
+    let url = ssh::with_alias(url, &cfg.ssh_hosts);
+    let target = partial.to_string_lossy();
+    let depth = cfg.depth.map(|depth| format!("--depth={}", depth));
+    let filter = cfg
+        .filter
+        .as_ref()
+        .map(|filter| format!("--filter={}", filter));
+    let mut args = vec!["clone", "--quiet"];
+    args.extend(depth.as_deref());
+    args.extend(filter.as_deref());
+    if let Some(branch) = branch {
+        args.extend(["--branch", branch]);
+    }
+    args.extend(["--", url.as_str(), &target]);
+    git(None, &args)?;
+    std::fs::rename(&partial, dst)
+        .wrap_err_with(|| format!("moving clone to {}", dst.display()))?;
+    Ok("cloned")
+}
+
+/// How long to wait before retry number `retry`, counting from zero
+fn backoff(first: Duration, retry: u32) -> Duration {
+    first.saturating_mul(1 << retry.min(16))
+}
+
+fn with_retries<T, F>(cfg: &CloneConfig, what: &str, mut f: F) -> Result<T>
+where
+    F: FnMut() -> Result<T>,
+{
+    let mut retry = 0;
+    loop {
+        match f() {
+            Ok(value) => return Ok(value),
+            Err(e) if retry < cfg.retries => {
+                let wait = backoff(cfg.backoff.0, retry);
+                log::info!("{}: {:#}, retrying in {:?}", what, e, wait);
+                std::thread::sleep(wait);
+                retry += 1;
+            }
+            Err(e) => return Err(e),
+        }
+    }
+}
+
+/// How long an unfinished run can be resumed. After that its repositories
+/// are updated again, so one repository which always fails does not stop
+/// the rest from ever being pulled.
+const RESUME_WITHIN: Duration = Duration::from_secs(24 * 60 * 60);
+
+/// The repositories an unfinished run got through, so running the same
+/// command again skips them. It is removed once a run completes.
+struct Journal {
+    path: Option<PathBuf>,
+    done: BTreeSet<PathBuf>,
+}
+
+impl Journal {
+    fn open(key: &str) -> Self {
+        let path = cache_file()
+            .ok()
+            .map(|file| file.with_file_name(format!("clone-{:016x}.json", fnv(key, 0))));
+        let done = path
+            .as_ref()
+            .filter(|path| {
+                std::fs::metadata(path)
+                    .and_then(|meta| meta.modified())
+                    .ok()
+                    .and_then(|modified| modified.elapsed().ok())
+                    .map_or(false, |age| age < RESUME_WITHIN)
+            })
+            .and_then(|path| std::fs::read_to_string(path).ok())
+            .and_then(|txt| serde_json::from_str(&txt).ok())
+            .unwrap_or_default();
+        Self { path, done }
+    }
+
+    fn record(&mut self, dst: &Path) {
+        self.done.insert(dst.to_path_buf());
+        if let Some(path) = &self.path {
+            let txt = serde_json::to_string(&self.done).unwrap_or_default();
+            if let Err(e) = std::fs::write(path, txt) {
+                log::warn!("saving clone progress: {}", e);
+            }
+        }
+    }
+
+    fn finish(self) {
+        if let Some(path) = self.path {
+            let _ = std::fs::remove_file(path);
+        }
+    }
+}
+
+/// Clone or update each of `jobs`, printing progress as they finish, and
+/// return what happened to each. `key` identifies the run, such as the
+/// manifest's path, for resuming it after an interruption.
+pub(crate) fn run(
+    cfg: &CloneConfig,
+    key: &str,
+    jobs: Vec<Job>,
+) -> Vec<(Job, Result<&'static str>)> {
+    let mut journal = Journal::open(key);
+    let total = jobs.len();
+    let (pending, resumed): (Vec<Job>, Vec<Job>) = jobs
+        .into_iter()
+        .partition(|job| !journal.done.contains(&job.dst));
+    if !resumed.is_empty() {
+        eprintln!(
+            "resuming: {} of {} repositories were synced by the interrupted run",
+            resumed.len(),
+            total
+        );
+    }
+    let mut results: Vec<(Job, Result<&'static str>)> =
+        resumed.into_iter().map(|job| (job, Ok("synced"))).collect();
+
+    let (job_tx, job_rx) = crossbeam_channel::unbounded::<Job>();
+    let (result_tx, result_rx) = crossbeam_channel::unbounded();
+    for job in pending {
+        let _ = job_tx.send(job);
+    }
+    drop(job_tx);
+
+    std::thread::scope(|scope| {
+        for _ in 0..cfg.jobs.max(1) {
+            let job_rx = job_rx.clone();
+            let result_tx = result_tx.clone();
+            scope.spawn(move || {
+                for job in job_rx.iter() {
+                    let result = with_retries(cfg, &job.url, || {
+                        clone_or_update(cfg, &job.url, job.branch.as_deref(), &job.dst)
+                    });
+                    let _ = result_tx.send((job, result));
+                }
+            });
+        }
+        drop(result_tx);
+
+        for (job, result) in result_rx.iter() {
+            let progress = format!("[{}/{}]", results.len() + 1, total);
+            match &result {
+                Ok(done) => {
+                    eprintln!("{} {} {}", progress, done, job.dst.display());
+                    journal.record(&job.dst);
+                }
+                Err(e) => eprintln!("{} failed {}: {:#}", progress, job.url, e),
+            }
+            results.push((job, result));
+        }
+    });
+
+    if results.iter().all(|(_, result)| result.is_ok()) {
+        journal.finish();
+    }
+    results
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn git_versions() {
+        assert_eq!(parse_version("git version 2.39.2"), Some((2, 39)));
+        assert_eq!(
+            parse_version("git version 2.30.1 (Apple Git-130)"),
+            Some((2, 30))
+        );
+        assert!(parse_version("git version 2.30.1").unwrap() < REFETCH_VERSION);
+        assert_eq!(parse_version(""), None);
+    }
+
+    #[test]
+    fn retries() {
+        let cfg = CloneConfig {
+            retries: 2,
+            backoff: HumanDuration(Duration::from_millis(1)),
+            ..CloneConfig::default()
+        };
+        let mut attempts = 0;
+        let result = with_retries(&cfg, "flaky", || {
+            attempts += 1;
+            if attempts < 3 {
+                eyre::bail!("try again")
+            }
+            Ok(attempts)
+        });
+        assert_eq!(result.unwrap(), 3);
+
+        let mut attempts = 0;
+        let result: Result<()> = with_retries(&cfg, "broken", || {
+            attempts += 1;
+            eyre::bail!("no")
+        });
+        assert!(result.is_err());
+        assert_eq!(attempts, 3);
+
+        assert_eq!(backoff(Duration::from_secs(2), 3), Duration::from_secs(16));
+        assert_eq!(
+            partial(Path::new("/work/org/api")),
+            PathBuf::from("/work/org/.api.partial")
+        );
+    }
+}
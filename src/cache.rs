@@ -0,0 +1,117 @@
+//! `project cache` subcommands
+
+use eyre::{Result, WrapErr};
+use serde::Serialize;
+use std::path::{Path, PathBuf};
+
+use crate::{
+    activity::day, canonical_key, confirm::confirm, exclude::Excludes, state::State, undo, usage,
+    Cache, Config, Format,
+};
+
+#[derive(Serialize)]
+struct Entry {
+    path: String,
+    session_name: String,
+    /// the configured root the project was found under, if it still is one
+    root: Option<PathBuf>,
+    /// seconds since the unix epoch
+    added: Option<u64>,
+    last_used: Option<u64>,
+    size_bytes: Option<u64>,
+}
+
+/// Remove the cached projects beneath `root` and matching `pattern`, or
+/// every project when neither is given, once the user agrees
+pub(crate) fn clear(
+    cache: &Cache,
+    state: &State,
+    root: Option<&str>,
+    pattern: Option<&str>,
+    yes: bool,
+) -> Result<()> {
+    let root = root.map(canonical_key);
+    let pattern = pattern.map(|pattern| Excludes::new([anywhere(pattern)]));
+
+    let doomed: Vec<_> = cache
+        .initial_paths()
+        .into_iter()
+        .filter(|project| {
+            let under_root = root
+                .as_ref()
+                .map_or(true, |root| Path::new(&project.full_path).starts_with(root));
+            let matched = pattern
+                .as_ref()
+                .map_or(true, |pattern| pattern.matches(&project.full_path));
+            under_root && matched
+        })
+        .collect();
+    if doomed.is_empty() {
+        println!("no cached projects to remove");
+        return Ok(());
+    }
+    if !confirm(&format!("remove {} cached projects?", doomed.len()), yes)? {
+        return Ok(());
+    }
+    undo::remove(cache, state, "clearing the cache", &doomed);
+    println!("removed {} cached projects", doomed.len());
+    Ok(())
+}
+
+/// Let a relative glob like "forks/*" match at any depth, as it would be
+/// awkward to spell out the whole path on the command line
+fn anywhere(pattern: &str) -> String {
+    if pattern.contains('/') && !pattern.starts_with('/') && !pattern.starts_with('~') {
+        format!("**/{}", pattern)
+    } else {
+        pattern.to_string()
+    }
+}
+
+/// Every cached project with its metadata, for working out why a project
+/// is or is not showing up
+pub(crate) fn show(cfg: &Config, cache: &Cache, state: &State, format: Format) -> Result<()> {
+    let entries: Vec<_> = cache
+        .initial_paths()
+        .into_iter()
+        .map(|p| Entry {
+            root: cfg.root_for(&p.full_path).map(|dir| dir.path.clone()),
+            added: cache.added(&p.full_path),
+            last_used: Some(state.last_used(&p.full_path)).filter(|t| *t > 0),
+            size_bytes: cache.cached_size(&p.full_path),
+            path: p.full_path,
+            session_name: p.session_name,
+        })
+        .collect();
+
+    match format {
+        Format::Json => {
+            let stdout = std::io::stdout();
+            serde_json::to_writer_pretty(stdout.lock(), &entries).wrap_err("writing json")?;
+            println!();
+        }
+        Format::Text => {
+            let date = |t: Option<u64>| t.map_or_else(|| "-".to_string(), day);
+            for entry in &entries {
+                println!("{}", entry.path);
+                println!("  session:   {}", entry.session_name);
+                println!(
+                    "  root:      {}",
+                    entry
+                        .root
+                        .as_ref()
+                        .map_or_else(|| "none".to_string(), |r| r.display().to_string())
+                );
+                println!("  added:     {}", date(entry.added));
+                println!("  last used: {}", date(entry.last_used));
+                println!(
+                    "  size:      {}",
+                    entry
+                        .size_bytes
+                        .map_or_else(|| "-".to_string(), usage::human)
+                );
+            }
+        }
+    }
+    Ok(())
+}
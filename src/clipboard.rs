@@ -0,0 +1,66 @@
+//! Copying to the clipboard with OSC 52, which terminals honour over SSH as
+//! well as locally
+
+use eyre::{Result, WrapErr};
+use std::io::Write;
+
+use crate::tmux::TmuxCommand;
+
+const BASE64: &[u8; 64] = b"ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/";
+
+fn base64(data: &[u8]) -> String {
+    let mut out = String::with_capacity((data.len() + 2) / 3 * 4);
+    for chunk in data.chunks(3) {
+        let n = chunk
+            .iter()
+            .enumerate()
+            .fold(0u32, |n, (i, b)| n | (*b as u32) << (16 - 8 * i));
+        for i in 0..4 {
+            if i <= chunk.len() {
+                out.push(BASE64[(n >> (18 - 6 * i) & 0x3f) as usize] as char);
+            } else {
+                out.push('=');
+            }
+        }
+    }
+    out
+}
+
+/// The escape sequence asking the terminal to put `text` on the clipboard
+fn osc52(text: &str) -> String {
+    format!("\x1b]52;c;{}\x07", base64(text.as_bytes()))
+}
+
+/// Put `text` on the clipboard. Inside tmux the buffer is set with -w so tmux
+/// passes it on to the terminal itself, which needs set-clipboard enabled.
+pub(crate) fn copy(text: &str) -> Result<()> {
+    if std::env::var_os("TMUX").is_some() {
+        TmuxCommand::new("set-buffer")
+            .args(["-w", "--", text])
+            .run()?;
+        return Ok(());
+    }
+    // the terminal rather than stdout, which may be a pipe
+    let mut tty = std::fs::OpenOptions::new()
+        .write(true)
+        .open("/dev/tty")
+        .wrap_err("opening terminal")?;
+    tty.write_all(osc52(text).as_bytes())
+        .wrap_err("writing to terminal")?;
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn encoding() {
+        assert_eq!(base64(b""), "");
+        assert_eq!(base64(b"f"), "Zg==");
+        assert_eq!(base64(b"fo"), "Zm8=");
+        assert_eq!(base64(b"foo"), "Zm9v");
+        assert_eq!(base64(b"/home/me/work"), "L2hvbWUvbWUvd29yaw==");
+        assert_eq!(osc52("fo"), "\x1b]52;c;Zm8=\x07");
+    }
+}
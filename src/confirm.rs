@@ -0,0 +1,47 @@
+//! Asking before destructive actions, the same way from the command line and
+//! the picker
+
+use eyre::{Result, WrapErr};
+use std::io::Write;
+
+use crate::tmux::is_interactive;
+
+/// Whether the user agrees to `question`, asked on the terminal unless
+/// `yes` says so already. With nobody to ask, the answer is no, so scripts
+/// have to pass --yes.
+pub(crate) fn confirm(question: &str, yes: bool) -> Result<bool> {
+    if yes {
+        return Ok(true);
+    }
+    if !is_interactive() {
+        eprintln!(
+            "{} not confirmed, pass --yes to do it without asking",
+            question
+        );
+        return Ok(false);
+    }
+    eprint!("{} [y/N] ", question);
+    std::io::stderr().flush()?;
+    let mut answer = String::new();
+    std::io::stdin()
+        .read_line(&mut answer)
+        .wrap_err("reading answer")?;
+    Ok(is_yes(&answer))
+}
+
+fn is_yes(answer: &str) -> bool {
+    matches!(answer.trim().to_lowercase().as_str(), "y" | "yes")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn answers() {
+        assert!(is_yes("y\n"));
+        assert!(is_yes(" YES "));
+        assert!(!is_yes("\n"));
+        assert!(!is_yes("nope"));
+    }
+}
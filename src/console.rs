@@ -0,0 +1,174 @@
+use eyre::{Result, WrapErr};
+use std::{io::Write, path::Path, process::Command, sync::Arc};
+
+use skim::prelude::Key;
+
+use crate::{
+    browse, clipboard,
+    confirm::confirm,
+    files, git, open_file, open_project, send_cached,
+    state::State,
+    tmux::{self, Tmux},
+    undo, Annotators, Args, Cache, Config, ProjectItem, ProjectPath,
+};
+
+const HELP: &str =
+    "enter: switch  ctrl-o: second session  ctrl-x: kill session  ctrl-e: editor  ctrl-t: tag  ctrl-h: hide  alt-o: opener  alt-b: browse  alt-y: copy path  alt-f: file  alt-c: default branch  ctrl-r: previous query  esc: quit";
+
+fn edit(full_path: &str) -> Result<()> {
+    let editor = files::editor();
+    let status = Command::new("sh")
+        .arg("-c")
+        .arg(format!("{} .", editor))
+        .current_dir(full_path)
+        .status()
+        .wrap_err_with(|| format!("running {}", editor))?;
+    if !status.success() {
+        log::warn!("{} exited with {}", editor, status);
+    }
+    Ok(())
+}
+
+fn tag(state: &State, full_path: &str) -> Result<()> {
+    print!(
+        "tags for {} [{}] (comma separated): ",
+        full_path,
+        state.tags(full_path).join(", ")
+    );
+    std::io::stdout().flush()?;
+    let mut line = String::new();
+    std::io::stdin()
+        .read_line(&mut line)
+        .wrap_err("reading tags")?;
+    let tags = line
+        .split(',')
+        .map(str::trim)
+        .filter(|t| !t.is_empty())
+        .map(str::to_string)
+        .collect();
+    undo::set_tags(state, &[full_path], tags);
+    Ok(())
+}
+
+fn set_opener(state: &State, full_path: &str) -> Result<()> {
+    print!(
+        "open {} with [{}] (a command such as \"code .\", \"tmux\" for a session, blank for the config default): ",
+        full_path,
+        state.opener(full_path).unwrap_or_default()
+    );
+    std::io::stdout().flush()?;
+    let mut line = String::new();
+    std::io::stdin()
+        .read_line(&mut line)
+        .wrap_err("reading opener")?;
+    state.set_opener(full_path, line.trim());
+    Ok(())
+}
+
+/// Put the project back on its default branch, up to date with its upstream
+/// unless `offline`. Uncommitted changes are stashed first if the user
+/// agrees, returning false if they would rather stop.
+fn checkout_default(
+    cache: &Cache,
+    project: &ProjectPath,
+    dry_run: bool,
+    offline: bool,
+) -> Result<bool> {
+    let branch = cache
+        .default_branch(&project.full_path)
+        .ok_or_else(|| eyre::eyre!("no default branch known for {}", project.full_path))?;
+    let path = Path::new(&project.full_path);
+    if git::is_dirty(path) {
+        print!(
+            "{} has uncommitted changes: [s]tash them and check out {}, or [a]bort? ",
+            project.full_path, branch
+        );
+        std::io::stdout().flush()?;
+        let mut line = String::new();
+        std::io::stdin()
+            .read_line(&mut line)
+            .wrap_err("reading answer")?;
+        match line.trim() {
+            "s" | "stash" => {
+                let message = format!("project: before checking out {}", branch);
+                git::stash(path, &message, dry_run)?;
+            }
+            _ => return Ok(false),
+        }
+    }
+    git::checkout(path, &branch, dry_run, offline)
+        .wrap_err_with(|| format!("checking out {} in {}", branch, project.full_path))?;
+    Ok(true)
+}
+
+/// Run the picker as a management console: actions other than switching
+/// return to the list rather than exiting
+pub(crate) fn run(
+    cfg: &Config,
+    args: &Args,
+    cache: &Cache,
+    state: &State,
+    annotators: &Arc<Annotators>,
+    mut options: skim::SkimOptions,
+    rx: skim::SkimItemReceiver,
+) -> Result<()> {
+    options.header = Some(HELP);
+    options.expect =
+        Some("ctrl-o,ctrl-x,ctrl-e,ctrl-t,ctrl-h,alt-o,alt-b,alt-y,alt-f,alt-c".to_string());
+
+    // the first round shows projects as the background scan finds them,
+    // later rounds are fed from the cache it has been filling
+    let mut pending = Some(rx);
+    loop {
+        let rx = pending.take().unwrap_or_else(|| {
+            let (tx, rx): (skim::SkimItemSender, skim::SkimItemReceiver) =
+                crossbeam_channel::unbounded();
+            send_cached(cfg, cache, state, annotators, args.all, &tx);
+            rx
+        });
+
+        let result = match skim::Skim::run_with(&options, Some(rx)) {
+            Some(result) => result,
+            None => return Ok(()),
+        };
+        if result.is_abort {
+            return Ok(());
+        }
+        let item = match result.selected_items.first() {
+            Some(item) => item,
+            None => continue,
+        };
+        state.record_query(&result.query);
+        // we know this is a ProjectItem, so downcast accordingly
+        let item: &ProjectItem = item.as_any().downcast_ref().unwrap();
+        let project = &item.path;
+
+        match result.final_key {
+            Key::Ctrl('o') => return open_project(cfg, args, state, &tmux::secondary(project)?),
+            Key::Ctrl('x') if cfg.is_protected(project) => {
+                println!("not killing protected session {}", project.session_name);
+            }
+            Key::Ctrl('x') => {
+                let question = format!("kill session {}?", project.session_name);
+                if confirm(&question, args.yes || args.dry_run)?
+                    && Tmux::new(project).dry_run(args.dry_run).kill()?
+                {
+                    println!("killed session {}", project.session_name);
+                }
+            }
+            Key::Ctrl('e') => edit(&project.full_path)?,
+            Key::Ctrl('t') => tag(state, &project.full_path)?,
+            Key::Ctrl('h') => undo::hide(state, &project.full_path),
+            Key::Alt('o') => set_opener(state, &project.full_path)?,
+            Key::Alt('b') => browse::run(project, args.dry_run)?,
+            Key::Alt('y') => clipboard::copy(&project.full_path)?,
+            Key::Alt('f') => return open_file(cfg, args, state, project),
+            Key::Alt('c') => {
+                if checkout_default(cache, project, args.dry_run, args.offline)? {
+                    return open_project(cfg, args, state, project);
+                }
+            }
+            _ => return open_project(cfg, args, state, project),
+        }
+    }
+}
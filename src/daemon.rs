@@ -0,0 +1,359 @@
+//! `project daemon`: keeps the cache current in the background so the picker
+//! starts with a complete list
+
+use eyre::{Result, WrapErr};
+use serde::{Deserialize, Serialize};
+use std::{
+    io::{BufRead, BufReader, Write},
+    os::unix::net::{UnixListener, UnixStream},
+    path::{Path, PathBuf},
+    sync::{Arc, Mutex},
+    time::{Duration, Instant, SystemTime},
+};
+
+use crate::{
+    duration::{elapsed, HumanDuration},
+    scan_roots,
+    signals::Flags,
+    state::State,
+    usage::now,
+    Cache, Config, RootDir,
+};
+
+/// How often the config file is checked for changes
+const CONFIG_POLL_INTERVAL: Duration = Duration::from_secs(2);
+
+/// A changed config file is applied once it has stopped changing for this
+/// long, so that an editor writing it in steps or a burst of saves leads to
+/// one reload and rescan rather than one each
+const CONFIG_SETTLE: Duration = Duration::from_secs(1);
+
+/// The main loop is wedged if it has not come round for this long. Scans
+/// happen on the loop too, so this allows for a slow one.
+const WEDGED_AFTER: Duration = Duration::from_secs(5 * 60);
+
+/// How long `project daemon status` waits for an answer
+const STATUS_TIMEOUT: Duration = Duration::from_secs(2);
+
+/// Where the daemon listens, in the runtime directory so it does not
+/// outlive a reboot
+pub(crate) fn socket_path() -> Result<PathBuf> {
+    let dir = dirs::runtime_dir()
+        .or_else(dirs::cache_dir)
+        .unwrap_or_else(std::env::temp_dir)
+        .join("project");
+    std::fs::create_dir_all(&dir).wrap_err("creating socket directory")?;
+    Ok(dir.join("daemon.sock"))
+}
+
+/// What the daemon reports over its socket; times are seconds since the
+/// unix epoch
+#[derive(Debug, Clone, Serialize, Deserialize)]
+struct Status {
+    pid: u32,
+    started_at: u64,
+    /// when the main loop last came round
+    heartbeat: u64,
+    last_scan: Option<u64>,
+    projects: usize,
+    socket: PathBuf,
+}
+
+type SharedStatus = Arc<Mutex<Status>>;
+
+fn serve(listener: UnixListener, status: SharedStatus) {
+    for stream in listener.incoming() {
+        let stream = match stream {
+            Ok(stream) => stream,
+            Err(e) => {
+                log::warn!("accepting connection: {:?}", e);
+                continue;
+            }
+        };
+        if let Err(e) = answer(stream, &status) {
+            log::warn!("answering request: {:?}", e);
+        }
+    }
+}
+
+fn answer(stream: UnixStream, status: &SharedStatus) -> Result<()> {
+    stream.set_read_timeout(Some(STATUS_TIMEOUT))?;
+    let mut line = String::new();
+    BufReader::new(&stream).read_line(&mut line)?;
+    let mut stream = &stream;
+    match line.trim() {
+        "status" => {
+            let status = status.lock().unwrap().clone();
+            serde_json::to_writer(&mut stream, &status)?;
+            writeln!(stream)?;
+        }
+        other => writeln!(stream, "unknown request {:?}", other)?,
+    }
+    Ok(())
+}
+
+/// Listen on the daemon socket, refusing to start if another daemon answers
+fn listen(path: &Path) -> Result<UnixListener> {
+    if UnixStream::connect(path).is_ok() {
+        eyre::bail!("a daemon is already listening on {}", path.display());
+    }
+    // left behind by a daemon which did not shut down cleanly
+    let _ = std::fs::remove_file(path);
+    UnixListener::bind(path).wrap_err_with(|| format!("listening on {}", path.display()))
+}
+
+fn human_age(at: u64) -> String {
+    format!("{} ago", elapsed(now().saturating_sub(at)))
+}
+
+/// `project daemon status`
+pub(crate) fn status() -> Result<()> {
+    let path = socket_path()?;
+    let stream = UnixStream::connect(&path)
+        .wrap_err_with(|| format!("no daemon is listening on {}", path.display()))?;
+    stream.set_read_timeout(Some(STATUS_TIMEOUT))?;
+    let mut writer = &stream;
+    writeln!(writer, "status")?;
+    let mut line = String::new();
+    BufReader::new(&stream)
+        .read_line(&mut line)
+        .wrap_err("daemon did not answer, it may be wedged")?;
+    let status: Status = serde_json::from_str(&line).wrap_err("parsing daemon status")?;
+
+    println!("pid:        {}", status.pid);
+    println!(
+        "uptime:     {}",
+        elapsed(now().saturating_sub(status.started_at))
+    );
+    println!(
+        "last scan:  {}",
+        status.last_scan.map_or("never".to_string(), human_age)
+    );
+    println!("projects:   {}", status.projects);
+    println!("socket:     {}", status.socket.display());
+
+    if now().saturating_sub(status.heartbeat) > WEDGED_AFTER.as_secs() {
+        eyre::bail!(
+            "daemon is wedged, its main loop last ran {}",
+            human_age(status.heartbeat)
+        );
+    }
+    Ok(())
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+pub(crate) struct DaemonConfig {
+    /// how often every root is rescanned
+    #[serde(default = "default_scan_interval")]
+    scan_interval: HumanDuration,
+}
+
+fn default_scan_interval() -> HumanDuration {
+    HumanDuration(Duration::from_secs(10 * 60))
+}
+
+impl Default for DaemonConfig {
+    fn default() -> Self {
+        Self {
+            scan_interval: default_scan_interval(),
+        }
+    }
+}
+
+fn modified(path: &Path) -> Option<SystemTime> {
+    std::fs::metadata(path).and_then(|m| m.modified()).ok()
+}
+
+/// What a config change means for the index
+#[derive(Debug, Default, PartialEq, Eq)]
+struct Changes {
+    /// roots which are new or whose settings changed, to be indexed afresh
+    reindex: Vec<PathBuf>,
+    /// roots which are no longer configured
+    removed: Vec<PathBuf>,
+    /// whether the exclusions changed, which can affect any root
+    excludes: bool,
+}
+
+fn find<'a>(cfg: &'a Config, path: &Path) -> Option<&'a RootDir> {
+    cfg.root_dirs.iter().find(|dir| dir.path == path)
+}
+
+fn changes(old: &Config, new: &Config) -> Changes {
+    Changes {
+        reindex: new
+            .root_dirs
+            .iter()
+            .filter(|dir| find(old, &dir.path) != Some(*dir))
+            .map(|dir| dir.path.clone())
+            .collect(),
+        removed: old
+            .root_dirs
+            .iter()
+            .filter(|dir| find(new, &dir.path).is_none())
+            .map(|dir| dir.path.clone())
+            .collect(),
+        excludes: old.exclude != new.exclude,
+    }
+}
+
+/// Forget the cached projects which `old` indexed under the given roots
+fn forget(cache: &Cache, old: &Config, roots: &[PathBuf]) {
+    for project in cache.initial_paths() {
+        let root = old.root_for(&project.full_path).map(|dir| &dir.path);
+        if root.map_or(false, |root| roots.contains(root)) {
+            cache.remove(&project.full_path);
+        }
+    }
+}
+
+/// Rescan the roots `include` picks, saving the cache afterwards. The cache
+/// is loaded each time so that changes other commands make, such as
+/// `project manage` removing projects, are not undone.
+fn rescan<I>(cfg: &Config, status: &SharedStatus, offline: bool, include: I) -> Result<()>
+where
+    I: Fn(&RootDir) -> bool,
+{
+    // the state is read afresh each time for entries added with `project ignore`
+    let state = State::open_read_only().wrap_err("reading state")?;
+    let excludes = cfg.excludes(&state);
+    let cache = Cache::new(false).wrap_err("loading cache")?;
+    let start = Instant::now();
+    let mut found = 0;
+    let report = scan_roots(cfg, &cache, &excludes, offline, include, |_| found += 1);
+    log::info!("scan found {} new projects in {:?}", found, start.elapsed());
+    log::debug!("{}", report.to_string().trim_end());
+    let mut status = status.lock().unwrap();
+    status.last_scan = Some(now());
+    status.projects = cache.initial_paths().len();
+    Ok(())
+}
+
+/// Apply a changed config file, reindexing only the roots it affects
+fn reload(old: &Config, new: &Config, status: &SharedStatus, offline: bool) -> Result<()> {
+    let changes = changes(old, new);
+    log::info!("config changed: {:?}", changes);
+
+    {
+        // saved when dropped, before the rescan loads it again
+        let cache = Cache::new(false).wrap_err("loading cache")?;
+        let mut stale = changes.removed.clone();
+        // remote roots are not rescanned offline, so their projects are kept
+        stale.extend(
+            changes
+                .reindex
+                .iter()
+                .filter(|path| !(offline && find(new, path).map_or(false, RootDir::is_remote)))
+                .cloned(),
+        );
+        forget(&cache, old, &stale);
+
+        if changes.excludes {
+            let state = State::open_read_only().wrap_err("reading state")?;
+            let excludes = new.excludes(&state);
+            for project in cache.initial_paths() {
+                if excludes.matches(&project.full_path) {
+                    cache.remove(&project.full_path);
+                }
+            }
+        }
+    }
+
+    if changes.excludes {
+        // projects which are no longer excluded could be under any root
+        rescan(new, status, offline, |_| true)
+    } else {
+        rescan(new, status, offline, |dir| {
+            changes.reindex.contains(&dir.path)
+        })
+    }
+}
+
+pub(crate) fn run(mut cfg: Config, config_path: PathBuf, offline: bool) -> Result<()> {
+    let signals = Flags::register()?;
+    let socket = socket_path()?;
+    let listener = listen(&socket)?;
+    let status = Arc::new(Mutex::new(Status {
+        pid: std::process::id(),
+        started_at: now(),
+        heartbeat: now(),
+        last_scan: None,
+        projects: 0,
+        socket,
+    }));
+    let serve_status = Arc::clone(&status);
+    std::thread::spawn(move || serve(listener, serve_status));
+
+    let mut config_modified = modified(&config_path);
+    let mut config_changed_at: Option<Instant> = None;
+
+    rescan(&cfg, &status, offline, |_| true)?;
+    let mut last_scan = Instant::now();
+
+    loop {
+        std::thread::sleep(CONFIG_POLL_INTERVAL);
+        status.lock().unwrap().heartbeat = now();
+
+        if signals.terminated() {
+            // each scan has already saved the cache, so only the socket is
+            // left to tidy up
+            let _ = std::fs::remove_file(&status.lock().unwrap().socket);
+            return Ok(());
+        }
+
+        let current = modified(&config_path);
+        if current != config_modified {
+            config_modified = current;
+            config_changed_at = Some(Instant::now());
+        } else if config_changed_at.map_or(false, |at| at.elapsed() >= CONFIG_SETTLE) {
+            config_changed_at = None;
+            // keep going with the old config until the file is fixed
+            match Config::open(config_path.clone()) {
+                Ok(new) => match reload(&cfg, &new, &status, offline) {
+                    Ok(()) => cfg = new,
+                    Err(e) => log::warn!("applying config: {:?}", e),
+                },
+                Err(e) => log::warn!("reloading config: {:?}", e),
+            }
+        }
+
+        if signals.take_rescan() || last_scan.elapsed() >= cfg.daemon.scan_interval.0 {
+            // tried again at the next interval rather than straight away
+            if let Err(e) = rescan(&cfg, &status, offline, |_| true) {
+                log::warn!("rescanning: {:?}", e);
+            }
+            last_scan = Instant::now();
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn config_changes() {
+        let root = |path: &str, weight: i64| RootDir {
+            path: PathBuf::from(path),
+            weight,
+            ..Default::default()
+        };
+        let old = Config {
+            root_dirs: vec![root("/work", 0), root("/oss", 0), root("/old", 0)],
+            ..Default::default()
+        };
+        let new = Config {
+            root_dirs: vec![root("/work", 0), root("/oss", 5), root("/new", 0)],
+            exclude: vec!["vendor".to_string()],
+            ..Default::default()
+        };
+        assert_eq!(
+            changes(&old, &new),
+            Changes {
+                reindex: vec![PathBuf::from("/oss"), PathBuf::from("/new")],
+                removed: vec![PathBuf::from("/old")],
+                excludes: true,
+            }
+        );
+    }
+}
@@ -0,0 +1,141 @@
+use eyre::Result;
+use std::{
+    collections::BTreeMap,
+    path::{Path, PathBuf},
+};
+
+use crate::{toml_string, Config};
+
+/// Directories never worth descending into when looking for repositories
+const SKIP: &[&str] = &["node_modules", "target", "Library", "vendor"];
+
+/// Repositories beneath `dir`, looking at most `depth` levels down and not
+/// descending into hidden directories or the repositories themselves
+fn find_repos(dir: &Path, depth: usize, repos: &mut Vec<PathBuf>) {
+    if dir.join(".git").is_dir() {
+        repos.push(dir.to_path_buf());
+        return;
+    }
+    if depth == 0 {
+        return;
+    }
+    let entries = match std::fs::read_dir(dir) {
+        Ok(entries) => entries,
+        Err(_) => return,
+    };
+    for entry in entries.filter_map(|e| e.ok()) {
+        let name = entry.file_name();
+        let name = name.to_string_lossy();
+        if name.starts_with('.') || SKIP.contains(&name.as_ref()) {
+            continue;
+        }
+        if entry.file_type().map(|t| t.is_dir()).unwrap_or(false) {
+            find_repos(&entry.path(), depth - 1, repos);
+        }
+    }
+}
+
+/// The outermost directories below `home` holding at least `min_repos` of
+/// `repos`, with the number of repositories beneath each
+fn suggest(home: &Path, repos: &[PathBuf], min_repos: usize) -> Vec<(PathBuf, usize)> {
+    let mut counts: BTreeMap<&Path, usize> = BTreeMap::new();
+    for repo in repos {
+        for ancestor in repo.ancestors().skip(1) {
+            if ancestor == home || !ancestor.starts_with(home) {
+                break;
+            }
+            *counts.entry(ancestor).or_default() += 1;
+        }
+    }
+
+    let dense = |dir: &Path| counts.get(dir).map_or(false, |n| *n >= min_repos);
+    counts
+        .iter()
+        .filter(|(dir, n)| **n >= min_repos && !dir.ancestors().skip(1).any(dense))
+        .map(|(dir, n)| (dir.to_path_buf(), *n))
+        .collect()
+}
+
+pub(crate) fn run(cfg: &Config, depth: usize, min_repos: usize) -> Result<()> {
+    let home = dirs::home_dir().ok_or_else(|| eyre::eyre!("finding home directory"))?;
+    let mut repos = Vec::new();
+    find_repos(&home, depth, &mut repos);
+    // repositories under an existing root are already taken care of
+    repos.retain(|repo| !cfg.root_dirs.iter().any(|dir| repo.starts_with(&dir.path)));
+
+    let suggestions = suggest(&home, &repos, min_repos);
+    if suggestions.is_empty() {
+        eprintln!(
+            "no directories with {} or more repositories outside the configured roots",
+            min_repos
+        );
+        return Ok(());
+    }
+
+    println!("# add these to the config file");
+    print!("{}", root_dirs(&home, &suggestions));
+    Ok(())
+}
+
+/// `[[root_dirs]]` entries for the suggested directories, with paths
+/// relative to `home` written with `~`
+fn root_dirs(home: &Path, suggestions: &[(PathBuf, usize)]) -> String {
+    let mut out = String::new();
+    for (dir, n) in suggestions {
+        let relative = dir.strip_prefix(home).unwrap_or(dir);
+        out.push_str(&format!(
+            "\n# {} repositories\n[[root_dirs]]\npath = {}\n",
+            n,
+            toml_string(&format!("~/{}", relative.display()))
+        ));
+    }
+    out
+}
+
+/// Roots for a first config file, found as `project discover` does with its
+/// default settings
+pub(crate) fn starter_roots() -> Option<String> {
+    let home = dirs::home_dir()?;
+    let mut repos = Vec::new();
+    find_repos(&home, 4, &mut repos);
+    let suggestions = suggest(&home, &repos, 3);
+    (!suggestions.is_empty()).then(|| root_dirs(&home, &suggestions))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn suggestions() {
+        let home = Path::new("/home/me");
+        let repos: Vec<PathBuf> = [
+            "/home/me/src/a",
+            "/home/me/src/b",
+            "/home/me/src/team/c",
+            "/home/me/notes",
+            "/home/me/clients/x/one",
+            "/home/me/clients/y/two",
+        ]
+        .iter()
+        .map(PathBuf::from)
+        .collect();
+
+        assert_eq!(
+            suggest(home, &repos, 2),
+            vec![
+                (PathBuf::from("/home/me/clients"), 2),
+                (PathBuf::from("/home/me/src"), 3),
+            ]
+        );
+
+        // what is printed is pasted into the config file as it is
+        let odd = PathBuf::from("/home/me/cafe\u{301} \"old\"");
+        let toml = root_dirs(home, &[(odd, 3)]);
+        let value: toml::Value = toml::from_str(&toml).unwrap();
+        assert_eq!(
+            value["root_dirs"][0]["path"].as_str(),
+            Some("~/cafe\u{301} \"old\"")
+        );
+    }
+}
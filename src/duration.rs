@@ -0,0 +1,105 @@
+use std::time::Duration;
+
+use serde::{Deserialize, Deserializer, Serialize, Serializer};
+
+/// A rough length of time in its two largest units, e.g. "3h05m"
+pub(crate) fn elapsed(secs: u64) -> String {
+    match secs {
+        s if s >= 86400 => format!("{}d{:02}h", s / 86400, s % 86400 / 3600),
+        s if s >= 3600 => format!("{}h{:02}m", s / 3600, s % 3600 / 60),
+        s if s >= 60 => format!("{}m{:02}s", s / 60, s % 60),
+        s => format!("{}s", s),
+    }
+}
+
+/// A duration written like "90s", "30m", "12h", "7d" or "2w"
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub(crate) struct HumanDuration(pub(crate) Duration);
+
+impl std::str::FromStr for HumanDuration {
+    type Err = String;
+
+    fn from_str(s: &str) -> std::result::Result<Self, Self::Err> {
+        let s = s.trim();
+        let split = s
+            .find(|c: char| !c.is_ascii_digit())
+            .ok_or_else(|| format!("duration {:?} has no unit, e.g. 7d", s))?;
+        let (count, unit) = s.split_at(split);
+        let count: u64 = count
+            .parse()
+            .map_err(|_| format!("duration {:?} does not start with a number", s))?;
+        let secs = match unit {
+            "s" => 1,
+            "m" => 60,
+            "h" => 60 * 60,
+            "d" => 24 * 60 * 60,
+            "w" => 7 * 24 * 60 * 60,
+            other => {
+                return Err(format!(
+                    "unknown duration unit {:?}, expected s, m, h, d or w",
+                    other
+                ))
+            }
+        };
+        let secs = count
+            .checked_mul(secs)
+            .ok_or_else(|| format!("duration {:?} is too long", s))?;
+        Ok(HumanDuration(Duration::from_secs(secs)))
+    }
+}
+
+impl<'de> Deserialize<'de> for HumanDuration {
+    fn deserialize<D>(deserializer: D) -> std::result::Result<Self, D::Error>
+    where
+        D: Deserializer<'de>,
+    {
+        // owned, as not every format can lend out the original text
+        let s: String = Deserialize::deserialize(deserializer)?;
+        s.parse().map_err(serde::de::Error::custom)
+    }
+}
+
+impl std::fmt::Display for HumanDuration {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let secs = self.0.as_secs();
+        let units = [
+            (7 * 24 * 60 * 60, "w"),
+            (24 * 60 * 60, "d"),
+            (60 * 60, "h"),
+            (60, "m"),
+        ];
+        match units.iter().find(|(size, _)| secs > 0 && secs % size == 0) {
+            Some((size, unit)) => write!(f, "{}{}", secs / size, unit),
+            None => write!(f, "{}s", secs),
+        }
+    }
+}
+
+impl Serialize for HumanDuration {
+    fn serialize<S>(&self, serializer: S) -> std::result::Result<S::Ok, S::Error>
+    where
+        S: Serializer,
+    {
+        serializer.collect_str(self)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn parsing() {
+        let parse = |s: &str| s.parse::<HumanDuration>().map(|d| d.0.as_secs());
+        assert_eq!(parse("90s"), Ok(90));
+        assert_eq!(parse("12h"), Ok(12 * 60 * 60));
+        assert_eq!(parse("180d"), Ok(180 * 24 * 60 * 60));
+        assert!(parse("180").is_err());
+        assert!(parse("d").is_err());
+        assert!(parse("3y").is_err());
+        assert!(parse("99999999999999999w").is_err());
+
+        assert_eq!("14d".parse::<HumanDuration>().unwrap().to_string(), "2w");
+        assert_eq!("90s".parse::<HumanDuration>().unwrap().to_string(), "90s");
+    }
+}
@@ -0,0 +1,142 @@
+//! Projects left out of scans, from the config file's `exclude` globs and
+//! the entries added with `project ignore`
+
+use eyre::Result;
+use std::path::Path;
+
+use crate::{state::State, tilde, Cache, Config};
+
+/// Exclusion patterns with `~` expanded
+pub(crate) struct Excludes {
+    patterns: Vec<String>,
+}
+
+impl Excludes {
+    pub(crate) fn new<I, S>(patterns: I) -> Self
+    where
+        I: IntoIterator<Item = S>,
+        S: AsRef<str>,
+    {
+        Self {
+            patterns: patterns
+                .into_iter()
+                .map(|p| tilde::expand(p.as_ref().trim_end_matches('/')).into_owned())
+                .collect(),
+        }
+    }
+
+    /// Whether the project at `full_path`, or a directory containing it, is
+    /// excluded
+    pub(crate) fn matches(&self, full_path: &str) -> bool {
+        self.matching(full_path).is_some()
+    }
+
+    /// The first pattern excluding the project at `full_path`
+    pub(crate) fn matching(&self, full_path: &str) -> Option<&str> {
+        self.patterns
+            .iter()
+            .find(|pattern| {
+                Path::new(full_path)
+                    .ancestors()
+                    .any(|dir| pattern_matches(pattern, &dir.to_string_lossy()))
+            })
+            .map(String::as_str)
+    }
+}
+
+/// Patterns without a slash match a directory name anywhere, like gitignore;
+/// others match the whole path
+fn pattern_matches(pattern: &str, path: &str) -> bool {
+    let pattern: Vec<char> = pattern.chars().collect();
+    if pattern.contains(&'/') {
+        let path: Vec<char> = path.chars().collect();
+        glob_match(&pattern, &path)
+    } else {
+        let name = path.rsplit('/').next().unwrap_or(path);
+        let name: Vec<char> = name.chars().collect();
+        glob_match(&pattern, &name)
+    }
+}
+
+/// Match `*` (within a path component), `**` (across components) and `?`
+fn glob_match(pattern: &[char], s: &[char]) -> bool {
+    match pattern.first() {
+        None => s.is_empty(),
+        Some('*') if pattern.get(1) == Some(&'*') => {
+            (0..=s.len()).any(|i| glob_match(&pattern[2..], &s[i..]))
+        }
+        Some('*') => (0..=s.len())
+            .take_while(|&i| i == 0 || s[i - 1] != '/')
+            .any(|i| glob_match(&pattern[1..], &s[i..])),
+        Some('?') => s.first().map_or(false, |c| *c != '/') && glob_match(&pattern[1..], &s[1..]),
+        Some(c) => s.first() == Some(c) && glob_match(&pattern[1..], &s[1..]),
+    }
+}
+
+/// `project ignore`: list, add or remove ignore entries
+pub(crate) fn run(
+    cfg: &Config,
+    cache: &Cache,
+    state: &State,
+    pattern: Option<String>,
+    remove: bool,
+) -> Result<()> {
+    let pattern = match pattern {
+        Some(pattern) => pattern,
+        None => {
+            for pattern in &cfg.exclude {
+                println!("{}  (config)", pattern);
+            }
+            for pattern in state.ignored() {
+                println!("{}", pattern);
+            }
+            return Ok(());
+        }
+    };
+    // existing directories are stored as absolute paths so they can be given
+    // relative to wherever the command is run
+    let pattern = match std::fs::canonicalize(tilde::expand(&pattern).as_ref()) {
+        Ok(path) => path.to_string_lossy().into_owned(),
+        Err(_) => pattern,
+    };
+
+    if remove {
+        if !state.unignore(&pattern) {
+            eyre::bail!("{} is not ignored", pattern);
+        }
+        println!(
+            "no longer ignoring {}, it will be picked up by the next scan",
+            pattern
+        );
+        return Ok(());
+    }
+
+    state.ignore(&pattern);
+    let excludes = Excludes::new([&pattern]);
+    let mut removed = 0;
+    for project in cache.initial_paths() {
+        if excludes.matches(&project.full_path) {
+            cache.remove(&project.full_path);
+            removed += 1;
+        }
+    }
+    println!("ignoring {}, removed {} cached projects", pattern, removed);
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn globs() {
+        let excludes = Excludes::new(["node_modules", "/srv/*/scratch", "/opt/**/tmp-?"]);
+        assert!(excludes.matches("/home/me/web/node_modules/left-pad"));
+        assert!(excludes.matches("/srv/team/scratch"));
+        assert!(excludes.matches("/srv/team/scratch/inner"));
+        assert!(!excludes.matches("/srv/team/deep/scratch"));
+        assert!(excludes.matches("/opt/a/b/tmp-1"));
+        assert!(!excludes.matches("/opt/a/b/tmp-12"));
+        assert!(!excludes.matches("/home/me/modules"));
+    }
+}
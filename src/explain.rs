@@ -0,0 +1,131 @@
+//! `project explain <path>`: whether a directory would be indexed, and if
+//! not what stops it
+
+use eyre::{Result, WrapErr};
+use std::path::Path;
+
+use crate::{state::State, tilde, Cache, Config, RootDir};
+
+/// Why the walk beneath `root` would never reach `path`, if it would not.
+/// Hidden directories are skipped by the walk, and `max_depth` counts the
+/// root's children as depth 1.
+fn unreachable(root: &RootDir, path: &Path) -> Option<String> {
+    let relative = path.strip_prefix(&root.path).ok()?;
+    if let Some(hidden) = relative
+        .components()
+        .map(|c| c.as_os_str().to_string_lossy())
+        .find(|name| name.starts_with('.'))
+    {
+        return Some(format!("it is inside the hidden directory {}", hidden));
+    }
+    let depth = relative.components().count();
+    match root.max_depth {
+        Some(max) if depth > max => Some(format!(
+            "it is {} levels below the root, which has max_depth = {}",
+            depth, max
+        )),
+        _ => None,
+    }
+}
+
+pub(crate) fn run(cfg: &Config, cache: &Cache, state: &State, path: &str) -> Result<()> {
+    let expanded = tilde::expand(path).into_owned();
+    let full_path = std::fs::canonicalize(&expanded)
+        .wrap_err_with(|| format!("reading {}", expanded))?
+        .to_string_lossy()
+        .into_owned();
+    println!("{}", full_path);
+
+    let mut blockers = Vec::new();
+
+    // the scan names projects by the path it walked, which may be a symlink
+    // to the canonical one
+    let root = cfg
+        .root_for(&expanded)
+        .map(|root| (root, Path::new(&expanded)))
+        .or_else(|| {
+            cfg.root_for(&full_path)
+                .map(|root| (root, Path::new(&full_path)))
+        });
+    match root {
+        Some((root, walked)) => {
+            println!("  root:     {}", root.path.display());
+            if let Some(reason) = unreachable(root, walked) {
+                blockers.push(reason);
+            }
+        }
+        None => {
+            println!("  root:     none");
+            blockers.push("it is not beneath any root_dirs entry".to_string());
+        }
+    }
+
+    let git = Path::new(&full_path).join(".git");
+    if git.is_dir() {
+        println!("  marker:   .git directory");
+    } else if git.exists() {
+        println!("  marker:   .git file (a worktree or submodule)");
+        blockers.push("only directories with a .git directory are projects".to_string());
+    } else {
+        println!("  marker:   none");
+        blockers.push("it has no .git directory".to_string());
+    }
+
+    if cfg.is_archived(&full_path) {
+        blockers.push("it is in the archive root".to_string());
+    }
+    if let Some(pattern) = cfg.excludes(state).matching(&full_path) {
+        let from_ignore = state
+            .ignored()
+            .iter()
+            .any(|p| tilde::expand(p.trim_end_matches('/')) == pattern);
+        let source = if from_ignore {
+            "`project ignore`"
+        } else {
+            "exclude in the config file"
+        };
+        blockers.push(format!("it matches {:?} from {}", pattern, source));
+    }
+
+    match cache.lookup(&full_path) {
+        Some(project) => println!("  cached:   yes, as {:?}", project.session_name),
+        None => println!("  cached:   no"),
+    }
+
+    if blockers.is_empty() {
+        println!("would be indexed");
+        if state.is_hidden(&full_path) {
+            println!("but it was hidden from the picker with ctrl-h");
+        }
+    } else {
+        println!("would not be indexed because:");
+        for reason in blockers {
+            println!("  - {}", reason);
+        }
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::path::PathBuf;
+
+    #[test]
+    fn unreachable_paths() {
+        let root = RootDir {
+            path: PathBuf::from("/work"),
+            max_depth: Some(2),
+            ..Default::default()
+        };
+        assert_eq!(unreachable(&root, Path::new("/work/a/b")), None);
+        assert_eq!(
+            unreachable(&root, Path::new("/work/a/b/c")),
+            Some("it is 3 levels below the root, which has max_depth = 2".to_string())
+        );
+        assert_eq!(
+            unreachable(&root, Path::new("/work/.old/b")),
+            Some("it is inside the hidden directory .old".to_string())
+        );
+    }
+}
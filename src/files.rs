@@ -0,0 +1,155 @@
+//! A second picker for a file within the chosen project, opened in the
+//! editor in a new window of the project's session
+
+use eyre::{Result, WrapErr};
+use std::{
+    borrow::Cow,
+    collections::HashMap,
+    path::Path,
+    process::Command,
+    sync::{Arc, RwLock},
+    time::{Duration, SystemTime},
+};
+
+use crate::{git::output_with_timeout, remote, tmux::shell_quote, ProjectPath, SkimOptionsFromEnv};
+
+/// How long the preview waits for git to list a project's files
+const LIST_TIMEOUT: Duration = Duration::from_millis(300);
+
+struct FileItem(String);
+
+impl skim::SkimItem for FileItem {
+    fn text(&self) -> Cow<str> {
+        Cow::Borrowed(&self.0)
+    }
+}
+
+/// The user's editor, which may carry its own arguments such as "code -w"
+pub(crate) fn editor() -> String {
+    std::env::var("VISUAL")
+        .or_else(|_| std::env::var("EDITOR"))
+        .unwrap_or_else(|_| "vi".to_string())
+}
+
+/// Shell command opening `file` in the editor
+pub(crate) fn edit_command(file: &str) -> String {
+    format!("{} {}", editor(), shell_quote(file))
+}
+
+fn tracked(full_path: &str) -> Result<Vec<String>> {
+    let output = Command::new("git")
+        .arg("-C")
+        .arg(full_path)
+        .args(["ls-files", "-z"])
+        .output()
+        .wrap_err("running git ls-files")?;
+    if !output.status.success() {
+        eyre::bail!(
+            "git ls-files failed: {}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    Ok(String::from_utf8_lossy(&output.stdout)
+        .split('\0')
+        .filter(|f| !f.is_empty())
+        .map(str::to_string)
+        .collect())
+}
+
+/// The `n` tracked files modified most recently, newest first, with how many
+/// seconds ago each was modified. Quietly empty if git is slow or fails, as
+/// this is only for the preview.
+fn recently_modified(full_path: &str, n: usize) -> Vec<(String, u64)> {
+    if remote::is_remote(full_path) {
+        return Vec::new();
+    }
+    let listing = match output_with_timeout(
+        Command::new("git")
+            .arg("-C")
+            .arg(full_path)
+            .args(["ls-files", "-z"]),
+        LIST_TIMEOUT,
+    ) {
+        Some(listing) => listing,
+        None => return Vec::new(),
+    };
+    let now = SystemTime::now();
+    let mut files: Vec<(String, u64)> = listing
+        .split('\0')
+        .filter(|f| !f.is_empty())
+        .filter_map(|f| {
+            let modified = std::fs::metadata(Path::new(full_path).join(f))
+                .and_then(|m| m.modified())
+                .ok()?;
+            let age = now.duration_since(modified).unwrap_or_default();
+            Some((f.to_string(), age.as_secs()))
+        })
+        .collect();
+    files.sort_by_key(|(_, age)| *age);
+    files.truncate(n);
+    files
+}
+
+pub(crate) type RecentStore = RwLock<HashMap<String, Vec<(String, u64)>>>;
+
+/// Finds recently modified files on a background thread as projects are
+/// previewed, since statting every file of a large repository would hold up
+/// the picker
+pub(crate) struct RecentFiles {
+    store: Arc<RecentStore>,
+    tx: crossbeam_channel::Sender<String>,
+}
+
+impl RecentFiles {
+    pub(crate) fn start(n: usize) -> Self {
+        let store = Arc::new(RecentStore::default());
+        let (tx, rx) = crossbeam_channel::unbounded::<String>();
+        let thread_store = Arc::clone(&store);
+        std::thread::spawn(move || {
+            for path in rx.iter() {
+                // each preview asks again, but once is enough
+                if thread_store.read().unwrap().contains_key(&path) {
+                    continue;
+                }
+                let recent = recently_modified(&path, n);
+                thread_store.write().unwrap().insert(path, recent);
+            }
+        });
+        Self { store, tx }
+    }
+
+    pub(crate) fn request(&self, full_path: &str) {
+        let _ = self.tx.send(full_path.to_string());
+    }
+
+    /// The project's recently modified files, once they have been found
+    pub(crate) fn get(&self, full_path: &str) -> Option<Vec<(String, u64)>> {
+        self.store.read().unwrap().get(full_path).cloned()
+    }
+}
+
+/// Choose one of the files git tracks in the project, `None` if the picker
+/// is closed without choosing
+pub(crate) fn pick(project: &ProjectPath) -> Result<Option<String>> {
+    let files = tracked(&project.full_path)?;
+    if files.is_empty() {
+        eyre::bail!("git tracks no files in {}", project.full_path);
+    }
+    let (tx, rx): (skim::SkimItemSender, skim::SkimItemReceiver) = crossbeam_channel::unbounded();
+    for file in files {
+        let _ = tx.send(Arc::new(FileItem(file)));
+    }
+    drop(tx);
+
+    let header = format!("files in {}", project.session_name);
+    let mut options = skim::SkimOptions::from_env();
+    options.header = Some(&header);
+    Ok(skim::Skim::run_with(&options, Some(rx))
+        .filter(|result| !result.is_abort)
+        .and_then(|result| {
+            result
+                .selected_items
+                .first()
+                .map(|item| item.output().into_owned())
+        }))
+}
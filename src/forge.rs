@@ -0,0 +1,636 @@
+//! Open pull requests, issues and the CI status of the default branch from
+//! the forge hosting a project, fetched in the background for the preview and
+//! the CI column and cached for a while. Each kind of forge is a [`Provider`],
+//! picked by the host of the project's origin remote
+
+use eyre::{Result, WrapErr};
+use serde::{Deserialize, Serialize};
+use serde_json::{json, Value};
+use std::{
+    collections::{BTreeMap, HashMap},
+    io::Write,
+    path::{Path, PathBuf},
+    process::{Command, Stdio},
+    sync::{Arc, RwLock},
+    time::Duration,
+};
+
+use crate::{cache_file, duration::HumanDuration, git, secret::Secret, usage::now};
+
+#[derive(Debug, Serialize, Deserialize)]
+pub(crate) struct ForgeConfig {
+    /// how long fetched details are used before they are fetched again
+    #[serde(default = "default_ttl")]
+    ttl: HumanDuration,
+    /// show a pass/fail glyph for the default branch next to each project
+    #[serde(default)]
+    pub(crate) ci_column: bool,
+    /// the kind of forge on self-hosted hosts, github.com and gitlab.com are
+    /// known already
+    #[serde(default)]
+    providers: BTreeMap<String, ProviderKind>,
+}
+
+#[derive(Debug, Clone, Copy, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub(crate) enum ProviderKind {
+    Github,
+    Gitlab,
+}
+
+/// A forge API which can report on a repository
+trait Provider: Send {
+    /// `path` is the repository's path on the host, e.g. "owner/repo"
+    fn fetch(&self, path: &str, token: &str) -> Result<ForgeInfo>;
+
+    /// Every repository of a user, organisation or group
+    fn repositories(&self, owner: &str, token: &str) -> Result<Vec<RemoteRepo>>;
+}
+
+/// A repository listed for `project mirror`
+#[derive(Debug, PartialEq, Eq)]
+pub(crate) struct RemoteRepo {
+    /// the path below the owner, which takes in subgroups on GitLab
+    pub(crate) name: String,
+    pub(crate) ssh_url: String,
+    pub(crate) https_url: String,
+    pub(crate) archived: bool,
+    pub(crate) fork: bool,
+}
+
+/// The repositories of `owner` on `host`, for hosts [`provider`] knows
+pub(crate) fn repositories(
+    cfg: Option<&ForgeConfig>,
+    host: &str,
+    owner: &str,
+    token: &str,
+) -> Result<Vec<RemoteRepo>> {
+    let kinds = cfg.map(|cfg| cfg.providers.clone()).unwrap_or_default();
+    let provider = provider(host, &kinds).ok_or_else(|| {
+        eyre::eyre!(
+            "{} is not a known forge, add it to [forge.providers] in the config file",
+            host
+        )
+    })?;
+    provider.repositories(owner, token)
+}
+
+/// Follow a connection's pages, `page` parsing one response into its
+/// repositories and the cursor of the next page
+fn paginate<F>(mut request: F) -> Result<Vec<RemoteRepo>>
+where
+    F: FnMut(Option<&str>) -> Result<(Vec<RemoteRepo>, Option<String>)>,
+{
+    let mut repos = Vec::new();
+    let mut cursor = None;
+    loop {
+        let (page, next) = request(cursor.as_deref())?;
+        repos.extend(page);
+        match next {
+            Some(next) => cursor = Some(next),
+            None => return Ok(repos),
+        }
+    }
+}
+
+/// The cursor of the page after `connection`'s, if there is one
+fn next_cursor(connection: &Value) -> Option<String> {
+    let page_info = &connection["pageInfo"];
+    if page_info["hasNextPage"].as_bool() == Some(true) {
+        page_info["endCursor"].as_str().map(str::to_string)
+    } else {
+        None
+    }
+}
+
+fn provider(host: &str, kinds: &BTreeMap<String, ProviderKind>) -> Option<Box<dyn Provider>> {
+    let kind = match (kinds.get(host), host) {
+        (Some(kind), _) => *kind,
+        (None, "github.com") => ProviderKind::Github,
+        (None, "gitlab.com") => ProviderKind::Gitlab,
+        (None, _) => return None,
+    };
+    Some(match kind {
+        ProviderKind::Github if host == "github.com" => Box::new(GitHub {
+            api: "https://api.github.com/graphql".to_string(),
+        }),
+        ProviderKind::Github => Box::new(GitHub {
+            api: format!("https://{}/api/graphql", host),
+        }),
+        ProviderKind::Gitlab => Box::new(GitLab {
+            api: format!("https://{}/api/graphql", host),
+        }),
+    })
+}
+
+fn default_ttl() -> HumanDuration {
+    HumanDuration(Duration::from_secs(10 * 60))
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub(crate) enum CiStatus {
+    Passing,
+    Failing,
+    Pending,
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub(crate) struct ForgeInfo {
+    open_prs: u64,
+    open_issues: u64,
+    default_branch: Option<String>,
+    ci: Option<CiStatus>,
+    /// seconds since the unix epoch
+    pub(crate) fetched_at: u64,
+}
+
+impl ForgeInfo {
+    /// A single character for the CI column
+    pub(crate) fn glyph(&self) -> Option<&'static str> {
+        self.ci.map(|ci| match ci {
+            CiStatus::Passing => "✓",
+            CiStatus::Failing => "✗",
+            CiStatus::Pending => "●",
+        })
+    }
+}
+
+impl std::fmt::Display for ForgeInfo {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(
+            f,
+            "{} open PRs, {} open issues",
+            self.open_prs, self.open_issues
+        )?;
+        if let (Some(branch), Some(ci)) = (&self.default_branch, self.ci) {
+            let ci = match ci {
+                CiStatus::Passing => "passing",
+                CiStatus::Failing => "failing",
+                CiStatus::Pending => "pending",
+            };
+            write!(f, ", CI on {} {}", branch, ci)?;
+        }
+        Ok(())
+    }
+}
+
+/// The host and repository path of the project's origin remote, e.g.
+/// ("github.com", "owner/repo")
+fn repository(full_path: &str) -> Option<(String, String)> {
+    let url = git::web_url(&git::origin_url(Path::new(full_path))?)?;
+    let (host, path) = url.strip_prefix("https://")?.split_once('/')?;
+    Some((host.to_string(), path.to_string()))
+}
+
+/// POST `body` to a JSON API with curl. The token goes in on stdin rather
+/// than the command line, where other users could see it.
+fn post(url: &str, token: &str, body: &Value) -> Result<Value> {
+    let mut child = Command::new("curl")
+        .args(["--silent", "--show-error", "--fail", "--max-time", "10"])
+        .args(["--header", "@-"])
+        .args(["--header", "Content-Type: application/json"])
+        .args(["--data", &body.to_string()])
+        .arg(url)
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .spawn()
+        .wrap_err("running curl")?;
+    if let Some(mut stdin) = child.stdin.take() {
+        writeln!(stdin, "Authorization: Bearer {}", token).wrap_err("passing token to curl")?;
+    }
+    let output = child.wait_with_output().wrap_err("running curl")?;
+    if !output.status.success() {
+        eyre::bail!(
+            "requesting {}: {}",
+            url,
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    serde_json::from_slice(&output.stdout)
+        .wrap_err_with(|| format!("parsing response from {}", url))
+}
+
+const GITHUB_QUERY: &str = "query($owner: String!, $name: String!) {
+  repository(owner: $owner, name: $name) {
+    pullRequests(states: OPEN) { totalCount }
+    issues(states: OPEN) { totalCount }
+    defaultBranchRef {
+      name
+      target { ... on Commit { statusCheckRollup { state } } }
+    }
+  }
+}";
+
+const GITHUB_REPOSITORIES_QUERY: &str = "query($owner: String!, $cursor: String) {
+  repositoryOwner(login: $owner) {
+    repositories(first: 100, after: $cursor) {
+      nodes { name sshUrl url isArchived isFork }
+      pageInfo { hasNextPage endCursor }
+    }
+  }
+}";
+
+struct GitHub {
+    api: String,
+}
+
+impl Provider for GitHub {
+    fn fetch(&self, path: &str, token: &str) -> Result<ForgeInfo> {
+        let (owner, name) = path
+            .split_once('/')
+            .ok_or_else(|| eyre::eyre!("{:?} is not an owner/name repository", path))?;
+        let body = json!({
+            "query": GITHUB_QUERY,
+            "variables": { "owner": owner, "name": name },
+        });
+        parse_github(&post(&self.api, token, &body)?)
+    }
+
+    fn repositories(&self, owner: &str, token: &str) -> Result<Vec<RemoteRepo>> {
+        paginate(|cursor| {
+            let body = json!({
+                "query": GITHUB_REPOSITORIES_QUERY,
+                "variables": { "owner": owner, "cursor": cursor },
+            });
+            parse_github_repositories(&post(&self.api, token, &body)?)
+        })
+    }
+}
+
+fn parse_github(response: &Value) -> Result<ForgeInfo> {
+    if let Some(message) = response["errors"][0]["message"].as_str() {
+        eyre::bail!("github: {}", message);
+    }
+    let repo = &response["data"]["repository"];
+    if repo.is_null() {
+        eyre::bail!("github: repository not found");
+    }
+    let branch = &repo["defaultBranchRef"];
+    let ci = match branch["target"]["statusCheckRollup"]["state"].as_str() {
+        Some("SUCCESS") => Some(CiStatus::Passing),
+        Some("FAILURE") | Some("ERROR") => Some(CiStatus::Failing),
+        Some("PENDING") | Some("EXPECTED") => Some(CiStatus::Pending),
+        _ => None,
+    };
+    Ok(ForgeInfo {
+        open_prs: repo["pullRequests"]["totalCount"].as_u64().unwrap_or(0),
+        open_issues: repo["issues"]["totalCount"].as_u64().unwrap_or(0),
+        default_branch: branch["name"].as_str().map(str::to_string),
+        ci,
+        fetched_at: now(),
+    })
+}
+
+fn parse_github_repositories(response: &Value) -> Result<(Vec<RemoteRepo>, Option<String>)> {
+    if let Some(message) = response["errors"][0]["message"].as_str() {
+        eyre::bail!("github: {}", message);
+    }
+    let repositories = &response["data"]["repositoryOwner"]["repositories"];
+    if repositories.is_null() {
+        eyre::bail!("github: owner not found");
+    }
+    let repos = repositories["nodes"]
+        .as_array()
+        .map(Vec::as_slice)
+        .unwrap_or_default()
+        .iter()
+        .filter_map(|node| {
+            let url = node["url"].as_str()?;
+            Some(RemoteRepo {
+                name: node["name"].as_str()?.to_string(),
+                ssh_url: node["sshUrl"].as_str()?.to_string(),
+                https_url: format!("{}.git", url),
+                archived: node["isArchived"].as_bool().unwrap_or(false),
+                fork: node["isFork"].as_bool().unwrap_or(false),
+            })
+        })
+        .collect();
+    Ok((repos, next_cursor(repositories)))
+}
+
+const GITLAB_QUERY: &str = "query($path: ID!) {
+  project(fullPath: $path) {
+    openIssuesCount
+    mergeRequests(state: opened) { count }
+    repository { rootRef }
+  }
+}";
+
+/// Pipelines cannot be filtered by the default branch without knowing its
+/// name, so they are a second query
+const GITLAB_PIPELINE_QUERY: &str = "query($path: ID!, $ref: String!) {
+  project(fullPath: $path) {
+    pipelines(ref: $ref, first: 1) { nodes { status } }
+  }
+}";
+
+/// GitLab does not say which projects are forks in this listing, so a mirror
+/// of a group takes them all
+const GITLAB_PROJECTS_QUERY: &str = "query($path: ID!, $cursor: String) {
+  group(fullPath: $path) {
+    projects(includeSubgroups: true, first: 100, after: $cursor) {
+      nodes { fullPath sshUrlToRepo httpUrlToRepo archived }
+      pageInfo { hasNextPage endCursor }
+    }
+  }
+}";
+
+struct GitLab {
+    api: String,
+}
+
+impl Provider for GitLab {
+    fn fetch(&self, path: &str, token: &str) -> Result<ForgeInfo> {
+        let body = json!({ "query": GITLAB_QUERY, "variables": { "path": path } });
+        let mut info = parse_gitlab(&post(&self.api, token, &body)?)?;
+        if let Some(branch) = &info.default_branch {
+            let body = json!({
+                "query": GITLAB_PIPELINE_QUERY,
+                "variables": { "path": path, "ref": branch },
+            });
+            info.ci = parse_gitlab_pipeline(&post(&self.api, token, &body)?)?;
+        }
+        Ok(info)
+    }
+
+    fn repositories(&self, owner: &str, token: &str) -> Result<Vec<RemoteRepo>> {
+        paginate(|cursor| {
+            let body = json!({
+                "query": GITLAB_PROJECTS_QUERY,
+                "variables": { "path": owner, "cursor": cursor },
+            });
+            parse_gitlab_projects(&post(&self.api, token, &body)?, owner)
+        })
+    }
+}
+
+fn gitlab_errors(response: &Value) -> Result<&Value> {
+    if let Some(message) = response["errors"][0]["message"].as_str() {
+        eyre::bail!("gitlab: {}", message);
+    }
+    let project = &response["data"]["project"];
+    if project.is_null() {
+        eyre::bail!("gitlab: project not found");
+    }
+    Ok(project)
+}
+
+fn parse_gitlab(response: &Value) -> Result<ForgeInfo> {
+    let project = gitlab_errors(response)?;
+    Ok(ForgeInfo {
+        open_prs: project["mergeRequests"]["count"].as_u64().unwrap_or(0),
+        open_issues: project["openIssuesCount"].as_u64().unwrap_or(0),
+        default_branch: project["repository"]["rootRef"]
+            .as_str()
+            .map(str::to_string),
+        ci: None,
+        fetched_at: now(),
+    })
+}
+
+fn parse_gitlab_projects(
+    response: &Value,
+    group: &str,
+) -> Result<(Vec<RemoteRepo>, Option<String>)> {
+    if let Some(message) = response["errors"][0]["message"].as_str() {
+        eyre::bail!("gitlab: {}", message);
+    }
+    let projects = &response["data"]["group"]["projects"];
+    if projects.is_null() {
+        eyre::bail!("gitlab: group not found");
+    }
+    let prefix = format!("{}/", group);
+    let repos = projects["nodes"]
+        .as_array()
+        .map(Vec::as_slice)
+        .unwrap_or_default()
+        .iter()
+        .filter_map(|node| {
+            let full_path = node["fullPath"].as_str()?;
+            Some(RemoteRepo {
+                name: full_path
+                    .strip_prefix(&prefix)
+                    .unwrap_or(full_path)
+                    .to_string(),
+                ssh_url: node["sshUrlToRepo"].as_str()?.to_string(),
+                https_url: node["httpUrlToRepo"].as_str()?.to_string(),
+                archived: node["archived"].as_bool().unwrap_or(false),
+                fork: false,
+            })
+        })
+        .collect();
+    Ok((repos, next_cursor(projects)))
+}
+
+fn parse_gitlab_pipeline(response: &Value) -> Result<Option<CiStatus>> {
+    let project = gitlab_errors(response)?;
+    Ok(match project["pipelines"]["nodes"][0]["status"].as_str() {
+        Some("SUCCESS") => Some(CiStatus::Passing),
+        Some("FAILED") => Some(CiStatus::Failing),
+        Some("CREATED")
+        | Some("WAITING_FOR_RESOURCE")
+        | Some("PREPARING")
+        | Some("PENDING")
+        | Some("RUNNING")
+        | Some("SCHEDULED") => Some(CiStatus::Pending),
+        // canceled, skipped and manual pipelines say nothing either way
+        _ => None,
+    })
+}
+
+fn store_file() -> Result<PathBuf> {
+    Ok(cache_file()?.with_file_name("forge.json"))
+}
+
+fn load() -> HashMap<String, ForgeInfo> {
+    store_file()
+        .ok()
+        .and_then(|path| std::fs::read_to_string(path).ok())
+        .and_then(|txt| serde_json::from_str(&txt).ok())
+        .unwrap_or_default()
+}
+
+fn save(store: &HashMap<String, ForgeInfo>) -> Result<()> {
+    let txt = serde_json::to_string(store)?;
+    std::fs::write(store_file()?, txt).wrap_err("writing forge cache")
+}
+
+pub(crate) type ForgeStore = RwLock<HashMap<String, ForgeInfo>>;
+
+/// Fetches forge details on a background thread as projects are previewed or
+/// drawn in the CI column, for projects whose host has a token in the config
+/// file
+pub(crate) struct Fetcher {
+    store: Arc<ForgeStore>,
+    tx: crossbeam_channel::Sender<String>,
+    pub(crate) ci_column: bool,
+}
+
+impl Fetcher {
+    pub(crate) fn start(cfg: &ForgeConfig, tokens: BTreeMap<String, Secret>) -> Self {
+        let store = Arc::new(RwLock::new(load()));
+        let (tx, rx) = crossbeam_channel::unbounded::<String>();
+        let ttl = cfg.ttl.0.as_secs();
+        let kinds = cfg.providers.clone();
+        let thread_store = Arc::clone(&store);
+        std::thread::spawn(move || {
+            // when each project was last tried, so failures are not retried
+            // on every preview and repeated requests do not pile up
+            let mut attempted: HashMap<String, u64> = thread_store
+                .read()
+                .unwrap()
+                .iter()
+                .map(|(path, info)| (path.clone(), info.fetched_at))
+                .collect();
+            let mut resolved: HashMap<String, Option<String>> = HashMap::new();
+            for full_path in rx.iter() {
+                if attempted
+                    .get(&full_path)
+                    .map_or(false, |at| now().saturating_sub(*at) < ttl)
+                {
+                    continue;
+                }
+                attempted.insert(full_path.clone(), now());
+                let (host, path) = match repository(&full_path) {
+                    Some(repo) => repo,
+                    None => continue,
+                };
+                let provider = match provider(&host, &kinds) {
+                    Some(provider) => provider,
+                    None => continue,
+                };
+                let token = resolved.entry(host.clone()).or_insert_with(|| {
+                    let secret = tokens.get(&host)?;
+                    secret
+                        .resolve()
+                        .map_err(|e| log::warn!("reading token for {}: {:?}", host, e))
+                        .ok()
+                });
+                let token = match token {
+                    Some(token) => token,
+                    None => continue,
+                };
+                match provider.fetch(&path, token) {
+                    Ok(info) => {
+                        let mut store = thread_store.write().unwrap();
+                        store.insert(full_path, info);
+                        if let Err(e) = save(&store) {
+                            log::warn!("saving forge details: {:?}", e);
+                        }
+                    }
+                    Err(e) => log::warn!("fetching {} from {}: {:?}", path, host, e),
+                }
+            }
+        });
+        Self {
+            store,
+            tx,
+            ci_column: cfg.ci_column,
+        }
+    }
+
+    pub(crate) fn request(&self, full_path: &str) {
+        let _ = self.tx.send(full_path.to_string());
+    }
+
+    /// The latest details fetched for the project, however old
+    pub(crate) fn get(&self, full_path: &str) -> Option<ForgeInfo> {
+        self.store.read().unwrap().get(full_path).cloned()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn github_responses() {
+        let response = json!({
+            "data": { "repository": {
+                "pullRequests": { "totalCount": 3 },
+                "issues": { "totalCount": 12 },
+                "defaultBranchRef": {
+                    "name": "main",
+                    "target": { "statusCheckRollup": { "state": "FAILURE" } }
+                }
+            }}
+        });
+        let info = parse_github(&response).unwrap();
+        assert_eq!(
+            info.to_string(),
+            "3 open PRs, 12 open issues, CI on main failing"
+        );
+
+        let response = json!({ "data": { "repository": null }, "errors": [{ "message": "Could not resolve to a Repository" }] });
+        assert!(parse_github(&response).is_err());
+
+        let page = json!({
+            "data": { "repositoryOwner": { "repositories": {
+                "nodes": [{
+                    "name": "api",
+                    "sshUrl": "git@github.com:team/api.git",
+                    "url": "https://github.com/team/api",
+                    "isArchived": true,
+                    "isFork": false
+                }],
+                "pageInfo": { "hasNextPage": true, "endCursor": "Y3Vyc29y" }
+            }}}
+        });
+        let (repos, next) = parse_github_repositories(&page).unwrap();
+        assert_eq!(
+            repos,
+            vec![RemoteRepo {
+                name: "api".to_string(),
+                ssh_url: "git@github.com:team/api.git".to_string(),
+                https_url: "https://github.com/team/api.git".to_string(),
+                archived: true,
+                fork: false,
+            }]
+        );
+        assert_eq!(next.as_deref(), Some("Y3Vyc29y"));
+    }
+
+    #[test]
+    fn gitlab_responses() {
+        let response = json!({
+            "data": { "project": {
+                "openIssuesCount": 4,
+                "mergeRequests": { "count": 1 },
+                "repository": { "rootRef": "master" }
+            }}
+        });
+        let mut info = parse_gitlab(&response).unwrap();
+        let pipeline = json!({
+            "data": { "project": { "pipelines": { "nodes": [{ "status": "RUNNING" }] } } }
+        });
+        info.ci = parse_gitlab_pipeline(&pipeline).unwrap();
+        assert_eq!(
+            info.to_string(),
+            "1 open PRs, 4 open issues, CI on master pending"
+        );
+        assert_eq!(info.glyph(), Some("●"));
+
+        let canceled = json!({
+            "data": { "project": { "pipelines": { "nodes": [{ "status": "CANCELED" }] } } }
+        });
+        assert_eq!(parse_gitlab_pipeline(&canceled).unwrap(), None);
+        assert!(parse_gitlab(&json!({ "data": { "project": null } })).is_err());
+
+        let page = json!({
+            "data": { "group": { "projects": {
+                "nodes": [{
+                    "fullPath": "team/tools/cli",
+                    "sshUrlToRepo": "git@gitlab.com:team/tools/cli.git",
+                    "httpUrlToRepo": "https://gitlab.com/team/tools/cli.git",
+                    "archived": false
+                }],
+                "pageInfo": { "hasNextPage": false, "endCursor": "eA" }
+            }}}
+        });
+        let (repos, next) = parse_gitlab_projects(&page, "team").unwrap();
+        assert_eq!(repos[0].name, "tools/cli");
+        assert_eq!(next, None);
+    }
+}
@@ -0,0 +1,338 @@
+use std::{
+    collections::HashMap,
+    io::Read,
+    path::Path,
+    process::{Command, Stdio},
+    sync::{Arc, RwLock},
+    time::Duration,
+};
+
+use eyre::{Result, WrapErr};
+use serde::{Deserialize, Serialize};
+
+use crate::{remote, text};
+
+#[derive(Debug, Serialize, Deserialize)]
+#[serde(default)]
+pub(crate) struct GitInfoConfig {
+    pub(crate) enabled: bool,
+    pub(crate) workers: usize,
+    pub(crate) timeout_ms: u64,
+}
+
+impl Default for GitInfoConfig {
+    fn default() -> Self {
+        Self {
+            enabled: false,
+            workers: 8,
+            timeout_ms: 500,
+        }
+    }
+}
+
+#[derive(Debug, Clone)]
+pub(crate) struct GitInfo {
+    pub(crate) branch: Option<String>,
+    pub(crate) dirty: bool,
+}
+
+impl std::fmt::Display for GitInfo {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(
+            f,
+            "{}{}",
+            text::truncate(
+                self.branch.as_deref().unwrap_or("(detached)"),
+                MAX_BRANCH_WIDTH
+            ),
+            if self.dirty { "*" } else { "" }
+        )
+    }
+}
+
+/// Longer branch names are cut short in the picker, leaving room for the path
+const MAX_BRANCH_WIDTH: usize = 30;
+
+pub(crate) type GitStore = RwLock<HashMap<String, GitInfo>>;
+
+/// Collects git metadata for projects on a bounded pool of worker threads.
+///
+/// Results land in a shared store that the picker reads when rendering, so a
+/// slow repository only delays its own annotation and never the selection.
+pub(crate) struct Enricher {
+    store: Arc<GitStore>,
+    tx: crossbeam_channel::Sender<String>,
+}
+
+impl Enricher {
+    pub(crate) fn start(cfg: &GitInfoConfig) -> Self {
+        let store = Arc::new(GitStore::default());
+        let (tx, rx) = crossbeam_channel::unbounded::<String>();
+        let timeout = Duration::from_millis(cfg.timeout_ms);
+
+        for _ in 0..cfg.workers.max(1) {
+            let rx = rx.clone();
+            let store = Arc::clone(&store);
+            std::thread::spawn(move || {
+                for path in rx.iter() {
+                    match git_info(Path::new(&path), timeout) {
+                        Some(info) => {
+                            store.write().unwrap().insert(path, info);
+                        }
+                        None => log::debug!("no git info for {} within {:?}", path, timeout),
+                    }
+                }
+            });
+        }
+
+        Self { store, tx }
+    }
+
+    pub(crate) fn request(&self, full_path: &str) {
+        let _ = self.tx.send(full_path.to_string());
+    }
+
+    pub(crate) fn store(&self) -> Arc<GitStore> {
+        Arc::clone(&self.store)
+    }
+}
+
+/// Run a command, giving up and killing it if it has not finished within `timeout`
+pub(crate) fn output_with_timeout(cmd: &mut Command, timeout: Duration) -> Option<String> {
+    let mut child = cmd
+        .stdin(Stdio::null())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::null())
+        .spawn()
+        .ok()?;
+
+    // read on a separate thread so a chatty command cannot fill the pipe and
+    // stall while we wait for it
+    let mut stdout = child.stdout.take()?;
+    let (tx, rx) = crossbeam_channel::bounded(1);
+    std::thread::spawn(move || {
+        let mut buf = String::new();
+        let res = stdout.read_to_string(&mut buf).map(|_| buf);
+        let _ = tx.send(res);
+    });
+
+    match rx.recv_timeout(timeout) {
+        Ok(Ok(out)) => match child.wait() {
+            Ok(status) if status.success() => Some(out),
+            _ => None,
+        },
+        _ => {
+            let _ = child.kill();
+            let _ = child.wait();
+            None
+        }
+    }
+}
+
+/// The branch checked out in `path`, if it is a git repository on a branch
+pub(crate) fn current_branch(path: &Path) -> Option<String> {
+    git_info(path, Duration::from_millis(500))?.branch
+}
+
+/// `git -C path`, or `None` for projects on other machines, which git here
+/// cannot look into
+fn git_in(path: &Path) -> Option<Command> {
+    if remote::is_remote(&path.to_string_lossy()) {
+        return None;
+    }
+    let mut cmd = Command::new("git");
+    cmd.arg("-C").arg(path);
+    Some(cmd)
+}
+
+/// The branch `origin/HEAD` points at, or failing that a local main or master
+pub(crate) fn default_branch(path: &Path) -> Option<String> {
+    let git =
+        |args: &[&str]| output_with_timeout(git_in(path)?.args(args), Duration::from_millis(500));
+    if let Some(out) = git(&["symbolic-ref", "--short", "refs/remotes/origin/HEAD"]) {
+        if let Some(branch) = out.trim().strip_prefix("origin/") {
+            return Some(branch.to_string());
+        }
+    }
+    ["main", "master"]
+        .iter()
+        .find(|branch| {
+            git(&[
+                "rev-parse",
+                "--verify",
+                "--quiet",
+                &format!("refs/heads/{}", branch),
+            ])
+            .is_some()
+        })
+        .map(|branch| branch.to_string())
+}
+
+/// Whether `path` has uncommitted changes to tracked files, which a checkout
+/// could clobber
+pub(crate) fn is_dirty(path: &Path) -> bool {
+    git_info(path, Duration::from_secs(5)).map_or(false, |info| info.dirty)
+}
+
+/// Stash uncommitted changes in `path`, including untracked files
+pub(crate) fn stash(path: &Path, message: &str, dry_run: bool) -> Result<()> {
+    let args = ["stash", "push", "--include-untracked", "--message", message];
+    if dry_run {
+        println!("git -C {} {}", path.display(), args.join(" "));
+        return Ok(());
+    }
+    let status = Command::new("git")
+        .arg("-C")
+        .arg(path)
+        .args(args)
+        .status()
+        .wrap_err("running git")?;
+    if !status.success() {
+        eyre::bail!("git stash exited with {}", status);
+    }
+    Ok(())
+}
+
+/// Check out `branch` in `path` and fast-forward it from its upstream, if it
+/// has one and this is not `offline`. git refuses to switch over uncommitted
+/// changes it would lose.
+pub(crate) fn checkout(path: &Path, branch: &str, dry_run: bool, offline: bool) -> Result<()> {
+    let run = |args: &[&str]| -> Result<()> {
+        if dry_run {
+            println!("git -C {} {}", path.display(), args.join(" "));
+            return Ok(());
+        }
+        let status = Command::new("git")
+            .arg("-C")
+            .arg(path)
+            .args(args)
+            .status()
+            .wrap_err("running git")?;
+        if !status.success() {
+            eyre::bail!("git {} exited with {}", args.join(" "), status);
+        }
+        Ok(())
+    };
+    run(&["checkout", branch])?;
+    if offline {
+        return Ok(());
+    }
+    let upstream = output_with_timeout(
+        Command::new("git").arg("-C").arg(path).args([
+            "rev-parse",
+            "--abbrev-ref",
+            &format!("{}@{{u}}", branch),
+        ]),
+        Duration::from_millis(500),
+    );
+    if upstream.is_some() {
+        run(&["pull", "--ff-only"])?;
+    }
+    Ok(())
+}
+
+/// When the commit checked out in `path` was made, in seconds since the unix epoch
+pub(crate) fn last_commit_time(path: &Path) -> Option<u64> {
+    let out = output_with_timeout(
+        git_in(path)?.args(["log", "-1", "--format=%ct"]),
+        Duration::from_millis(500),
+    )?;
+    out.trim().parse().ok()
+}
+
+/// The URL of the repository's `origin` remote
+pub(crate) fn origin_url(path: &Path) -> Option<String> {
+    let out = output_with_timeout(
+        git_in(path)?.args(["remote", "get-url", "origin"]),
+        Duration::from_millis(500),
+    )?;
+    Some(out.trim().to_string()).filter(|url| !url.is_empty())
+}
+
+/// The https address of a hosted repository from its remote URL, so that
+/// "git@github.com:owner/repo.git" gives "https://github.com/owner/repo"
+pub(crate) fn web_url(remote: &str) -> Option<String> {
+    let remote = remote.trim_end_matches('/');
+    let remote = remote.strip_suffix(".git").unwrap_or(remote);
+    let without_user = |s: &str| s.rsplit('@').next().unwrap_or(s).to_string();
+
+    let url = ["https://", "http://", "ssh://", "git://"]
+        .iter()
+        .find_map(|scheme| remote.strip_prefix(scheme));
+    let (host, path) = match url {
+        Some(rest) => {
+            let (authority, path) = rest.split_once('/')?;
+            // ports belong to the git protocol rather than the web site
+            let host = without_user(authority);
+            (host.split(':').next()?.to_string(), path)
+        }
+        // scp-like syntax, user@host:path, where anything with a slash before
+        // the colon is a local path instead
+        None => {
+            let (authority, path) = remote.split_once(':')?;
+            if authority.contains('/') {
+                return None;
+            }
+            (without_user(authority), path.trim_start_matches('/'))
+        }
+    };
+    (!host.is_empty() && !path.is_empty()).then(|| format!("https://{}/{}", host, path))
+}
+
+fn git_info(path: &Path, timeout: Duration) -> Option<GitInfo> {
+    let out = output_with_timeout(
+        git_in(path)?.args([
+            "status",
+            "--porcelain=v1",
+            "--branch",
+            "--untracked-files=no",
+        ]),
+        timeout,
+    )?;
+    Some(parse_status(&out))
+}
+
+fn parse_status(out: &str) -> GitInfo {
+    let mut lines = out.lines();
+    let branch = lines
+        .next()
+        .and_then(|header| header.strip_prefix("## "))
+        .and_then(|header| {
+            let name = header.split("...").next().unwrap_or(header);
+            let name = name.strip_prefix("No commits yet on ").unwrap_or(name);
+            (name != "HEAD (no branch)").then(|| name.to_string())
+        });
+    let dirty = lines.any(|l| !l.is_empty());
+    GitInfo { branch, dirty }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn status_parsing() {
+        let info = parse_status("## main...origin/main [ahead 1]\n M src/main.rs\n");
+        assert_eq!(info.branch.as_deref(), Some("main"));
+        assert!(info.dirty);
+
+        let info = parse_status("## HEAD (no branch)\n");
+        assert_eq!(info.branch, None);
+        assert!(!info.dirty);
+    }
+
+    #[test]
+    fn web_urls() {
+        let expected = Some("https://github.com/owner/repo".to_string());
+        assert_eq!(web_url("git@github.com:owner/repo.git"), expected);
+        assert_eq!(web_url("https://github.com/owner/repo.git"), expected);
+        assert_eq!(web_url("https://token@github.com/owner/repo"), expected);
+        assert_eq!(web_url("ssh://git@github.com:22/owner/repo.git"), expected);
+        assert_eq!(
+            web_url("git@gitlab.com:group/sub/repo.git"),
+            Some("https://gitlab.com/group/sub/repo".to_string())
+        );
+        assert_eq!(web_url("/srv/git/repo.git"), None);
+        assert_eq!(web_url("../repo"), None);
+    }
+}
@@ -0,0 +1,186 @@
+//! The picker as a tree: a list of groups, each expanding into a list of its
+//! projects and collapsing back with esc, for indexes too large to scroll
+
+use eyre::Result;
+use serde::{Deserialize, Serialize};
+use std::{borrow::Cow, collections::BTreeMap, path::Path, sync::Arc};
+
+use crate::{
+    cached_projects, state::State, Annotators, Args, Cache, Config, ProjectItem, ProjectPath,
+};
+
+const GROUP_HELP: &str = "enter: expand  esc: quit";
+const PROJECT_HELP: &str = "enter: switch  esc: back to groups";
+
+/// What projects are grouped by
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub(crate) enum GroupBy {
+    /// the root the project was found under
+    Root,
+    /// the directory the project is in, the owner in layouts such as
+    /// ~/src/github.com/owner/repo
+    Org,
+    /// each of the project's tags, so a project can be in several groups
+    Tag,
+}
+
+impl std::str::FromStr for GroupBy {
+    type Err = String;
+
+    fn from_str(s: &str) -> std::result::Result<Self, Self::Err> {
+        match s {
+            "root" => Ok(GroupBy::Root),
+            "org" => Ok(GroupBy::Org),
+            "tag" => Ok(GroupBy::Tag),
+            other => Err(format!(
+                "unknown grouping {:?}, expected root, org or tag",
+                other
+            )),
+        }
+    }
+}
+
+fn groups_of(cfg: &Config, state: &State, project: &ProjectPath, by: GroupBy) -> Vec<String> {
+    match by {
+        GroupBy::Root => vec![cfg.root_for(&project.full_path).map_or_else(
+            || "(no root)".to_string(),
+            |dir| dir.path.display().to_string(),
+        )],
+        GroupBy::Org => vec![Path::new(&project.full_path)
+            .parent()
+            .and_then(Path::file_name)
+            .map_or_else(
+                || "/".to_string(),
+                |name| name.to_string_lossy().into_owned(),
+            )],
+        GroupBy::Tag => {
+            let tags = state.tags(&project.full_path);
+            if tags.is_empty() {
+                vec!["(untagged)".to_string()]
+            } else {
+                tags
+            }
+        }
+    }
+}
+
+/// The projects in each group, keeping their order within groups
+fn group<F>(projects: Vec<ProjectPath>, groups_of: F) -> BTreeMap<String, Vec<ProjectPath>>
+where
+    F: Fn(&ProjectPath) -> Vec<String>,
+{
+    let mut groups: BTreeMap<String, Vec<ProjectPath>> = BTreeMap::new();
+    for project in projects {
+        for name in groups_of(&project) {
+            groups.entry(name).or_default().push(project.clone());
+        }
+    }
+    groups
+}
+
+struct GroupItem {
+    name: String,
+    label: String,
+}
+
+impl skim::SkimItem for GroupItem {
+    fn text(&self) -> Cow<str> {
+        Cow::Borrowed(&self.label)
+    }
+}
+
+/// Let the user pick a group and then a project in it, returning `None` if
+/// they quit instead
+pub(crate) fn pick(
+    cfg: &Config,
+    args: &Args,
+    cache: &Cache,
+    state: &State,
+    annotators: &Arc<Annotators>,
+    by: GroupBy,
+    mut options: skim::SkimOptions,
+) -> Result<Option<ProjectPath>> {
+    loop {
+        // grouped afresh each time, picking up what the scan has found since
+        let groups = group(cached_projects(cfg, cache, state, args.all), |p| {
+            groups_of(cfg, state, p, by)
+        });
+        let (tx, rx): (skim::SkimItemSender, skim::SkimItemReceiver) =
+            crossbeam_channel::unbounded();
+        for (name, projects) in &groups {
+            let _ = tx.send(Arc::new(GroupItem {
+                name: name.clone(),
+                label: format!("▸ {}  ({})", name, projects.len()),
+            }));
+        }
+        drop(tx);
+        options.header = Some(GROUP_HELP);
+        let result = match skim::Skim::run_with(&options, Some(rx)) {
+            Some(result) if !result.is_abort => result,
+            _ => return Ok(None),
+        };
+        let name = match result.selected_items.first() {
+            Some(item) => match item.as_any().downcast_ref::<GroupItem>() {
+                Some(item) => item.name.clone(),
+                None => continue,
+            },
+            None => continue,
+        };
+
+        let (tx, rx): (skim::SkimItemSender, skim::SkimItemReceiver) =
+            crossbeam_channel::unbounded();
+        for project in groups.get(&name).into_iter().flatten() {
+            let _ = tx.send(Arc::new(annotators.item(project.clone())));
+        }
+        drop(tx);
+        options.header = Some(PROJECT_HELP);
+        let result = match skim::Skim::run_with(&options, Some(rx)) {
+            Some(result) if !result.is_abort => result,
+            // collapse back to the groups
+            _ => continue,
+        };
+        state.record_query(&result.query);
+        if let Some(item) = result
+            .selected_items
+            .first()
+            .and_then(|item| item.as_any().downcast_ref::<ProjectItem>())
+        {
+            return Ok(Some(item.path.clone()));
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn grouping() {
+        let project = |path: &str| ProjectPath {
+            full_path: path.to_string(),
+            session_name: path.rsplit('/').next().unwrap().to_string(),
+        };
+        let projects = vec![
+            project("/src/acme/web"),
+            project("/src/me/dotfiles"),
+            project("/src/acme/api"),
+        ];
+        let groups = group(projects, |p| {
+            let mut groups = vec![p.full_path.split('/').nth(2).unwrap().to_string()];
+            if p.session_name == "api" {
+                groups.push("backend".to_string());
+            }
+            groups
+        });
+        let names = |group: &str| -> Vec<&str> {
+            groups[group]
+                .iter()
+                .map(|p| p.session_name.as_str())
+                .collect()
+        };
+        assert_eq!(groups.keys().collect::<Vec<_>>(), ["acme", "backend", "me"]);
+        assert_eq!(names("acme"), ["web", "api"]);
+        assert_eq!(names("backend"), ["api"]);
+    }
+}
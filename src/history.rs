@@ -0,0 +1,167 @@
+//! `project back` and `project forward`: each tmux client's switches between
+//! projects, navigated like a browser's history
+
+use eyre::{Result, WrapErr};
+use serde::{Deserialize, Serialize};
+
+use crate::{launch_with, state::State, tmux, Args, Config, ProjectPath};
+
+/// How many switches each client remembers
+const MAX_ENTRIES: usize = 50;
+
+#[derive(Debug, Default, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub(crate) struct History {
+    entries: Vec<ProjectPath>,
+    /// index of the entry the client is on
+    position: usize,
+}
+
+impl History {
+    /// Record a switch to `project`, dropping anything ahead of the current
+    /// entry as a browser does
+    fn visit(&mut self, project: &ProjectPath) {
+        if self.entries.get(self.position) == Some(project) {
+            return;
+        }
+        self.entries.truncate(self.position + 1);
+        self.entries.push(project.clone());
+        let excess = self.entries.len().saturating_sub(MAX_ENTRIES);
+        self.entries.drain(..excess);
+        self.position = self.entries.len() - 1;
+    }
+
+    fn target(&self, forward: bool) -> Option<usize> {
+        if forward {
+            Some(self.position + 1).filter(|&i| i < self.entries.len())
+        } else {
+            self.position.checked_sub(1)
+        }
+    }
+
+    /// The entry one step back or forward, if there is one
+    pub(crate) fn peek(&self, forward: bool) -> Option<&ProjectPath> {
+        self.target(forward).map(|i| &self.entries[i])
+    }
+
+    pub(crate) fn step(&mut self, forward: bool) {
+        if let Some(i) = self.target(forward) {
+            self.position = i;
+        }
+    }
+}
+
+/// The project of the session `client` is on now, if this tool created it
+fn current_project(client: &str) -> Option<ProjectPath> {
+    let name = tmux::client_session(client)?;
+    tmux::sessions()
+        .ok()?
+        .into_iter()
+        .find(|s| s.name == name)
+        .and_then(|s| {
+            Some(ProjectPath {
+                full_path: s.project_path?,
+                session_name: s.name,
+            })
+        })
+}
+
+/// Record that the client running this switched to `project`. The first
+/// switch also records where the client was, so there is somewhere to go
+/// back to.
+pub(crate) fn record(state: &State, project: &ProjectPath) {
+    let client = match tmux::current_client() {
+        Some(client) => client,
+        None => return,
+    };
+    let from = state
+        .history(&client)
+        .entries
+        .is_empty()
+        .then(|| current_project(&client))
+        .flatten();
+    state.update_history(&client, |history| {
+        if let Some(from) = &from {
+            history.visit(from);
+        }
+        history.visit(project);
+    });
+}
+
+/// Switch `client`, by default the one running this, to the project before
+/// or after the current one in its history
+pub(crate) fn go(
+    cfg: &Config,
+    args: &Args,
+    state: &State,
+    client: Option<String>,
+    forward: bool,
+) -> Result<()> {
+    let client = client
+        .or_else(tmux::current_client)
+        .ok_or_else(|| eyre::eyre!("no tmux client to switch, pass --client"))?;
+    let project = match state.history(&client).peek(forward) {
+        Some(project) => project.clone(),
+        None => {
+            println!("no {} project", if forward { "later" } else { "earlier" });
+            return Ok(());
+        }
+    };
+    let launched = launch_with(
+        cfg,
+        args,
+        state,
+        &project,
+        None,
+        cfg.on_existing,
+        Some(&client),
+    )
+    .wrap_err("switching project")?;
+    // without a client to switch the session is only made sure of, and the
+    // client is still where it was
+    let switched = match launched {
+        Some((outcome, session_name)) => {
+            outcome.report(&session_name);
+            !matches!(outcome, tmux::Outcome::Ensured { .. })
+        }
+        None => true,
+    };
+    if switched && !args.dry_run {
+        state.update_history(&client, |history| history.step(forward));
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn project(name: &str) -> ProjectPath {
+        ProjectPath {
+            full_path: format!("/work/{}", name),
+            session_name: name.to_string(),
+        }
+    }
+
+    #[test]
+    fn navigation() {
+        let mut history = History::default();
+        for name in ["api", "web", "cli"] {
+            history.visit(&project(name));
+        }
+        assert_eq!(history.peek(true), None);
+        assert_eq!(history.peek(false), Some(&project("web")));
+        history.step(false);
+        history.step(false);
+        assert_eq!(history.peek(false), None);
+        assert_eq!(history.peek(true), Some(&project("web")));
+
+        // a new switch replaces everything ahead
+        history.visit(&project("docs"));
+        assert_eq!(history.peek(true), None);
+        assert_eq!(history.peek(false), Some(&project("api")));
+
+        // staying put is not a switch
+        history.visit(&project("docs"));
+        assert_eq!(history.entries.len(), 2);
+    }
+}
@@ -0,0 +1,434 @@
+//! `project import`: bring in projects known to other tools, so switching to
+//! this one does not start from nothing
+
+use eyre::Result;
+use std::{
+    path::{Path, PathBuf},
+    time::UNIX_EPOCH,
+};
+
+use crate::{
+    canonical_path, normalize_path, state::State, tmux, tmux::shell_quote, toml_string, Cache,
+    Config, ProjectPath,
+};
+
+#[derive(Debug, Clone, Copy)]
+pub(crate) enum Source {
+    Tmuxinator,
+    Tmuxp,
+    VsCode,
+    JetBrains,
+}
+
+impl std::str::FromStr for Source {
+    type Err = String;
+
+    fn from_str(s: &str) -> std::result::Result<Self, Self::Err> {
+        match s {
+            "tmuxinator" => Ok(Source::Tmuxinator),
+            "tmuxp" => Ok(Source::Tmuxp),
+            "vscode" => Ok(Source::VsCode),
+            "jetbrains" => Ok(Source::JetBrains),
+            other => Err(format!(
+                "unknown source {:?}, expected tmuxinator, tmuxp, vscode or jetbrains",
+                other
+            )),
+        }
+    }
+}
+
+/// A project found in another tool's files
+#[derive(Debug, PartialEq, Eq)]
+struct Imported {
+    name: String,
+    root: PathBuf,
+    /// opens the project with the other tool's layout
+    opener: Option<String>,
+    /// when the other tool last opened the project, in seconds since the
+    /// unix epoch
+    used_at: Option<u64>,
+}
+
+impl Imported {
+    /// A project known only by its directory
+    fn dir(root: PathBuf, used_at: Option<u64>) -> Self {
+        let name = root
+            .file_name()
+            .map(|n| n.to_string_lossy().into_owned())
+            .unwrap_or_else(|| root.to_string_lossy().into_owned());
+        Self {
+            name,
+            root,
+            opener: None,
+            used_at,
+        }
+    }
+}
+
+/// The value of the unindented `key: value` line for any of `keys`. Session
+/// files keep the name and root at the top level as plain scalars, so this
+/// much YAML is enough.
+fn top_level(yaml: &str, keys: &[&str]) -> Option<String> {
+    yaml.lines().find_map(|line| {
+        let (key, value) = line.split_once(':')?;
+        if !keys.contains(&key) {
+            return None;
+        }
+        let value = value.split(" #").next().unwrap_or(value).trim();
+        let value = value
+            .strip_prefix('"')
+            .and_then(|v| v.strip_suffix('"'))
+            .or_else(|| value.strip_prefix('\'').and_then(|v| v.strip_suffix('\'')))
+            .unwrap_or(value);
+        Some(value.to_string()).filter(|v| !v.is_empty())
+    })
+}
+
+fn parse_session(source: Source, file: &Path, yaml: &str) -> Option<Imported> {
+    let stem = file.file_stem()?.to_string_lossy().into_owned();
+    let (name, root, opener) = match source {
+        Source::Tmuxp => {
+            let name = top_level(yaml, &["session_name"]).unwrap_or(stem);
+            let root = top_level(yaml, &["start_directory"])?;
+            let opener = format!("tmuxp load -y {}", shell_quote(&file.to_string_lossy()));
+            (name, root, opener)
+        }
+        Source::Tmuxinator => {
+            let name = top_level(yaml, &["name"]).unwrap_or(stem);
+            let root = top_level(yaml, &["root", "project_root"])?;
+            let opener = format!("tmuxinator start {}", shell_quote(&name));
+            (name, root, opener)
+        }
+        Source::VsCode | Source::JetBrains => return None,
+    };
+    Some(Imported {
+        name,
+        root: normalize_path(&root).ok()?,
+        opener: Some(opener),
+        used_at: None,
+    })
+}
+
+/// `tmuxinator` and `tmuxp` session files
+fn sessions(source: Source) -> Vec<Imported> {
+    let home = dirs::home_dir().unwrap_or_default();
+    let config = dirs::config_dir().unwrap_or_else(|| home.join(".config"));
+    let dirs = match source {
+        Source::Tmuxp => [config.join("tmuxp"), home.join(".tmuxp")],
+        Source::Tmuxinator => [config.join("tmuxinator"), home.join(".tmuxinator")],
+        Source::VsCode | Source::JetBrains => return Vec::new(),
+    };
+
+    let mut found = Vec::new();
+    for dir in dirs {
+        let entries = match std::fs::read_dir(&dir) {
+            Ok(entries) => entries,
+            Err(_) => continue,
+        };
+        let mut files: Vec<PathBuf> = entries
+            .filter_map(|entry| entry.ok().map(|e| e.path()))
+            .filter(|path| {
+                path.extension()
+                    .map_or(false, |ext| ext == "yml" || ext == "yaml")
+            })
+            .collect();
+        files.sort();
+        for file in files {
+            match std::fs::read_to_string(&file) {
+                Ok(yaml) => match parse_session(source, &file, &yaml) {
+                    Some(imported) => found.push(imported),
+                    None => log::warn!("no root directory in {}", file.display()),
+                },
+                Err(e) => log::warn!("reading {}: {}", file.display(), e),
+            }
+        }
+    }
+    found
+}
+
+/// Decode `%xx` escapes, as found in URIs
+fn percent_decode(s: &str) -> String {
+    let bytes = s.as_bytes();
+    let mut out = Vec::with_capacity(bytes.len());
+    let mut i = 0;
+    while i < bytes.len() {
+        let hex = bytes
+            .get(i + 1..i + 3)
+            .and_then(|h| std::str::from_utf8(h).ok())
+            .and_then(|h| u8::from_str_radix(h, 16).ok());
+        match (bytes[i], hex) {
+            (b'%', Some(byte)) => {
+                out.push(byte);
+                i += 3;
+            }
+            (byte, _) => {
+                out.push(byte);
+                i += 1;
+            }
+        }
+    }
+    String::from_utf8_lossy(&out).into_owned()
+}
+
+/// Local folders in VS Code's recent list, most recent first. The list is
+/// JSON, either in storage.json or as a value in the state.vscdb database,
+/// so looking for the `folderUri` keys works for both without reading
+/// SQLite.
+fn parse_vscode(text: &str) -> Vec<PathBuf> {
+    const KEY: &str = "\"folderUri\":\"";
+    let mut found: Vec<PathBuf> = Vec::new();
+    for (start, _) in text.match_indices(KEY) {
+        let rest = &text[start + KEY.len()..];
+        let uri = &rest[..rest.find('"').unwrap_or(rest.len())];
+        // remote folders such as vscode-remote:// are not on this machine
+        if let Some(path) = uri.strip_prefix("file://") {
+            let path = PathBuf::from(percent_decode(path));
+            if !found.contains(&path) {
+                found.push(path);
+            }
+        }
+    }
+    found
+}
+
+/// Undo the escaping of an XML attribute value
+fn xml_unescape(s: &str) -> String {
+    s.replace("&quot;", "\"")
+        .replace("&apos;", "'")
+        .replace("&lt;", "<")
+        .replace("&gt;", ">")
+        .replace("&amp;", "&")
+}
+
+/// Projects and when they were last opened from a JetBrains
+/// recentProjects.xml, where each is an `<entry key="path">` holding a
+/// `projectOpenTimestamp` option in milliseconds
+fn parse_jetbrains(xml: &str, home: &Path) -> Vec<(PathBuf, Option<u64>)> {
+    const KEY: &str = "<entry key=\"";
+    let home = home.to_string_lossy();
+    xml.split(KEY)
+        .skip(1)
+        .filter_map(|entry| {
+            let key = &entry[..entry.find('"')?];
+            let path = xml_unescape(key).replace("$USER_HOME$", &home);
+            let body = &entry[..entry.find("</entry>").unwrap_or(entry.len())];
+            let opened_at = body
+                .split_once("name=\"projectOpenTimestamp\" value=\"")
+                .and_then(|(_, rest)| rest[..rest.find('"')?].parse::<u64>().ok())
+                .map(|ms| ms / 1000);
+            Some((PathBuf::from(path), opened_at))
+        })
+        .collect()
+}
+
+fn modified(path: &Path) -> Option<u64> {
+    let modified = std::fs::metadata(path).ok()?.modified().ok()?;
+    modified
+        .duration_since(UNIX_EPOCH)
+        .ok()
+        .map(|d| d.as_secs())
+}
+
+fn vscode() -> Vec<Imported> {
+    let config = match dirs::config_dir() {
+        Some(config) => config,
+        None => return Vec::new(),
+    };
+    let mut found = Vec::new();
+    for product in ["Code", "Code - Insiders", "VSCodium"] {
+        let storage = config.join(product).join("User").join("globalStorage");
+        for file in ["state.vscdb", "storage.json"] {
+            let path = storage.join(file);
+            let bytes = match std::fs::read(&path) {
+                Ok(bytes) => bytes,
+                Err(_) => continue,
+            };
+            // the list keeps no times, only an order, so count the newest as
+            // opened when the list was written and each one after a second
+            // before the last
+            let written = modified(&path).unwrap_or(0);
+            let folders = parse_vscode(&String::from_utf8_lossy(&bytes));
+            found.extend(
+                folders.into_iter().enumerate().map(|(i, folder)| {
+                    Imported::dir(folder, Some(written.saturating_sub(i as u64)))
+                }),
+            );
+        }
+    }
+    found
+}
+
+fn jetbrains() -> Vec<Imported> {
+    let (home, config) = match (dirs::home_dir(), dirs::config_dir()) {
+        (Some(home), Some(config)) => (home, config),
+        _ => return Vec::new(),
+    };
+    // one directory per product and version, such as IntelliJIdea2023.2
+    let products = match std::fs::read_dir(config.join("JetBrains")) {
+        Ok(entries) => entries,
+        Err(_) => return Vec::new(),
+    };
+    let mut found = Vec::new();
+    for product in products.filter_map(|e| e.ok()) {
+        for file in ["recentProjects.xml", "recentSolutions.xml"] {
+            let path = product.path().join("options").join(file);
+            if let Ok(xml) = std::fs::read_to_string(&path) {
+                found.extend(
+                    parse_jetbrains(&xml, &home)
+                        .into_iter()
+                        .map(|(root, opened_at)| Imported::dir(root, opened_at)),
+                );
+            }
+        }
+    }
+    found
+}
+
+fn find(source: Source) -> Vec<Imported> {
+    let found = match source {
+        Source::Tmuxinator | Source::Tmuxp => sessions(source),
+        Source::VsCode => vscode(),
+        Source::JetBrains => jetbrains(),
+    };
+    // recent lists outlive the directories in them. Paths are resolved as
+    // scans resolve them, so usage and openers land on the project's key.
+    let mut seen = std::collections::HashSet::new();
+    found
+        .into_iter()
+        .filter(|i| i.root.is_dir())
+        .map(|i| Imported {
+            root: canonical_path(&i.root),
+            ..i
+        })
+        .filter(|i| seen.insert(i.root.clone()))
+        .collect()
+}
+
+/// `[[projects]]` entries for the imported projects
+fn projects_toml(imported: &[&Imported]) -> String {
+    imported
+        .iter()
+        .map(|i| {
+            format!(
+                "\n[[projects]]\npath = {}\nname = {}\n",
+                toml_string(&i.root.display().to_string()),
+                toml_string(&i.name)
+            )
+        })
+        .collect()
+}
+
+/// Add the projects `source` knows about, with their layouts and when they
+/// were last used there. Projects outside the config file's projects and
+/// roots go in the cache, and config entries to keep them for good are
+/// printed.
+pub(crate) fn run(cfg: &Config, cache: &Cache, state: &State, source: Source) -> Result<()> {
+    let imported = find(source);
+    if imported.is_empty() {
+        eprintln!("no projects to import");
+        return Ok(());
+    }
+
+    let mut unknown = Vec::new();
+    for i in &imported {
+        let full_path = i.root.to_string_lossy().into_owned();
+        if let Some(at) = i.used_at {
+            state.seed_last_used(&full_path, at);
+        }
+        // an opener chosen here already wins over the other tool's layout
+        if let Some(opener) = i
+            .opener
+            .as_ref()
+            .filter(|_| state.opener(&full_path).is_none())
+        {
+            state.set_opener(&full_path, opener);
+        }
+        let known = cfg
+            .projects
+            .iter()
+            .any(|p| canonical_path(&p.path) == i.root)
+            || cfg.root_for(&full_path).is_some();
+        if !known {
+            cache.add(ProjectPath {
+                full_path: full_path.clone(),
+                session_name: tmux::session_name(&i.name),
+            });
+            unknown.push(i);
+        }
+        eprintln!("imported {} ({})", i.name, full_path);
+    }
+
+    if !unknown.is_empty() {
+        println!("# add these to the config file to keep them through rescans");
+        print!("{}", projects_toml(&unknown));
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn session_files() {
+        let tmuxinator = "# ~/.config/tmuxinator/api.yml\nname: api\nroot: \"/work/api\" # the repo\n\nwindows:\n  - editor:\n      root: /elsewhere\n";
+        assert_eq!(
+            parse_session(Source::Tmuxinator, Path::new("api.yml"), tmuxinator),
+            Some(Imported {
+                name: "api".to_string(),
+                root: PathBuf::from("/work/api"),
+                opener: Some("tmuxinator start api".to_string()),
+                used_at: None,
+            })
+        );
+
+        let tmuxp =
+            "session_name: 'web app'\nstart_directory: /work/web\nwindows:\n- window_name: dev\n";
+        let imported =
+            parse_session(Source::Tmuxp, Path::new("/home/me/.tmuxp/web.yaml"), tmuxp).unwrap();
+        assert_eq!(imported.name, "web app");
+        assert_eq!(imported.root, PathBuf::from("/work/web"));
+        assert_eq!(
+            imported.opener.as_deref(),
+            Some("tmuxp load -y /home/me/.tmuxp/web.yaml")
+        );
+
+        assert_eq!(
+            parse_session(Source::Tmuxinator, Path::new("x.yml"), "windows:\n"),
+            None
+        );
+    }
+
+    #[test]
+    fn editor_recents() {
+        let vscode = r#"{"openedPathsList":{"entries":[{"folderUri":"file:///work/my%20api"},{"folderUri":"vscode-remote://ssh-remote%2Bbox/srv"},{"fileUri":"file:///etc/hosts"},{"folderUri":"file:///work/web"},{"folderUri":"file:///work/web"}]}}"#;
+        assert_eq!(
+            parse_vscode(vscode),
+            vec![PathBuf::from("/work/my api"), PathBuf::from("/work/web")]
+        );
+
+        let jetbrains = r#"<application>
+  <component name="RecentProjectsManager">
+    <option name="additionalInfo">
+      <map>
+        <entry key="$USER_HOME$/work/api">
+          <value>
+            <RecentProjectMetaInfo>
+              <option name="projectOpenTimestamp" value="1690000000123" />
+            </RecentProjectMetaInfo>
+          </value>
+        </entry>
+        <entry key="/srv/r&amp;d" />
+      </map>
+    </option>
+  </component>
+</application>"#;
+        assert_eq!(
+            parse_jetbrains(jetbrains, Path::new("/home/me")),
+            vec![
+                (PathBuf::from("/home/me/work/api"), Some(1690000000)),
+                (PathBuf::from("/srv/r&d"), None),
+            ]
+        );
+    }
+}
@@ -0,0 +1,234 @@
+//! A compact copy of the cache for looking up a single project, so that
+//! `project open <path>` and friends start without parsing the whole cache.
+//! Each cache write also writes the projects as a sorted file of
+//! "path<TAB>session" lines, and a bloom filter over both paths and session
+//! names which rules most misses out without reading that file at all.
+
+use std::path::{Path, PathBuf};
+
+use crate::{journal_file, tilde, CacheInner, ProjectPath};
+
+/// Bits in the filter for each key, for about a 1% false positive rate
+const BITS_PER_KEY: usize = 10;
+const HASHES: u32 = 7;
+
+struct Bloom {
+    bits: Vec<u64>,
+}
+
+/// FNV-1a, with a seed so two independent hashes can be combined into as
+/// many as the filter needs. Unlike std's hasher it is stable between
+/// releases, so it can name files.
+pub(crate) fn fnv(key: &str, seed: u64) -> u64 {
+    let mut hash = 0xcbf29ce484222325 ^ seed;
+    for byte in key.bytes() {
+        hash ^= byte as u64;
+        hash = hash.wrapping_mul(0x100000001b3);
+    }
+    hash
+}
+
+impl Bloom {
+    fn new(keys: usize) -> Self {
+        let words = (keys * BITS_PER_KEY + 63) / 64;
+        Self {
+            bits: vec![0; words.max(1)],
+        }
+    }
+
+    fn positions(&self, key: &str) -> impl Iterator<Item = usize> {
+        let (a, b) = (fnv(key, 0), fnv(key, 0x9e3779b97f4a7c15));
+        let len = self.bits.len() as u64 * 64;
+        (0..HASHES as u64).map(move |i| (a.wrapping_add(i.wrapping_mul(b)) % len) as usize)
+    }
+
+    fn insert(&mut self, key: &str) {
+        for bit in self.positions(key).collect::<Vec<_>>() {
+            self.bits[bit / 64] |= 1 << (bit % 64);
+        }
+    }
+
+    fn may_contain(&self, key: &str) -> bool {
+        self.positions(key)
+            .all(|bit| self.bits[bit / 64] & (1 << (bit % 64)) != 0)
+    }
+
+    fn to_bytes(&self) -> Vec<u8> {
+        self.bits
+            .iter()
+            .flat_map(|word| word.to_le_bytes())
+            .collect()
+    }
+
+    fn from_bytes(bytes: &[u8]) -> Option<Self> {
+        if bytes.is_empty() || bytes.len() % 8 != 0 {
+            return None;
+        }
+        let bits = bytes
+            .chunks(8)
+            .map(|chunk| u64::from_le_bytes(chunk.try_into().unwrap()))
+            .collect();
+        Some(Self { bits })
+    }
+}
+
+fn sorted_file(cache_file: &Path) -> PathBuf {
+    cache_file.with_file_name("index.txt")
+}
+
+fn bloom_file(cache_file: &Path) -> PathBuf {
+    cache_file.with_file_name("index.bloom")
+}
+
+/// Write the index for `inner`, which has just been saved to `cache_file`
+pub(crate) fn write(cache_file: &Path, inner: &CacheInner) -> std::io::Result<()> {
+    let mut bloom = Bloom::new(inner.paths.len() * 2);
+    let mut sorted = String::new();
+    // the set is ordered by path already
+    for project in &inner.paths {
+        bloom.insert(&project.full_path);
+        bloom.insert(&project.session_name);
+        sorted.push_str(&format!(
+            "{}\t{}\n",
+            project.full_path, project.session_name
+        ));
+    }
+    std::fs::write(sorted_file(cache_file), sorted)?;
+    std::fs::write(bloom_file(cache_file), bloom.to_bytes())
+}
+
+/// What the index knows about a project
+pub(crate) enum Lookup {
+    Found(ProjectPath),
+    /// certainly not in the cache
+    Absent,
+    /// the index is missing or out of date, so the cache has to be read
+    Unknown,
+}
+
+fn parse_line(line: &str) -> Option<ProjectPath> {
+    let (full_path, session_name) = line.split_once('\t')?;
+    Some(ProjectPath {
+        full_path: full_path.to_string(),
+        session_name: session_name.to_string(),
+    })
+}
+
+fn find_path(lines: &[&str], path: &str) -> Option<ProjectPath> {
+    let found = lines.binary_search_by(|line| {
+        let line_path = line.split_once('\t').map_or(*line, |(p, _)| p);
+        line_path.cmp(path)
+    });
+    found.ok().and_then(|i| parse_line(lines[i]))
+}
+
+/// Find a project in the sorted lines by any of `paths`, or else by its
+/// session name, the same way as [`crate::Cache::lookup`]
+fn find(sorted: &str, paths: &[&str], session_name: &str) -> Option<ProjectPath> {
+    let lines: Vec<&str> = sorted.lines().collect();
+    if let Some(project) = paths.iter().find_map(|path| find_path(&lines, path)) {
+        return Some(project);
+    }
+    lines
+        .iter()
+        .filter_map(|line| parse_line(line))
+        .find(|p| p.session_name == session_name)
+}
+
+/// Whether the index has everything the cache does
+fn usable(cache_file: &Path) -> bool {
+    let modified = |path: &Path| std::fs::metadata(path).and_then(|m| m.modified()).ok();
+    let fresh = match (modified(&bloom_file(cache_file)), modified(cache_file)) {
+        (Some(index), Some(cache)) => index >= cache,
+        _ => false,
+    };
+    // projects found since the cache was written are only in the journal
+    let journalled = std::fs::metadata(journal_file(cache_file)).map_or(false, |m| m.len() > 0);
+    fresh && !journalled
+}
+
+/// Look up a project by path or session name without reading the cache
+pub(crate) fn lookup(cache_file: &Path, query: &str) -> Lookup {
+    if !usable(cache_file) {
+        return Lookup::Unknown;
+    }
+    let bloom = match std::fs::read(bloom_file(cache_file))
+        .ok()
+        .and_then(|bytes| Bloom::from_bytes(&bytes))
+    {
+        Some(bloom) => bloom,
+        None => return Lookup::Unknown,
+    };
+
+    let expanded = tilde::expand(query).into_owned();
+    let canonical = std::fs::canonicalize(&expanded)
+        .ok()
+        .and_then(|p| p.to_str().map(str::to_string));
+    let mut paths = vec![expanded.as_str()];
+    paths.extend(canonical.as_deref());
+    if !paths
+        .iter()
+        .chain([&query])
+        .any(|key| bloom.may_contain(key))
+    {
+        return Lookup::Absent;
+    }
+    match std::fs::read_to_string(sorted_file(cache_file)) {
+        Ok(sorted) => match find(&sorted, &paths, query) {
+            Some(project) => Lookup::Found(project),
+            None => Lookup::Absent,
+        },
+        Err(_) => Lookup::Unknown,
+    }
+}
+
+/// The deepest project `dir` is in, without reading the cache
+pub(crate) fn containing(cache_file: &Path, dir: &Path) -> Lookup {
+    if !usable(cache_file) {
+        return Lookup::Unknown;
+    }
+    let sorted = match std::fs::read_to_string(sorted_file(cache_file)) {
+        Ok(sorted) => sorted,
+        Err(_) => return Lookup::Unknown,
+    };
+    let lines: Vec<&str> = sorted.lines().collect();
+    dir.ancestors()
+        .filter_map(|ancestor| ancestor.to_str())
+        .find_map(|ancestor| find_path(&lines, ancestor))
+        .map_or(Lookup::Absent, Lookup::Found)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn bloom_filter() {
+        let mut bloom = Bloom::new(100);
+        for i in 0..100 {
+            bloom.insert(&format!("/work/project-{}", i));
+        }
+        let bloom = Bloom::from_bytes(&bloom.to_bytes()).unwrap();
+        assert!((0..100).all(|i| bloom.may_contain(&format!("/work/project-{}", i))));
+        let false_positives = (0..1000)
+            .filter(|i| bloom.may_contain(&format!("/elsewhere/{}", i)))
+            .count();
+        assert!(false_positives < 50, "{} false positives", false_positives);
+    }
+
+    #[test]
+    fn sorted_lookup() {
+        let sorted = "/work/api\tapi\n/work/web\tweb\n/work/web-2\tclients/web\n";
+        assert_eq!(
+            find(sorted, &["/work/web"], "/work/web")
+                .unwrap()
+                .session_name,
+            "web"
+        );
+        assert_eq!(
+            find(sorted, &["web-2"], "clients/web").unwrap().full_path,
+            "/work/web-2"
+        );
+        assert!(find(sorted, &["/work/cli"], "cli").is_none());
+    }
+}
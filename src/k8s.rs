@@ -0,0 +1,128 @@
+//! The "dev-pod" opener: a session whose windows run a shell in a Kubernetes
+//! pod which has the project directories mounted, through `kubectl exec`
+
+use eyre::Result;
+use serde::{Deserialize, Serialize};
+use std::{collections::BTreeMap, path::Path};
+
+use crate::{canonical_key, tmux::shell_quote};
+
+/// The opener value which opens a project in the dev pod
+pub(crate) const OPENER: &str = "dev-pod";
+
+#[derive(Debug, Serialize, Deserialize)]
+pub(crate) struct DevPodConfig {
+    /// the pod, or anything `kubectl exec` takes such as "deploy/devbox"
+    pod: String,
+    namespace: Option<String>,
+    /// the kubeconfig context, the current one by default
+    context: Option<String>,
+    /// the container in the pod, kubectl's default one otherwise
+    container: Option<String>,
+    /// where directories here are mounted in the pod, e.g. "~/work" =
+    /// "/workspace"
+    #[serde(default)]
+    mounts: BTreeMap<String, String>,
+}
+
+impl DevPodConfig {
+    /// Expand and resolve the local side of each mount as project paths are,
+    /// keeping "/" as it is
+    pub(crate) fn canonicalize(&mut self) {
+        let mounts = std::mem::take(&mut self.mounts);
+        self.mounts = mounts
+            .into_iter()
+            .map(|(local, remote)| (canonical_key(&local), remote))
+            .collect();
+    }
+
+    /// Where the project at `full_path` is in the pod, through the most
+    /// specific mount holding it
+    fn pod_path(&self, full_path: &str) -> Option<String> {
+        self.mounts
+            .iter()
+            .filter_map(|(local, remote)| {
+                let local = Path::new(local);
+                let relative = Path::new(full_path).strip_prefix(local).ok()?;
+                Some((local.components().count(), Path::new(remote).join(relative)))
+            })
+            .max_by_key(|(depth, _)| *depth)
+            .map(|(_, path)| path.to_string_lossy().into_owned())
+    }
+
+    /// The command for the session's windows: `shell`, or the pod's login
+    /// shell, started in the project's directory in the pod
+    pub(crate) fn shell(&self, full_path: &str, shell: Option<&str>) -> Result<String> {
+        let path = self.pod_path(full_path).ok_or_else(|| {
+            eyre::eyre!(
+                "{} is not in any of the directories in [dev_pod.mounts]",
+                full_path
+            )
+        })?;
+        let mut command = String::from("kubectl");
+        if let Some(context) = &self.context {
+            command += &format!(" --context {}", shell_quote(context));
+        }
+        if let Some(namespace) = &self.namespace {
+            command += &format!(" --namespace {}", shell_quote(namespace));
+        }
+        command += &format!(" exec -it {}", shell_quote(&self.pod));
+        if let Some(container) = &self.container {
+            command += &format!(" --container {}", shell_quote(container));
+        }
+        let script = format!(
+            "cd {} && exec {}",
+            shell_quote(&path),
+            shell.unwrap_or("\"${SHELL:-sh}\" -l")
+        );
+        command += &format!(" -- sh -c {}", shell_quote(&script));
+        Ok(command)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn pod_shells() {
+        let mut cfg = DevPodConfig {
+            pod: "deploy/devbox".to_string(),
+            namespace: Some("dev".to_string()),
+            context: None,
+            container: Some("main".to_string()),
+            mounts: [
+                ("/home/me/work/".to_string(), "/workspace".to_string()),
+                ("/home/me/work/oss".to_string(), "/oss".to_string()),
+            ]
+            .into(),
+        };
+        cfg.canonicalize();
+        assert_eq!(
+            cfg.pod_path("/home/me/work/api").as_deref(),
+            Some("/workspace/api")
+        );
+        assert_eq!(
+            cfg.pod_path("/home/me/work/oss/lib").as_deref(),
+            Some("/oss/lib")
+        );
+        assert_eq!(cfg.pod_path("/home/me/other"), None);
+        assert_eq!(
+            cfg.shell("/home/me/work/api", Some("zsh")).unwrap(),
+            "kubectl --namespace dev exec -it deploy/devbox --container main -- sh -c 'cd /workspace/api && exec zsh'"
+        );
+        assert!(cfg.shell("/elsewhere", None).is_err());
+
+        // the whole filesystem mounted somewhere
+        cfg.mounts.insert("/".to_string(), "/host".to_string());
+        cfg.canonicalize();
+        assert_eq!(
+            cfg.pod_path("/home/me/other").as_deref(),
+            Some("/host/home/me/other")
+        );
+        assert_eq!(
+            cfg.pod_path("/home/me/work/api").as_deref(),
+            Some("/workspace/api")
+        );
+    }
+}
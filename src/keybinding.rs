@@ -0,0 +1,136 @@
+use eyre::{Result, WrapErr};
+use std::path::PathBuf;
+
+use crate::tmux::shell_quote;
+
+/// Marks the line we manage so later runs can find and replace it
+const MARKER: &str = "# added by `project install-keybinding`";
+
+/// How the picker is shown from the key binding. run-shell is not offered as
+/// it gives the command no terminal to draw the picker on.
+#[derive(Debug, Clone, Copy)]
+pub(crate) enum Style {
+    Popup,
+    Window,
+}
+
+impl std::str::FromStr for Style {
+    type Err = String;
+
+    fn from_str(s: &str) -> std::result::Result<Self, Self::Err> {
+        match s {
+            "popup" => Ok(Style::Popup),
+            "window" => Ok(Style::Window),
+            other => Err(format!(
+                "unknown style {:?}, expected popup or window",
+                other
+            )),
+        }
+    }
+}
+
+fn binding(key: &str, style: Style) -> Result<String> {
+    let exe = std::env::current_exe().wrap_err("finding path to this program")?;
+    let exe = exe.to_string_lossy();
+    let exe = shell_quote(&exe);
+    Ok(match style {
+        Style::Popup => format!("bind-key {} display-popup -E -w 80% -h 60% {}", key, exe),
+        Style::Window => format!("bind-key {} new-window -n project {}", key, exe),
+    })
+}
+
+fn tmux_conf() -> PathBuf {
+    let home = dirs::home_dir().unwrap_or_else(|| PathBuf::from("~"));
+    let dotfile = home.join(".tmux.conf");
+    let xdg = dirs::config_dir()
+        .unwrap_or_else(|| home.join(".config"))
+        .join("tmux")
+        .join("tmux.conf");
+    if !dotfile.exists() && xdg.exists() {
+        xdg
+    } else {
+        dotfile
+    }
+}
+
+/// Add `line` to `conf`, replacing a line added by an earlier install.
+/// Returns `None` when the binding is already present.
+fn with_binding(conf: &str, line: &str) -> Option<String> {
+    let lines: Vec<&str> = conf.lines().collect();
+    match lines.iter().position(|l| *l == MARKER) {
+        Some(i) if lines.get(i + 1) == Some(&line) => None,
+        Some(i) => {
+            let mut out: Vec<&str> = lines[..=i].to_vec();
+            out.push(line);
+            out.extend(lines.iter().skip(i + 2));
+            Some(out.join("\n") + "\n")
+        }
+        None => {
+            let mut out = conf.to_string();
+            if !out.is_empty() && !out.ends_with('\n') {
+                out.push('\n');
+            }
+            out.push_str(MARKER);
+            out.push('\n');
+            out.push_str(line);
+            out.push('\n');
+            Some(out)
+        }
+    }
+}
+
+pub(crate) fn run(key: &str, style: Style, print: bool, file: Option<PathBuf>) -> Result<()> {
+    let line = binding(key, style)?;
+    if print {
+        println!("{}", line);
+        return Ok(());
+    }
+
+    let path = file.unwrap_or_else(tmux_conf);
+    let conf = match std::fs::read_to_string(&path) {
+        Ok(conf) => conf,
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => String::new(),
+        Err(e) => return Err(e).wrap_err_with(|| format!("reading {}", path.display())),
+    };
+    match with_binding(&conf, &line) {
+        Some(updated) => {
+            std::fs::write(&path, updated)
+                .wrap_err_with(|| format!("writing {}", path.display()))?;
+            println!("added key binding to {}", path.display());
+            println!("reload it with: tmux source-file {}", path.display());
+        }
+        None => println!("key binding already present in {}", path.display()),
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn installs_idempotently() {
+        let conf = "set -g mouse on";
+        let installed = with_binding(conf, "bind-key f new-window project").unwrap();
+        assert_eq!(
+            installed,
+            format!(
+                "set -g mouse on\n{}\nbind-key f new-window project\n",
+                MARKER
+            )
+        );
+        assert_eq!(
+            with_binding(&installed, "bind-key f new-window project"),
+            None
+        );
+
+        let replaced = with_binding(&installed, "bind-key g new-window project").unwrap();
+        assert_eq!(
+            replaced,
+            format!(
+                "set -g mouse on\n{}\nbind-key g new-window project\n",
+                MARKER
+            )
+        );
+    }
+}
@@ -0,0 +1,241 @@
+//! `project export-layout`: describe a project's session as a tmuxinator or
+//! tmuxp config, for teammates who use those tools
+
+use eyre::{Result, WrapErr};
+use std::path::Path;
+
+use crate::{tmux, ProjectPath};
+
+#[derive(Debug, Clone, Copy)]
+pub(crate) enum Tool {
+    Tmuxinator,
+    Tmuxp,
+}
+
+impl std::str::FromStr for Tool {
+    type Err = String;
+
+    fn from_str(s: &str) -> std::result::Result<Self, Self::Err> {
+        match s {
+            "tmuxinator" => Ok(Tool::Tmuxinator),
+            "tmuxp" => Ok(Tool::Tmuxp),
+            other => Err(format!(
+                "unknown tool {:?}, expected tmuxinator or tmuxp",
+                other
+            )),
+        }
+    }
+}
+
+/// Programs which are where a pane starts anyway, so are not worth running
+const SHELLS: &[&str] = &["sh", "bash", "zsh", "fish", "dash", "ksh", "tcsh", "nu"];
+
+#[derive(Debug, PartialEq, Eq)]
+struct Window {
+    name: String,
+    /// left out with one pane, where there is nothing to lay out
+    layout: Option<String>,
+    /// the commands to type into each pane
+    panes: Vec<Vec<String>>,
+}
+
+#[derive(Debug, PartialEq, Eq)]
+struct Layout {
+    name: String,
+    root: String,
+    windows: Vec<Window>,
+}
+
+fn is_shell(command: &str) -> bool {
+    let command = command.trim_start_matches('-');
+    SHELLS.contains(&command)
+        || std::env::var("SHELL").map_or(false, |shell| {
+            Path::new(&shell)
+                .file_name()
+                .map_or(false, |n| n == command)
+        })
+}
+
+impl Layout {
+    /// A single window in the project directory, for a project without a
+    /// session to copy
+    fn plain(project: &ProjectPath) -> Self {
+        Self {
+            name: project.session_name.clone(),
+            root: project.full_path.clone(),
+            windows: vec![Window {
+                name: "main".to_string(),
+                layout: None,
+                panes: vec![Vec::new()],
+            }],
+        }
+    }
+
+    /// The windows and panes of a running session. tmux knows the program in
+    /// each pane but not its arguments, so panes get the bare program, after
+    /// a cd if they have moved away from the project directory.
+    fn from_panes(project: &ProjectPath, panes: Vec<tmux::Pane>) -> Self {
+        let mut windows: Vec<(u32, Window)> = Vec::new();
+        for pane in panes {
+            let mut commands = Vec::new();
+            if pane.path != project.full_path {
+                let dir = Path::new(&pane.path)
+                    .strip_prefix(&project.full_path)
+                    .map(|rel| rel.to_string_lossy().into_owned())
+                    .unwrap_or_else(|_| pane.path.clone());
+                commands.push(format!("cd {}", tmux::shell_quote(&dir)));
+            }
+            if !pane.command.is_empty() && !is_shell(&pane.command) {
+                commands.push(pane.command);
+            }
+            match windows.last_mut() {
+                Some((index, window)) if *index == pane.window_index => {
+                    window.layout = Some(pane.window_layout);
+                    window.panes.push(commands);
+                }
+                _ => windows.push((
+                    pane.window_index,
+                    Window {
+                        name: pane.window_name,
+                        layout: None,
+                        panes: vec![commands],
+                    },
+                )),
+            }
+        }
+        Self {
+            name: project.session_name.clone(),
+            root: project.full_path.clone(),
+            windows: windows.into_iter().map(|(_, window)| window).collect(),
+        }
+    }
+
+    fn to_yaml(&self, tool: Tool) -> String {
+        // JSON strings are valid YAML, quoting everything that needs it
+        let q = |s: &str| serde_json::to_string(s).unwrap_or_default();
+        let mut out = String::new();
+        match tool {
+            Tool::Tmuxinator => {
+                out += &format!(
+                    "name: {}\nroot: {}\nwindows:\n",
+                    q(&self.name),
+                    q(&self.root)
+                );
+                for window in &self.windows {
+                    out += &format!("  - {}:\n", q(&window.name));
+                    if let Some(layout) = &window.layout {
+                        out += &format!("      layout: {}\n", q(layout));
+                    }
+                    out += "      panes:\n";
+                    for pane in &window.panes {
+                        match pane.as_slice() {
+                            [] => out += "        - null\n",
+                            [command] => out += &format!("        - {}\n", q(command)),
+                            commands => {
+                                out += "        -\n";
+                                for command in commands {
+                                    out += &format!("          - {}\n", q(command));
+                                }
+                            }
+                        }
+                    }
+                }
+            }
+            Tool::Tmuxp => {
+                out += &format!(
+                    "session_name: {}\nstart_directory: {}\nwindows:\n",
+                    q(&self.name),
+                    q(&self.root)
+                );
+                for window in &self.windows {
+                    out += &format!("  - window_name: {}\n", q(&window.name));
+                    if let Some(layout) = &window.layout {
+                        out += &format!("    layout: {}\n", q(layout));
+                    }
+                    out += "    panes:\n";
+                    for pane in &window.panes {
+                        if pane.is_empty() {
+                            out += "      - null\n";
+                            continue;
+                        }
+                        out += "      - shell_command:\n";
+                        for command in pane {
+                            out += &format!("          - {}\n", q(command));
+                        }
+                    }
+                }
+            }
+        }
+        out
+    }
+}
+
+/// Print `project`'s layout for `tool`, copied from its session when one is
+/// running
+pub(crate) fn export(project: &ProjectPath, tool: Tool) -> Result<()> {
+    let layout = match tmux::session_state(&project.session_name) {
+        tmux::SessionState::Absent => Layout::plain(project),
+        _ => {
+            let panes = tmux::panes(&project.session_name).wrap_err("listing panes")?;
+            Layout::from_panes(project, panes)
+        }
+    };
+    print!("{}", layout.to_yaml(tool));
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn session_layouts() {
+        let project = ProjectPath {
+            full_path: "/work/api".to_string(),
+            session_name: "api".to_string(),
+        };
+        let pane = |window_index, path: &str, command: &str| tmux::Pane {
+            window_index,
+            window_name: if window_index == 1 { "code" } else { "logs" }.to_string(),
+            window_layout: "b25d,200x50,0,0".to_string(),
+            path: path.to_string(),
+            command: command.to_string(),
+        };
+        let layout = Layout::from_panes(
+            &project,
+            vec![
+                pane(1, "/work/api", "nvim"),
+                pane(1, "/work/api/src", "zsh"),
+                pane(2, "/var/log", "tail"),
+            ],
+        );
+
+        assert_eq!(
+            layout.to_yaml(Tool::Tmuxinator),
+            r#"name: "api"
+root: "/work/api"
+windows:
+  - "code":
+      layout: "b25d,200x50,0,0"
+      panes:
+        - "nvim"
+        - "cd src"
+  - "logs":
+      panes:
+        -
+          - "cd /var/log"
+          - "tail"
+"#
+        );
+        assert_eq!(
+            Layout::plain(&project).to_yaml(Tool::Tmuxp),
+            r#"session_name: "api"
+start_directory: "/work/api"
+windows:
+  - window_name: "main"
+    panes:
+      - null
+"#
+        );
+    }
+}
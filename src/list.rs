@@ -0,0 +1,82 @@
+use eyre::{Result, WrapErr};
+use std::{
+    io::Write,
+    time::{Duration, SystemTime},
+};
+
+use serde::Serialize;
+
+use crate::{cache_file, Cache, Format};
+
+/// How often `--watch` checks whether the cache has changed
+const POLL_INTERVAL: Duration = Duration::from_secs(2);
+
+#[derive(Serialize)]
+struct ListEntry<'a> {
+    path: &'a str,
+    session_name: &'a str,
+    /// as last measured, by the picker's size column or `project stats`;
+    /// listing never walks projects itself
+    size_bytes: Option<u64>,
+}
+
+/// The listing, with JSON on a single line when `compact`
+fn render(cache: &Cache, format: Format, compact: bool) -> Result<String> {
+    let paths = cache.initial_paths();
+
+    match format {
+        Format::Text => Ok(paths.iter().map(|p| format!("{}\n", p.full_path)).collect()),
+        Format::Json => {
+            let entries: Vec<_> = paths
+                .iter()
+                .map(|p| ListEntry {
+                    path: &p.full_path,
+                    session_name: &p.session_name,
+                    size_bytes: cache.cached_size(&p.full_path),
+                })
+                .collect();
+            let json = if compact {
+                serde_json::to_string(&entries)
+            } else {
+                serde_json::to_string_pretty(&entries)
+            };
+            Ok(json.wrap_err("writing json")? + "\n")
+        }
+    }
+}
+
+pub(crate) fn run(cache: &Cache, format: Format) -> Result<()> {
+    print!("{}", render(cache, format, false)?);
+    Ok(())
+}
+
+fn modified() -> Option<SystemTime> {
+    let loc = cache_file().ok()?;
+    std::fs::metadata(loc).and_then(|m| m.modified()).ok()
+}
+
+/// Print the list again whenever it changes, for status bars and dashboards.
+/// Only the cache file is watched, so the lists follow whatever scans the
+/// picker and other commands do rather than rescanning here. Text listings
+/// are separated by a blank line and JSON listings are one per line.
+pub(crate) fn watch(format: Format) -> Result<()> {
+    let mut last_modified = None;
+    let mut last_output = String::new();
+    loop {
+        let current = modified();
+        if current.is_none() || current != last_modified {
+            let cache = Cache::read_only().wrap_err("loading cache")?;
+            let output = render(&cache, format, true)?;
+            last_modified = current;
+            if output != last_output {
+                if !last_output.is_empty() && matches!(format, Format::Text) {
+                    println!();
+                }
+                print!("{}", output);
+                std::io::stdout().flush()?;
+                last_output = output;
+            }
+        }
+        std::thread::sleep(POLL_INTERVAL);
+    }
+}
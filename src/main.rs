@@ -1,65 +1,846 @@
 use eyre::{Result, WrapErr};
 use skim::SkimOptions;
 use std::{
-    borrow::Cow,
-    collections::HashSet,
-    path::PathBuf,
-    sync::{Arc, RwLock},
+    collections::{BTreeMap, BTreeSet, HashMap, HashSet},
+    path::{Component, PathBuf},
+    sync::{
+        atomic::{AtomicBool, Ordering},
+        Arc, RwLock,
+    },
 };
-use tmux_interface::TmuxCommand;
 
-use clap::Parser;
+use clap::{Parser, Subcommand};
 use serde::{Deserialize, Serialize};
+use tmux::Tmux;
+
+mod actions;
+mod activity;
+mod archive;
+mod bench;
+mod bootstrap;
+mod browse;
+mod bulk;
+mod cache;
+mod clipboard;
+mod confirm;
+mod console;
+mod daemon;
+mod discover;
+mod duration;
+mod exclude;
+mod explain;
+mod files;
+mod forge;
+mod git;
+mod group;
+mod history;
+mod import;
+mod index;
+mod k8s;
+mod keybinding;
+mod layout;
+mod list;
+mod manage;
+mod manifest;
+mod mirror;
+mod nvim;
+mod plain;
+mod prompt;
+mod redact;
+mod remote;
+mod report;
+mod rpc;
+mod scaffold;
+mod secret;
+mod service;
+mod sessions;
+mod signals;
+mod ssh;
+mod state;
+mod stats;
+mod statusline;
+mod storage;
+mod sync;
+mod template;
+mod text;
+mod tilde;
+mod tmux;
+mod tracking;
+mod undo;
+mod usage;
+mod wsl;
 
 #[derive(Parser, Debug)]
 struct Args {
-    #[clap(short, long)]
+    #[clap(short, long, conflicts_with = "read_only")]
     clear: bool,
 
+    /// scan from scratch without reading or writing the cache, unlike
+    /// --clear which empties it
+    #[clap(long, conflicts_with = "clear")]
+    no_cache: bool,
+
     #[clap(long)]
     config: Option<PathBuf>,
+
+    /// never save the state or cache, for machines using an index synced
+    /// from elsewhere. Commands which only exist to change them refuse to run
+    #[clap(long, global = true)]
+    read_only: bool,
+
+    /// detach any other clients when attaching to a session
+    #[clap(long, global = true)]
+    detach_others: bool,
+
+    /// keep the picker open as a management console with actions for the
+    /// highlighted project
+    #[clap(long)]
+    console: bool,
+
+    /// print a numbered list and read the choice from stdin instead of
+    /// showing the full screen picker
+    #[clap(long)]
+    plain: bool,
+
+    /// open another session for the project if its session is already
+    /// running, named after the checked out branch or numbered
+    #[clap(long, global = true)]
+    secondary: bool,
+
+    /// never touch the network, working from local files and the cache only
+    #[clap(long, global = true)]
+    offline: bool,
+
+    /// include everything deliberately left out: hidden projects, those
+    /// matching exclude rules and dormant ones past ignore_older_than
+    #[clap(long, global = true)]
+    all: bool,
+
+    /// scan every root now and print how many projects were indexed and how
+    /// many skipped by each exclude rule, depth limit and ignore file
+    #[clap(long)]
+    scan_report: bool,
+
+    /// print the tmux commands which would be run instead of running them
+    #[clap(long, global = true)]
+    dry_run: bool,
+
+    /// kill sessions, archive projects and clear the cache without asking
+    #[clap(short, long, global = true)]
+    yes: bool,
+
+    /// pick a group first, by root, org or tag, then a project in it
+    #[clap(long)]
+    group_by: Option<group::GroupBy>,
+
+    /// print the commands which would create and switch to the project's
+    /// session for a tmux control mode client, such as iTerm2's tmux -CC, to
+    /// run instead of running them
+    #[clap(long, global = true)]
+    print_commands: bool,
+
+    /// log what is being done to stderr, RUST_LOG gives finer control
+    #[clap(short, long, global = true)]
+    verbose: bool,
+
+    /// after choosing a project choose a file in it, which opens in $EDITOR in
+    /// a new window of the project's session
+    #[clap(long)]
+    files: bool,
+
+    /// start the picker with the last query, ctrl-r goes further back
+    #[clap(long)]
+    requery: bool,
+
+    /// extra argument for tmux new-session, may be given more than once
+    #[clap(long = "tmux-arg", global = true, allow_hyphen_values = true)]
+    tmux_args: Vec<String>,
+
+    #[clap(subcommand)]
+    command: Option<Command>,
+}
+
+#[derive(Subcommand, Debug)]
+enum Command {
+    /// Time a cold scan, warm scan and cache load for the current config
+    Bench,
+    /// Create a new project from a template and open a session in it,
+    /// exiting with status 3 if the directory already exists
+    New {
+        /// directory name of the new project
+        name: String,
+
+        /// name of a template from the config file
+        #[clap(long)]
+        template: String,
+
+        /// root directory to create the project in, defaults to the first configured root
+        #[clap(long)]
+        root: Option<PathBuf>,
+    },
+    /// Clone the repositories listed in a team's manifest into a root, and
+    /// update the ones already there
+    SyncManifest {
+        /// the manifest file
+        #[clap(default_value = "projects.toml")]
+        manifest: PathBuf,
+
+        /// root directory to clone into, defaults to the first configured root
+        #[clap(long)]
+        root: Option<PathBuf>,
+    },
+    /// Clone every repository of a GitHub organisation or GitLab group into
+    /// a directory, and update the ones already there
+    Mirror {
+        /// whose repositories: github:org, gitlab:group, or host:owner for a
+        /// forge in [forge.providers]
+        source: String,
+
+        /// directory to keep the clones in, best inside a root directory
+        dir: PathBuf,
+
+        /// leave out repositories matching this glob, like the config file's
+        /// exclude
+        #[clap(long)]
+        exclude: Vec<String>,
+
+        /// mirror archived repositories too
+        #[clap(long)]
+        archived: bool,
+
+        /// mirror forks too
+        #[clap(long)]
+        forks: bool,
+
+        /// clone over HTTPS instead of SSH
+        #[clap(long)]
+        https: bool,
+    },
+    /// Kill a project's session and move it into the archive root
+    Archive {
+        /// path or session name of the project
+        path: String,
+    },
+    /// Print the name of the project a directory is in and the state of its
+    /// session, for a shell prompt
+    Prompt {
+        /// directory to look up, defaults to the current one
+        path: Option<PathBuf>,
+        /// a bare segment for a starship custom module or powerlevel10k,
+        /// with a glyph for the session instead of words
+        #[clap(long)]
+        starship: bool,
+    },
+    /// Print the current project and how many projects with sessions have
+    /// uncommitted changes, for the tmux status line
+    Statusline {
+        /// session to describe, defaults to the one tmux reports as current;
+        /// pass "#S" from the status line to be sure
+        #[clap(long)]
+        session: Option<String>,
+    },
+    /// Switch back to the project before the current one, for a tmux binding
+    Back {
+        /// tmux client to switch, defaults to the current one; pass
+        /// "#{client_tty}" from a binding to be sure
+        #[clap(long)]
+        client: Option<String>,
+    },
+    /// Switch to the project `project back` left, for a tmux binding
+    Forward {
+        /// tmux client to switch, defaults to the current one
+        #[clap(long)]
+        client: Option<String>,
+    },
+    /// Take back the last removal from the cache, hide, tag or pin change
+    Undo,
+    /// Print the cached projects
+    List {
+        /// output format, either text or json
+        #[clap(long, default_value = "text")]
+        format: Format,
+        /// keep running, printing the list again whenever it changes
+        #[clap(long)]
+        watch: bool,
+    },
+    /// Summarise the cached projects and their disk usage
+    Stats,
+    /// Leave a directory or glob out of scans, or list the ignored entries
+    Ignore {
+        /// path or glob such as "~/work/**/vendor" or "node_modules"
+        pattern: Option<String>,
+        /// stop ignoring the pattern
+        #[clap(long)]
+        remove: bool,
+    },
+    /// Keep the cache up to date in the background, rescanning periodically
+    /// and whenever the config file changes
+    Daemon {
+        #[clap(subcommand)]
+        command: Option<DaemonCommand>,
+    },
+    /// Inspect or clear the cached projects
+    Cache {
+        #[clap(subcommand)]
+        command: CacheCommand,
+    },
+    /// Sample tmux session activity for the time spent in `project stats`;
+    /// run it from the status line with `set -ag status-right '#(project track)'`
+    Track,
+    /// Check that the API tokens in the config file can be read
+    Tokens,
+    /// Check the syntax of the shell commands in the config file, which
+    /// unlike its templates are not checked on every run
+    Check,
+    /// Merge pins, notes, usage and the project list with other machines
+    /// through the directory in the [sync] section of the config file
+    Sync,
+    /// Serve line delimited JSON-RPC on stdin and stdout for editor plugins
+    Rpc,
+    /// Suggest root directories by looking for directories in $HOME which
+    /// hold several git repositories
+    Discover {
+        /// how many levels below $HOME to look for repositories
+        #[clap(long, default_value = "4")]
+        depth: usize,
+        /// fewest repositories a directory needs to be suggested
+        #[clap(long, default_value = "3")]
+        min_repos: usize,
+    },
+    /// Add the projects another tool knows about, with their layouts or how
+    /// recently they were used there: tmuxinator, tmuxp, vscode or jetbrains
+    Import {
+        /// the tool to import from
+        source: import::Source,
+    },
+    /// Print a tmuxinator or tmuxp config for a project, copying the windows
+    /// and panes of its session if it has one
+    ExportLayout {
+        /// path or session name of the project
+        path: String,
+        /// the tool to write the config for: tmuxinator or tmuxp
+        #[clap(long, default_value = "tmuxinator")]
+        tool: layout::Tool,
+    },
+    /// Open the project's origin remote in the web browser
+    Browse {
+        /// path or session name of the project
+        path: String,
+    },
+    /// Print a project's path, or copy it to the clipboard
+    Path {
+        /// path or session name of the project
+        path: String,
+        /// the session name rather than the path
+        #[clap(long)]
+        session: bool,
+        /// copy to the clipboard with OSC 52, which works over SSH, instead of printing
+        #[clap(long)]
+        copy: bool,
+    },
+    /// Report whether a directory would be indexed, and if not what stops it
+    Explain {
+        /// the directory, e.g. ~/work/foo
+        path: String,
+    },
+    /// Attach a description to a project, shown in the preview pane
+    Note {
+        /// path or session name of the project
+        path: String,
+
+        /// text of the note, an empty string removes it
+        note: String,
+    },
+    /// Switch to or attach to a project's session without the picker. When
+    /// there is no client, e.g. from cron, only make sure the session exists,
+    /// exiting with status 3 if it already did
+    Open {
+        /// path or session name of the project
+        path: String,
+    },
+    /// Browse the cache to remove stale entries, edit tags and pins, or rescan
+    Manage,
+    /// List live tmux sessions with the project each one belongs to
+    Sessions {
+        #[clap(subcommand)]
+        command: Option<SessionsCommand>,
+    },
+    /// Add a key binding which opens the picker to your tmux config
+    InstallKeybinding {
+        /// key to bind, pressed after the tmux prefix
+        #[clap(long, default_value = "f")]
+        key: String,
+
+        /// how to show the picker, either popup or window
+        #[clap(long, default_value = "popup")]
+        style: keybinding::Style,
+
+        /// print the binding rather than adding it
+        #[clap(long)]
+        print: bool,
+
+        /// tmux config file to edit, defaults to ~/.tmux.conf
+        #[clap(long)]
+        file: Option<PathBuf>,
+    },
+}
+
+impl Command {
+    /// Whether the command is only there to change the state or cache
+    fn writes(&self) -> bool {
+        matches!(
+            self,
+            Command::Note { .. }
+                | Command::Ignore {
+                    pattern: Some(_),
+                    ..
+                }
+                | Command::Cache {
+                    command: CacheCommand::Clear { .. }
+                }
+                | Command::Daemon { command: None }
+                | Command::Sync
+                | Command::Track
+                | Command::Manage
+                | Command::Undo
+                | Command::Import { .. }
+        )
+    }
+}
+
+/// The cache, loaded without saving it back when `--read-only` is given
+fn open_cache(args: &Args) -> Result<Cache> {
+    if args.read_only {
+        Cache::read_only().wrap_err("loading cache")
+    } else {
+        Cache::new(false).wrap_err("creating cache")
+    }
+}
+
+/// Find the project a command line names, reading the whole cache only when
+/// its index cannot answer
+fn resolve_project(cfg: &Config, args: &Args, query: &str) -> Result<ProjectPath> {
+    match index::lookup(&cache_file()?, query) {
+        index::Lookup::Found(project) => Ok(project),
+        index::Lookup::Absent => cfg.resolve(&Cache::in_memory(), query),
+        index::Lookup::Unknown => cfg.resolve(&open_cache(args)?, query),
+    }
+}
+
+fn open_state(args: &Args) -> Result<state::State> {
+    if args.read_only {
+        state::State::open_read_only().wrap_err("opening state")
+    } else {
+        state::State::open().wrap_err("opening state")
+    }
+}
+
+/// The state for commands which run alongside others and save only what
+/// they change
+fn open_shared_state(args: &Args) -> Result<state::State> {
+    if args.read_only {
+        state::State::open_read_only().wrap_err("opening state")
+    } else {
+        state::State::open_shared().wrap_err("opening state")
+    }
+}
+
+#[derive(Subcommand, Debug)]
+enum SessionsCommand {
+    /// Kill sessions created by this tool whose project directory has gone,
+    /// or which have been idle for longer than the given period, after
+    /// asking unless --yes is given
+    Prune {
+        /// idle period such as 12h or 7d, defaults to prune_idle_after from the config
+        #[clap(long)]
+        idle: Option<duration::HumanDuration>,
+    },
+}
+
+#[derive(Debug, Subcommand)]
+enum CacheCommand {
+    /// Dump the cached projects with what is known about them
+    Show {
+        /// output format, either text or json
+        #[clap(long, default_value = "text")]
+        format: Format,
+    },
+    /// Remove cached projects, all of them unless narrowed down
+    Clear {
+        /// only projects beneath this directory
+        #[clap(long)]
+        root: Option<String>,
+        /// only projects matching this glob, e.g. "forks/*"
+        #[clap(long = "match")]
+        pattern: Option<String>,
+    },
+}
+
+#[derive(Debug, Subcommand)]
+enum DaemonCommand {
+    /// Report on the running daemon, failing if it is not running or is stuck
+    Status,
+    /// Run the daemon as a systemd or launchd user service
+    Install {
+        /// print the service file rather than installing it
+        #[clap(long)]
+        print: bool,
+    },
+}
+
+#[derive(Debug, Clone, Copy)]
+enum Format {
+    Text,
+    Json,
+}
+
+impl std::str::FromStr for Format {
+    type Err = String;
+
+    fn from_str(s: &str) -> std::result::Result<Self, Self::Err> {
+        match s {
+            "text" => Ok(Format::Text),
+            "json" => Ok(Format::Json),
+            other => Err(format!("unknown format {:?}, expected text or json", other)),
+        }
+    }
 }
 
 // Cache types
 
-#[derive(Debug, Hash, PartialEq, Eq, Serialize, Deserialize, Clone)]
+#[derive(Debug, Hash, PartialEq, Eq, PartialOrd, Ord, Serialize, Deserialize, Clone)]
 #[serde(rename_all = "PascalCase")]
 struct ProjectPath {
     full_path: String,
     session_name: String,
 }
 
-impl skim::SkimItem for ProjectPath {
+/// Background workers collecting the metadata shown next to picker entries
+struct Annotators {
+    git: Option<git::Enricher>,
+    sizes: Option<usage::Sizer>,
+    /// pull requests, issues and CI, asked for when previewed or, with the CI
+    /// column, when drawn
+    forge: Option<forge::Fetcher>,
+    /// the files most recently modified in each project, for the preview
+    recent: Option<files::RecentFiles>,
+    /// notes from the config file, notes in the state take precedence
+    notes: Arc<HashMap<String, String>>,
+    state: state::State,
+}
+
+impl Annotators {
+    fn item(self: &Arc<Self>, path: ProjectPath) -> ProjectItem {
+        ProjectItem {
+            path,
+            annotators: Arc::clone(self),
+            requested: AtomicBool::new(false),
+        }
+    }
+
+    /// Ask the background workers for the project's git status and size
+    fn request(&self, full_path: &str) {
+        if let Some(enricher) = &self.git {
+            enricher.request(full_path);
+        }
+        if let Some(sizer) = &self.sizes {
+            sizer.request(full_path);
+        }
+        if let Some(fetcher) = self.forge.as_ref().filter(|fetcher| fetcher.ci_column) {
+            fetcher.request(full_path);
+        }
+    }
+
+    /// Whatever the background workers have found out about the project so far
+    fn annotations(&self, full_path: &str) -> Vec<String> {
+        let mut annotations = Vec::new();
+        if let Some(bytes) = self
+            .sizes
+            .as_ref()
+            .and_then(|sizer| sizer.store().read().unwrap().get(full_path).copied())
+        {
+            annotations.push(usage::human(bytes));
+        }
+        if let Some(info) = self
+            .git
+            .as_ref()
+            .and_then(|enricher| enricher.store().read().unwrap().get(full_path).cloned())
+        {
+            annotations.push(info.to_string());
+        }
+        if let Some(glyph) = self
+            .forge
+            .as_ref()
+            .filter(|fetcher| fetcher.ci_column)
+            .and_then(|fetcher| fetcher.get(full_path))
+            .and_then(|info| info.glyph())
+        {
+            annotations.push(format!("CI {}", glyph));
+        }
+        annotations
+    }
+}
+
+/// How many recently modified files the preview lists
+const RECENT_FILES: usize = 5;
+
+/// Entry shown in the picker, annotated with any metadata collected so far
+struct ProjectItem {
+    path: ProjectPath,
+    annotators: Arc<Annotators>,
+    /// whether git status and size have been asked for. This waits until the
+    /// item is first drawn so that huge indexes do not queue work for
+    /// thousands of projects which never scroll into view.
+    requested: AtomicBool,
+}
+
+impl skim::SkimItem for ProjectItem {
     fn text(&self) -> std::borrow::Cow<str> {
-        std::borrow::Cow::Borrowed(&self.full_path)
+        std::borrow::Cow::Borrowed(&self.path.full_path)
+    }
+
+    fn display<'a>(&'a self, context: skim::DisplayContext<'a>) -> skim::AnsiString<'a> {
+        if !self.requested.swap(true, Ordering::Relaxed) {
+            self.annotators.request(&self.path.full_path);
+        }
+        let annotations = self.annotators.annotations(&self.path.full_path);
+        if annotations.is_empty() {
+            context.into()
+        } else {
+            annotate(context, &annotations.join("  "))
+        }
+    }
+
+    fn preview(&self, _context: skim::PreviewContext) -> skim::ItemPreview {
+        let mut text = format!(
+            "{}\nsession: {}\n",
+            self.path.full_path, self.path.session_name
+        );
+        let state = &self.annotators.state;
+        let tags = state.tags(&self.path.full_path);
+        if !tags.is_empty() {
+            text.push_str(&format!("tags: {}\n", tags.join(", ")));
+        }
+        let note = state
+            .note(&self.path.full_path)
+            .or_else(|| self.annotators.notes.get(&self.path.full_path).cloned());
+        if let Some(note) = note {
+            text.push('\n');
+            text.push_str(&note);
+            text.push('\n');
+        }
+        if let Some(fetcher) = &self.annotators.forge {
+            fetcher.request(&self.path.full_path);
+            if let Some(info) = fetcher.get(&self.path.full_path) {
+                text.push_str(&format!(
+                    "\n{} (as of {} ago)\n",
+                    info,
+                    duration::elapsed(usage::now().saturating_sub(info.fetched_at))
+                ));
+            }
+        }
+        if let Some(recent) = &self.annotators.recent {
+            recent.request(&self.path.full_path);
+            let files = recent.get(&self.path.full_path).unwrap_or_default();
+            if !files.is_empty() {
+                text.push_str("\nrecently modified:\n");
+                for (file, age) in files {
+                    text.push_str(&format!("{:>7}  {}\n", duration::elapsed(age), file));
+                }
+            }
+        }
+        skim::ItemPreview::Text(text)
     }
 }
 
+/// Render the item text followed by an annotation, keeping the match highlighting
+fn annotate<'a>(context: skim::DisplayContext<'a>, annotation: &str) -> skim::AnsiString<'a> {
+    let attr = context.highlight_attr;
+    let char_idx = |byte: usize| context.text[..byte].chars().count() as u32;
+    let fragments = match context.matches {
+        skim::Matches::CharIndices(indices) => indices
+            .iter()
+            .map(|&i| (attr, (i as u32, i as u32 + 1)))
+            .collect(),
+        skim::Matches::CharRange(start, end) => vec![(attr, (start as u32, end as u32))],
+        skim::Matches::ByteRange(start, end) => vec![(attr, (char_idx(start), char_idx(end)))],
+        skim::Matches::None => Vec::new(),
+    };
+    skim::AnsiString::new_string(format!("{}  {}", context.text, annotation), fragments)
+}
+
 #[derive(Debug, Clone)]
 struct Cache {
     inner: Arc<RwLock<CacheInner>>,
-    loc: PathBuf,
+    /// where the cache is saved, `None` for one which is never saved
+    loc: Option<PathBuf>,
+    /// projects are appended here as they are found, so a long scan of a
+    /// huge tree is saved as it goes rather than only when the cache is
+    /// written out in full, which empties it
+    journal: Option<Arc<std::sync::Mutex<std::fs::File>>>,
+    /// projects removed since loading, which other processes' journal
+    /// entries must not bring back
+    removed: Arc<std::sync::Mutex<HashSet<String>>>,
 }
 
-#[derive(Debug, Deserialize, Serialize)]
+/// Sorted collections keep the file stable between writes, so that copies
+/// synced between machines diff and merge cleanly
+#[derive(Debug, Default, Clone, Deserialize, Serialize)]
 struct CacheInner {
-    paths: HashSet<ProjectPath>,
+    paths: BTreeSet<ProjectPath>,
+    #[serde(default)]
+    sizes: BTreeMap<String, usage::DiskUsage>,
+    /// when each project was first cached, in seconds since the unix epoch
+    #[serde(default)]
+    added: BTreeMap<String, u64>,
+    /// the branch `origin/HEAD` points at in each repository
+    #[serde(default)]
+    default_branches: BTreeMap<String, String>,
+    /// when each project under a root with `ignore_older_than` last changed:
+    /// its last commit, or failing that its directory's modification time
+    #[serde(default)]
+    last_changed: BTreeMap<String, u64>,
+}
+
+impl CacheInner {
+    /// Add the projects only `other` knows about, keeping the earliest time
+    /// each was added. Sizes are left alone as they differ between machines.
+    fn merge(&mut self, other: CacheInner) {
+        let known: HashSet<String> = self.paths.iter().map(|p| p.full_path.clone()).collect();
+        for project in other.paths {
+            if !known.contains(&project.full_path) {
+                self.paths.insert(project);
+            }
+        }
+        for (full_path, at) in other.added {
+            let added = self.added.entry(full_path).or_insert(at);
+            *added = (*added).min(at);
+        }
+        for (full_path, branch) in other.default_branches {
+            self.default_branches.entry(full_path).or_insert(branch);
+        }
+        for (full_path, at) in other.last_changed {
+            let changed = self.last_changed.entry(full_path).or_insert(at);
+            *changed = (*changed).max(at);
+        }
+    }
+
+    /// Add a project, returning `None` if it was already there as it is
+    fn insert(&mut self, value: ProjectPath, at: u64) -> Option<CacheState> {
+        let full_path = value.full_path.clone();
+        let session_name = value.session_name.clone();
+        if !self.paths.insert(value) {
+            return None;
+        }
+        if self.added.contains_key(&full_path) {
+            // a known project whose session name has changed, e.g. with the
+            // root's template, replaces its old entry
+            self.paths
+                .retain(|p| p.full_path != full_path || p.session_name == session_name);
+            return Some(CacheState::Found);
+        }
+        self.added.insert(full_path, at);
+        Some(CacheState::Missing)
+    }
+
+    /// Add the projects a journal recorded since the cache was last written.
+    /// A line cut short by a crash is skipped.
+    fn replay(&mut self, journal: &std::path::Path) {
+        let txt = match std::fs::read_to_string(journal) {
+            Ok(txt) => txt,
+            Err(_) => return,
+        };
+        for line in txt.lines() {
+            if let Ok((project, at)) = serde_json::from_str::<(ProjectPath, u64)>(line) {
+                self.insert(project, at);
+            }
+        }
+    }
+
+    /// Add the projects other processes have journalled since this cache was
+    /// loaded, leaving alone those it already has or has since removed
+    fn catch_up(&mut self, journal: &std::path::Path, removed: &HashSet<String>) {
+        let mut journalled = CacheInner::default();
+        journalled.replay(journal);
+        let known: HashSet<String> = self.paths.iter().map(|p| p.full_path.clone()).collect();
+        let CacheInner { paths, added, .. } = journalled;
+        for project in paths {
+            if known.contains(&project.full_path) || removed.contains(&project.full_path) {
+                continue;
+            }
+            let at = added
+                .get(&project.full_path)
+                .copied()
+                .unwrap_or_else(usage::now);
+            self.insert(project, at);
+        }
+    }
+
+    /// Rewrite every project path with `f`
+    fn map_paths<F>(self, f: F) -> Self
+    where
+        F: Fn(&str) -> String,
+    {
+        CacheInner {
+            paths: self
+                .paths
+                .into_iter()
+                .map(|p| ProjectPath {
+                    full_path: f(&p.full_path),
+                    session_name: p.session_name,
+                })
+                .collect(),
+            sizes: self.sizes.into_iter().map(|(k, v)| (f(&k), v)).collect(),
+            added: self.added.into_iter().map(|(k, v)| (f(&k), v)).collect(),
+            default_branches: self
+                .default_branches
+                .into_iter()
+                .map(|(k, v)| (f(&k), v))
+                .collect(),
+            last_changed: self
+                .last_changed
+                .into_iter()
+                .map(|(k, v)| (f(&k), v))
+                .collect(),
+        }
+    }
+}
+
+fn cache_file() -> Result<PathBuf> {
+    let cache_dir = dirs::cache_dir()
+        .unwrap_or_else(|| PathBuf::from("~/.cache"))
+        .join("project");
+    std::fs::create_dir_all(&cache_dir).wrap_err("creating cache directory")?;
+    Ok(cache_dir.join("config.json"))
+}
+
+fn journal_file(cache_file: &std::path::Path) -> PathBuf {
+    cache_file.with_file_name("journal.jsonl")
+}
+
+fn open_journal(cache_file: &std::path::Path) -> Result<Arc<std::sync::Mutex<std::fs::File>>> {
+    let path = journal_file(cache_file);
+    let f = std::fs::OpenOptions::new()
+        .create(true)
+        .append(true)
+        .open(&path)
+        .wrap_err_with(|| format!("opening {}", path.display()))?;
+    Ok(Arc::new(std::sync::Mutex::new(f)))
 }
 
 impl Cache {
     fn new(clear: bool) -> Result<Self> {
-        let cache_dir = dirs::cache_dir()
-            .unwrap_or_else(|| PathBuf::from("~/.cache"))
-            .join("project");
-        std::fs::create_dir_all(&cache_dir).wrap_err("creating cache directory")?;
-        let cache_file = cache_dir.join("config.json");
+        let cache_file = cache_file()?;
 
-        match std::fs::read_to_string(&cache_file) {
+        match storage::read(&cache_file) {
             Ok(txt) => {
-                let cache_inner: CacheInner = serde_json::from_str(&txt)?;
+                let mut cache_inner: CacheInner = serde_json::from_str(&txt)?;
+                cache_inner.replay(&journal_file(&cache_file));
                 let cache = Cache {
                     inner: Arc::new(RwLock::new(cache_inner)),
-                    loc: cache_file,
+                    journal: Some(open_journal(&cache_file)?),
+                    loc: Some(cache_file),
+                    removed: Default::default(),
                 };
                 if clear {
                     cache.clear();
@@ -68,12 +849,13 @@ impl Cache {
             }
             Err(e) => match e.kind() {
                 std::io::ErrorKind::NotFound => {
-                    let inner = CacheInner {
-                        paths: HashSet::new(),
-                    };
+                    let mut inner = CacheInner::default();
+                    inner.replay(&journal_file(&cache_file));
                     let cache = Cache {
                         inner: Arc::new(RwLock::new(inner)),
-                        loc: cache_file,
+                        journal: Some(open_journal(&cache_file)?),
+                        loc: Some(cache_file),
+                        removed: Default::default(),
                     };
                     cache.write().wrap_err("writing cache")?;
                     Ok(cache)
@@ -83,31 +865,249 @@ impl Cache {
         }
     }
 
+    /// The saved cache, which is never written back
+    fn read_only() -> Result<Self> {
+        let cache_file = cache_file()?;
+        match storage::read(&cache_file) {
+            Ok(txt) => {
+                let mut inner: CacheInner = serde_json::from_str(&txt)?;
+                inner.replay(&journal_file(&cache_file));
+                Ok(Cache {
+                    inner: Arc::new(RwLock::new(inner)),
+                    loc: None,
+                    journal: None,
+                    removed: Default::default(),
+                })
+            }
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => Ok(Cache::in_memory()),
+            Err(e) => Err(eyre::eyre!("IO error: {:?}", e)),
+        }
+    }
+
+    /// An empty cache which is never saved, leaving the real one untouched
+    fn in_memory() -> Self {
+        Cache {
+            inner: Arc::new(RwLock::new(CacheInner::default())),
+            loc: None,
+            journal: None,
+            removed: Default::default(),
+        }
+    }
+
     fn write(&self) -> Result<()> {
-        let mut f = std::fs::File::create(&self.loc).wrap_err("creating cache file")?;
-        let lock = self.inner.read().unwrap();
-        serde_json::to_writer(&mut f, &*lock).wrap_err("writing cache file")?;
-        Ok(())
+        let loc = match &self.loc {
+            Some(loc) => loc,
+            None => return Ok(()),
+        };
+        let journal = match &self.journal {
+            Some(journal) => journal.lock().unwrap(),
+            None => {
+                let lock = self.inner.read().unwrap();
+                storage::write(loc, &*lock).wrap_err("writing cache file")?;
+                return index::write(loc, &lock).wrap_err("writing cache index");
+            }
+        };
+        // other processes append to the journal too, so between reading it
+        // and emptying it nobody may add to it
+        let _journal_lock = storage::lock_file(&journal)?;
+        let mut lock = self.inner.write().unwrap();
+        lock.catch_up(&journal_file(loc), &self.removed.lock().unwrap());
+        storage::write(loc, &*lock).wrap_err("writing cache file")?;
+        index::write(loc, &lock).wrap_err("writing cache index")?;
+        // everything journalled is in the file now
+        journal.set_len(0).wrap_err("emptying cache journal")
+    }
+
+    fn snapshot(&self) -> CacheInner {
+        self.inner.read().unwrap().clone()
+    }
+
+    fn merge(&self, other: CacheInner) {
+        self.inner.write().unwrap().merge(other);
     }
 
     fn clear(&self) {
         let mut lock = self.inner.write().unwrap();
         lock.paths.clear();
+        lock.sizes.clear();
+        lock.added.clear();
+        lock.default_branches.clear();
+        lock.last_changed.clear();
+        if let Some(journal) = &self.journal {
+            let journal = journal.lock().unwrap();
+            let emptied = storage::lock_file(&journal)
+                .and_then(|_lock| journal.set_len(0).wrap_err("emptying"));
+            if let Err(e) = emptied {
+                log::warn!("emptying cache journal: {:?}", e);
+            }
+        }
     }
 
+    /// The cached projects, sorted by path so output is the same run to run
     fn initial_paths(&self) -> Vec<ProjectPath> {
         let lock = self.inner.read().unwrap();
-        lock.paths.iter().cloned().collect()
+        let mut paths: Vec<_> = lock.paths.iter().cloned().collect();
+        paths.sort_by(|a, b| a.full_path.cmp(&b.full_path));
+        paths
     }
 
-    fn add(&self, value: ProjectPath) -> CacheState {
+    /// The session names cached projects have, and the project with each,
+    /// for [`unique_session_name`]
+    fn session_names(&self) -> HashMap<String, String> {
+        let lock = self.inner.read().unwrap();
+        lock.paths
+            .iter()
+            .map(|p| (p.session_name.clone(), p.full_path.clone()))
+            .collect()
+    }
+
+    /// Find a cached project by its path or session name
+    fn lookup(&self, query: &str) -> Option<ProjectPath> {
+        let expanded = tilde::expand(query).into_owned();
+        let canonical = std::fs::canonicalize(&expanded)
+            .ok()
+            .and_then(|p| p.to_str().map(str::to_string));
+        let lock = self.inner.read().unwrap();
+        lock.paths
+            .iter()
+            .find(|p| {
+                p.full_path == expanded
+                    || Some(&p.full_path) == canonical.as_ref()
+                    || p.session_name == query
+            })
+            .cloned()
+    }
+
+    /// Everything cached about a project, to put back with [`Cache::restore`]
+    fn entry(&self, full_path: &str) -> Option<CacheEntry> {
+        let lock = self.inner.read().unwrap();
+        let project = lock.paths.iter().find(|p| p.full_path == full_path)?;
+        Some(CacheEntry {
+            project: project.clone(),
+            added: lock.added.get(full_path).copied(),
+            size: lock.sizes.get(full_path).copied(),
+            default_branch: lock.default_branches.get(full_path).cloned(),
+            last_changed: lock.last_changed.get(full_path).copied(),
+        })
+    }
+
+    /// Put back a project removed earlier, as it was when it was removed
+    fn restore(&self, entry: CacheEntry) {
+        let full_path = entry.project.full_path.clone();
+        self.removed.lock().unwrap().remove(&full_path);
         let mut lock = self.inner.write().unwrap();
-        let inserted = lock.paths.insert(value);
-        if inserted {
-            CacheState::Missing
-        } else {
-            CacheState::Found
+        let added = entry.added.unwrap_or_else(usage::now);
+        lock.insert(entry.project, added);
+        if let Some(size) = entry.size {
+            lock.sizes.insert(full_path.clone(), size);
+        }
+        if let Some(branch) = entry.default_branch {
+            lock.default_branches.insert(full_path.clone(), branch);
+        }
+        if let Some(changed) = entry.last_changed {
+            lock.last_changed.insert(full_path, changed);
+        }
+    }
+
+    fn remove(&self, full_path: &str) {
+        self.removed.lock().unwrap().insert(full_path.to_string());
+        let mut lock = self.inner.write().unwrap();
+        lock.paths.retain(|p| p.full_path != full_path);
+        lock.sizes.remove(full_path);
+        lock.added.remove(full_path);
+        lock.default_branches.remove(full_path);
+        lock.last_changed.remove(full_path);
+    }
+
+    /// When the project last changed, if a scan has looked
+    fn last_changed(&self, full_path: &str) -> Option<u64> {
+        self.inner
+            .read()
+            .unwrap()
+            .last_changed
+            .get(full_path)
+            .copied()
+    }
+
+    /// Look up when the project last changed, for `ignore_older_than`
+    fn update_last_changed(&self, full_path: &str) {
+        let path = std::path::Path::new(full_path);
+        let changed = git::last_commit_time(path).or_else(|| {
+            let modified = std::fs::metadata(path).and_then(|m| m.modified()).ok()?;
+            modified
+                .duration_since(std::time::UNIX_EPOCH)
+                .ok()
+                .map(|d| d.as_secs())
+        });
+        if let Some(changed) = changed {
+            let mut lock = self.inner.write().unwrap();
+            lock.last_changed.insert(full_path.to_string(), changed);
+        }
+    }
+
+    /// The project's default branch, asking git the first time it is wanted
+    /// rather than for every project a scan finds
+    fn default_branch(&self, full_path: &str) -> Option<String> {
+        if let Some(branch) = self.inner.read().unwrap().default_branches.get(full_path) {
+            return Some(branch.clone());
+        }
+        let branch = git::default_branch(std::path::Path::new(full_path))?;
+        let mut lock = self.inner.write().unwrap();
+        lock.default_branches
+            .insert(full_path.to_string(), branch.clone());
+        Some(branch)
+    }
+
+    /// When the project was first cached, if that was recorded
+    fn added(&self, full_path: &str) -> Option<u64> {
+        self.inner.read().unwrap().added.get(full_path).copied()
+    }
+
+    /// The last size worked out for the project, however old
+    fn cached_size(&self, full_path: &str) -> Option<u64> {
+        let lock = self.inner.read().unwrap();
+        lock.sizes.get(full_path).map(|usage| usage.bytes)
+    }
+
+    /// Size of a project on disk, walking it only if the cached size is stale
+    fn disk_usage(&self, full_path: &str) -> u64 {
+        if let Some(usage) = self.inner.read().unwrap().sizes.get(full_path) {
+            if usage.is_fresh() {
+                return usage.bytes;
+            }
         }
+        let bytes = usage::dir_size(std::path::Path::new(full_path));
+        let mut lock = self.inner.write().unwrap();
+        lock.sizes
+            .insert(full_path.to_string(), usage::DiskUsage::new(bytes));
+        bytes
+    }
+
+    fn add(&self, value: ProjectPath) -> CacheState {
+        // rescans come across the same projects time and again
+        if self.inner.read().unwrap().paths.contains(&value) {
+            return CacheState::Found;
+        }
+        let at = usage::now();
+        let line = self
+            .journal
+            .as_ref()
+            .and_then(|_| serde_json::to_string(&(&value, at)).ok());
+        let state = match self.inner.write().unwrap().insert(value, at) {
+            Some(state) => state,
+            None => return CacheState::Found,
+        };
+        if let (Some(journal), Some(line)) = (&self.journal, line) {
+            let f = journal.lock().unwrap();
+            let appended = storage::lock_file(&f).and_then(|_lock| {
+                std::io::Write::write_all(&mut &*f, format!("{}\n", line).as_bytes())
+                    .wrap_err("writing")
+            });
+            if let Err(e) = appended {
+                log::warn!("appending to cache journal: {:?}", e);
+            }
+        }
+        state
     }
 }
 
@@ -116,6 +1116,22 @@ enum CacheState {
     Found,
 }
 
+/// Everything the cache knows about one project, so that undoing its removal
+/// puts it back as it was rather than as newly found
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+struct CacheEntry {
+    #[serde(flatten)]
+    project: ProjectPath,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    added: Option<u64>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    size: Option<usage::DiskUsage>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    default_branch: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    last_changed: Option<u64>,
+}
+
 impl Drop for Cache {
     fn drop(&mut self) {
         if let Err(e) = self.write() {
@@ -125,107 +1141,716 @@ impl Drop for Cache {
 }
 
 // config types
-#[derive(Debug, Serialize, Deserialize)]
+#[derive(Debug, Default, Serialize, Deserialize)]
 struct Config {
     root_dirs: Vec<RootDir>,
+    /// directories always listed, without scanning, alongside those found
+    /// under the roots
+    #[serde(default)]
+    projects: Vec<ProjectConfig>,
+    #[serde(default)]
+    git_info: git::GitInfoConfig,
+    /// how `project mirror` and `project sync-manifest` clone
+    #[serde(default)]
+    clone: bulk::CloneConfig,
+    #[serde(default)]
+    templates: Vec<scaffold::Template>,
+    archive: Option<archive::ArchiveConfig>,
+    /// show the size of each project in the picker
+    #[serde(default)]
+    disk_usage_column: bool,
+    /// show the preview pane even when no project has a note
+    #[serde(default)]
+    preview: bool,
+    /// always start the picker in console mode, see `--console`
+    #[serde(default)]
+    console: bool,
+    /// show the picker as groups of projects, see `--group-by`
+    group_by: Option<group::GroupBy>,
+    /// after choosing a project, choose what to do with it from a menu
+    /// rather than switching to it; alt-a does this for a single pick
+    #[serde(default)]
+    action_menu: bool,
+    /// descriptions of projects keyed by path
+    #[serde(default)]
+    notes: HashMap<String, String>,
+    /// extra arguments for tmux new-session, e.g. ["-x", "250", "-y", "50"]
+    #[serde(default)]
+    new_session_args: Vec<String>,
+    /// commands to open projects with instead of a tmux session, keyed by
+    /// path, e.g. "code ."; "tmux" means the usual session and "dev-pod" one
+    /// whose shells run in the pod in [dev_pod]
+    #[serde(default)]
+    openers: HashMap<String, String>,
+    /// shells for projects' sessions keyed by path, taking the place of a
+    /// root's shell, e.g. "fish" or "bash --login"
+    #[serde(default)]
+    shells: HashMap<String, String>,
+    /// how long a session may be idle before `project sessions prune` kills it
+    prune_idle_after: Option<duration::HumanDuration>,
+    /// session names or project paths whose sessions are never killed by
+    /// `project sessions prune`, `project archive` or the console
+    #[serde(default)]
+    protected: Vec<String>,
+    /// globs for directories to leave out of scans, merged with `project ignore`
+    #[serde(default)]
+    exclude: Vec<String>,
+    /// tell a Neovim in the project's session about the switch
+    nvim: Option<nvim::NvimConfig>,
+    /// gaps in session activity longer than this do not count towards time spent
+    afk_after: Option<duration::HumanDuration>,
+    /// API tokens for remote sources keyed by host, e.g. "github.com"
+    #[serde(default)]
+    tokens: std::collections::BTreeMap<String, secret::Secret>,
+    #[serde(default)]
+    daemon: daemon::DaemonConfig,
+    /// environment variables for each project's tmux session and opener,
+    /// templates with the project's fields
+    #[serde(default)]
+    env: BTreeMap<String, String>,
+    /// variables whose values are hidden in --dry-run output and logs, by
+    /// parts of their names, defaulting to TOKEN, SECRET, KEY and PASSWORD
+    redact: Option<Vec<String>>,
+    /// start and end events for each switch, for time tracking
+    tracking: Option<tracking::TrackingConfig>,
+    /// most projects the picker and `--plain` show before anything is typed
+    max_results: Option<usize>,
+    /// also look for projects directly inside each CDPATH entry
+    #[serde(default)]
+    cdpath_roots: bool,
+    /// what to do when the project's session is already running
+    #[serde(default)]
+    on_existing: tmux::OnExisting,
+    /// with several tmux clients attached, switch the one this was run from
+    /// rather than the most recently active
+    #[serde(default)]
+    switch_invoking_client: bool,
+    /// open pull requests, issues and CI status in the preview and optionally
+    /// a column, for remotes on hosts with a token
+    forge: Option<forge::ForgeConfig>,
+    /// where `project sync` shares the state and cache with other machines
+    sync: Option<sync::SyncConfig>,
+    /// the Kubernetes pod the "dev-pod" opener runs shells in
+    dev_pod: Option<k8s::DevPodConfig>,
+    /// compress the cache and state files, "gzip" or "zstd", for large
+    /// caches or home directories on the network
+    #[serde(default)]
+    compression: storage::Compression,
 }
 
 fn expand_path<'de, D>(deserializer: D) -> std::result::Result<PathBuf, D::Error>
 where
     D: serde::Deserializer<'de>,
 {
-    let s: &str = serde::Deserialize::deserialize(deserializer)?;
-    let transformed = shellexpand::tilde(s);
-    match transformed {
-        Cow::Borrowed(s) => Ok(PathBuf::from(s)),
-        Cow::Owned(s) => Ok(PathBuf::from(s)),
+    let s: String = serde::Deserialize::deserialize(deserializer)?;
+    normalize_path(&s).map_err(serde::de::Error::custom)
+}
+
+/// Expand `~` and environment variables in a configured path and tidy it up
+/// lexically, so that "~/work/", "$HOME/work" and "~/work/./" are the same
+/// root and session names never start with a slash. Windows paths such as
+/// "C:\\Users\\me\\src" become the drive's WSL mount.
+fn normalize_path(path: &str) -> std::result::Result<PathBuf, String> {
+    let expanded = shellexpand::env(path).map_err(|e| e.to_string())?;
+    let expanded = match wsl::from_windows(&expanded) {
+        Some(translated) => std::borrow::Cow::Owned(translated),
+        None => tilde::expand(&expanded),
+    };
+    let mut normalized = PathBuf::new();
+    for component in std::path::Path::new(expanded.as_ref()).components() {
+        match (component, normalized.components().next_back()) {
+            (Component::CurDir, _) => {}
+            (Component::ParentDir, Some(Component::Normal(_))) => {
+                normalized.pop();
+            }
+            (Component::ParentDir, Some(Component::RootDir)) => {}
+            (component, _) => normalized.push(component),
+        }
     }
+    Ok(normalized)
 }
 
-#[derive(Debug, Serialize, Deserialize)]
-struct RootDir {
+/// `path` with symlinks resolved, or as it is when it does not exist (yet) or
+/// is on a remote root
+fn canonical_path(path: &std::path::Path) -> PathBuf {
+    std::fs::canonicalize(path).unwrap_or_else(|_| path.to_path_buf())
+}
+
+/// A configured path key, such as those of `openers`, expanded and with
+/// symlinks resolved. Keys which are not absolute paths, such as session
+/// names in `protected`, are left as they are.
+fn canonical_key(key: &str) -> String {
+    let expanded = tilde::expand(key);
+    let trimmed = match expanded.trim_end_matches('/') {
+        "" => "/",
+        trimmed => trimmed,
+    };
+    if !std::path::Path::new(trimmed).is_absolute() {
+        return key.to_string();
+    }
+    canonical_path(std::path::Path::new(trimmed))
+        .to_string_lossy()
+        .into_owned()
+}
+
+/// `s` quoted as a TOML string or key, for config snippets shown to the user
+/// or written for them
+fn toml_string(s: &str) -> String {
+    toml::Value::String(s.to_string()).to_string()
+}
+
+/// A directory to offer in the picker without it being a repository or under
+/// a root, such as "~/.config", a network share or a one-off checkout
+#[derive(Debug, PartialEq, Serialize, Deserialize)]
+struct ProjectConfig {
     #[serde(deserialize_with = "expand_path")]
     path: PathBuf,
-    prefix: Option<String>,
+    /// session name, the directory's name by default
+    name: Option<String>,
 }
 
-impl Config {
-    fn open(config_path: PathBuf) -> Result<Self> {
-        let config_txt = std::fs::read_to_string(&config_path).wrap_err("reading config file")?;
-        let config: Config = toml::from_str(&config_txt).wrap_err("parsing config file")?;
-        Ok(config)
+impl ProjectConfig {
+    fn project_path(&self) -> ProjectPath {
+        let full_path = self.path.to_string_lossy().into_owned();
+        let name = match &self.name {
+            Some(name) => name.clone(),
+            None => self
+                .path
+                .file_name()
+                .map(|n| n.to_string_lossy().into_owned())
+                .unwrap_or_else(|| full_path.clone()),
+        };
+        ProjectPath {
+            full_path,
+            session_name: tmux::session_name(&name),
+        }
     }
 }
 
-struct Tmux<'a> {
-    path: &'a ProjectPath,
-    client: TmuxCommand<'a>,
+#[derive(Debug, Default, PartialEq, Serialize, Deserialize)]
+struct RootDir {
+    #[serde(deserialize_with = "expand_path")]
+    path: PathBuf,
+    prefix: Option<String>,
+    /// put between the prefix and the rest of the name, e.g. "/" or "-"
+    separator: Option<String>,
+    /// projects under heavier roots rank first when their match is otherwise equal
+    #[serde(default)]
+    weight: i64,
+    /// template for session names, e.g. "{{.Prefix}}{{.Base}}" or "{{.Parent}}/{{.Base}}"
+    session_name: Option<String>,
+    /// name sessions after the final path component only, see [`unique_session_name`]
+    #[serde(default)]
+    short_session_names: bool,
+    /// extra arguments for tmux new-session, after the global ones
+    #[serde(default)]
+    new_session_args: Vec<String>,
+    /// shell for the sessions of projects under this root, such as "fish",
+    /// instead of tmux's default-command
+    shell: Option<String>,
+    /// how many levels below the root to look for projects, unlimited if unset
+    max_depth: Option<usize>,
+    /// leave out projects with no commits or changes for this long, and not
+    /// opened for as long either, unless --all is given
+    ignore_older_than: Option<duration::HumanDuration>,
+}
+
+/// Shallow roots for the directories in a CDPATH value, leaving out the
+/// current directory entries which would make projects depend on where the
+/// picker is started
+fn cdpath_roots(cdpath: &str) -> Vec<RootDir> {
+    cdpath
+        .split(':')
+        .map(|entry| tilde::expand(entry.trim_end_matches('/')).into_owned())
+        .map(PathBuf::from)
+        .filter(|path| path.is_absolute())
+        .map(|path| RootDir {
+            path,
+            max_depth: Some(1),
+            ..Default::default()
+        })
+        .collect()
 }
 
-impl<'a> Tmux<'a> {
-    fn new(item: &'a ProjectPath) -> Self {
-        let client = TmuxCommand::new();
-        Self { path: item, client }
+/// Session name template for roots which do not configure their own
+const DEFAULT_SESSION_NAME: &str = "{{.Prefix}}{{.Relative}}";
+const SHORT_SESSION_NAME: &str = "{{.Prefix}}{{.Base}}";
+
+impl RootDir {
+    /// Whether the root is on another machine or in a container, reached
+    /// through ssh or docker
+    fn is_remote(&self) -> bool {
+        remote::parse(&self.path.to_string_lossy()).is_some()
     }
 
-    fn create(&self) -> Result<()> {
-        if self.is_running() {
-            if !self.session_exists()? {
-                self.create_session().wrap_err("creating session")?;
+    /// The prefix with its separator, or nothing when there is no prefix
+    fn prefix(&self) -> String {
+        match &self.prefix {
+            Some(prefix) if !prefix.is_empty() => {
+                format!("{}{}", prefix, self.separator.as_deref().unwrap_or(""))
             }
-            self.switch_client().wrap_err("switching client")?;
-        } else if self.session_exists()? {
-            self.join().wrap_err("joining session")?;
-        } else {
-            self.create_session().wrap_err("creating session")?;
-            self.join().wrap_err("joining session")?;
+            _ => String::new(),
         }
+    }
+
+    /// Name of the tmux session for a project beneath this root
+    fn session_name_for(&self, full_path_str: &str) -> String {
+        let relative = compute_session_name(full_path_str, &self.path.to_string_lossy());
+        let path = std::path::Path::new(full_path_str);
+        let file_name = |p: Option<&std::path::Path>| {
+            p.and_then(|p| p.file_name())
+                .map(|name| name.to_string_lossy().into_owned())
+                .unwrap_or_default()
+        };
 
-        Ok(())
+        let template = match (&self.session_name, self.short_session_names) {
+            (Some(template), _) => template.as_str(),
+            (None, true) => SHORT_SESSION_NAME,
+            (None, false) => DEFAULT_SESSION_NAME,
+        };
+        let rendered = template::render(template, |field| match field {
+            "Prefix" => Some(self.prefix()),
+            "Relative" => Some(relative.clone()),
+            "Base" => Some(file_name(Some(path))),
+            "Parent" => Some(file_name(path.parent())),
+            "Root" => Some(self.path.to_string_lossy().into_owned()),
+            _ => None,
+        });
+        let name = match rendered {
+            // the root itself is a repository
+            Ok(name) if name.is_empty() => file_name(Some(path)),
+            Ok(name) => name,
+            Err(e) => {
+                log::warn!("rendering session name for {}: {:?}", full_path_str, e);
+                relative
+            }
+        };
+        tmux::session_name(&name)
     }
+}
 
-    fn join(&self) -> Result<()> {
-        self.client
-            .attach_session()
-            .target_session(&self.path.session_name)
-            .output()?;
-        Ok(())
+impl Config {
+    fn open(config_path: PathBuf) -> Result<Self> {
+        let config_txt = std::fs::read_to_string(&config_path).wrap_err("reading config file")?;
+        let mut config: Config = toml::from_str(&config_txt).wrap_err("parsing config file")?;
+        config
+            .check(&config_txt)
+            .wrap_err_with(|| format!("checking {}", config_path.display()))?;
+        // overlaps are handled when scanning, but are usually a mistake
+        for (outer, inner) in config.overlapping_roots() {
+            if outer.path == inner.path {
+                eprintln!(
+                    "warning: root {} is listed more than once, only the first is used",
+                    outer.path.display()
+                );
+            } else {
+                eprintln!(
+                    "warning: root {} is inside root {}, its projects are indexed under the inner root only",
+                    inner.path.display(),
+                    outer.path.display()
+                );
+            }
+        }
+        if config.cdpath_roots {
+            let cdpath = std::env::var("CDPATH").unwrap_or_default();
+            for dir in cdpath_roots(&cdpath) {
+                if !config.root_dirs.iter().any(|d| d.path == dir.path) {
+                    config.root_dirs.push(dir);
+                }
+            }
+        }
+        config.canonicalize();
+        Ok(config)
     }
 
-    fn create_session(&self) -> Result<()> {
-        self.client
-            .new_session()
-            .detached()
-            .start_directory(&self.path.full_path)
-            .session_name(&self.path.session_name)
-            .output()?;
-        Ok(())
+    /// Resolve symlinks in configured roots and path keys, as scans do for
+    /// the projects they find, so that a root on a symlinked mount still
+    /// holds its projects and path keys still match them
+    fn canonicalize(&mut self) {
+        for dir in &mut self.root_dirs {
+            dir.path = canonical_path(&dir.path);
+        }
+        if let Some(archive) = &mut self.archive {
+            archive.root = canonical_path(&archive.root);
+        }
+        for keyed in [&mut self.openers, &mut self.shells, &mut self.notes] {
+            *keyed = keyed
+                .drain()
+                .map(|(path, value)| (canonical_key(&path), value))
+                .collect();
+        }
+        for entry in &mut self.protected {
+            *entry = canonical_key(entry);
+        }
+        if let Some(dev_pod) = &mut self.dev_pod {
+            dev_pod.canonicalize();
+        }
     }
 
-    fn session_exists(&self) -> Result<bool> {
-        let res = self
-            .client
-            .has_session()
-            .target_session(&self.path.session_name)
-            .output()
-            .wrap_err("checking if session exists")?;
-        Ok(res.status().success())
+    /// Parse every template now, rather than failing when a project is
+    /// opened, reporting each problem with the line it is on
+    fn check(&self, config_txt: &str) -> Result<()> {
+        let (templates, _) = self.templates_and_commands();
+        let problems = templates
+            .into_iter()
+            .filter_map(|(t, fields)| Some((t, template::check(t, fields).err()?)));
+        report_problems(config_txt, problems)
     }
 
-    fn is_running(&self) -> bool {
-        std::env::var("TMUX").is_ok()
+    /// Check the syntax of every shell command with `sh -n`. This starts a
+    /// shell for each, so it is left to `project check` rather than done on
+    /// every load.
+    fn check_commands(&self, config_txt: &str) -> Result<()> {
+        let (_, commands) = self.templates_and_commands();
+        let problems = commands
+            .into_iter()
+            .filter_map(|c| Some((c, template::check_command(c).err()?)));
+        report_problems(config_txt, problems)
     }
 
-    fn switch_client(&self) -> Result<()> {
-        self.client
-            .switch_client()
-            .target_session(&self.path.session_name)
-            .output()?;
-        Ok(())
+    /// Every template in the config with the fields it may use, and every
+    /// shell command
+    fn templates_and_commands(&self) -> (Vec<(&str, &[&str])>, Vec<&str>) {
+        let mut templates: Vec<(&str, &[&str])> = Vec::new();
+        let mut commands: Vec<&str> = Vec::new();
+        for dir in &self.root_dirs {
+            if let Some(session_name) = &dir.session_name {
+                templates.push((session_name, template::SESSION_NAME_FIELDS));
+            }
+            commands.extend(dir.shell.as_deref());
+        }
+        commands.extend(self.shells.values().map(String::as_str));
+        for opener in self
+            .openers
+            .values()
+            .filter(|o| *o != "tmux" && *o != k8s::OPENER)
+        {
+            templates.push((opener, template::PROJECT_FIELDS));
+            commands.push(opener);
+        }
+        for value in self.env.values() {
+            templates.push((value, template::PROJECT_FIELDS));
+        }
+        if let Some(nvim) = &self.nvim {
+            for t in nvim.templates() {
+                templates.push((t, template::PROJECT_FIELDS));
+            }
+        }
+        if let Some(command) = self.tracking.as_ref().and_then(|t| t.command()) {
+            templates.push((command, template::PROJECT_FIELDS));
+            commands.push(command);
+        }
+        for t in &self.templates {
+            commands.extend(t.init().iter().map(String::as_str));
+        }
+        (templates, commands)
     }
-}
 
-fn compute_session_name(full_path_str: &str, dir_path_str: &str) -> String {
+    /// Notes from the config file keyed by expanded path
+    fn project_notes(&self) -> HashMap<String, String> {
+        self.notes
+            .iter()
+            .map(|(path, note)| {
+                let path = tilde::expand(path.trim_end_matches('/')).into_owned();
+                (path, note.clone())
+            })
+            .collect()
+    }
+
+    /// The opener configured for the project at `full_path`
+    fn opener_for(&self, full_path: &str) -> Option<&String> {
+        self.openers.iter().find_map(|(path, opener)| {
+            let path = tilde::expand(path.trim_end_matches('/'));
+            (path == full_path).then_some(opener)
+        })
+    }
+
+    /// Whether the project's session is one to leave alone
+    fn is_protected(&self, project: &ProjectPath) -> bool {
+        self.protected.iter().any(|entry| {
+            entry == &project.session_name
+                || tilde::expand(entry.trim_end_matches('/')) == project.full_path
+        })
+    }
+
+    /// The shell for the project's session, if it is not tmux's default
+    fn shell_for(&self, full_path: &str) -> Option<&String> {
+        self.shells
+            .iter()
+            .find_map(|(path, shell)| {
+                let path = tilde::expand(path.trim_end_matches('/'));
+                (path == full_path).then_some(shell)
+            })
+            .or_else(|| self.root_for(full_path)?.shell.as_ref())
+    }
+
+    /// The command new windows of the project's session run: its configured
+    /// shell, started on the far side for projects under remote roots
+    fn session_shell(&self, full_path: &str) -> Option<String> {
+        let shell = self.shell_for(full_path);
+        match remote::parse(full_path) {
+            Some(location) => Some(location.shell(shell.map(String::as_str))),
+            None => shell.cloned(),
+        }
+    }
+
+    /// The most specific root directory containing `full_path`
+    fn root_for(&self, full_path: &str) -> Option<&RootDir> {
+        self.root_dirs
+            .iter()
+            .filter(|dir| std::path::Path::new(full_path).starts_with(&dir.path))
+            .max_by_key(|dir| dir.path.components().count())
+    }
+
+    /// Roots strictly inside `dir`
+    fn nested_roots(&self, dir: &RootDir) -> Vec<PathBuf> {
+        self.root_dirs
+            .iter()
+            .filter(|other| other.path != dir.path && other.path.starts_with(&dir.path))
+            .map(|other| other.path.clone())
+            .collect()
+    }
+
+    /// Pairs of roots where the second is the same as or inside the first
+    fn overlapping_roots(&self) -> Vec<(&RootDir, &RootDir)> {
+        let mut overlaps = Vec::new();
+        for (i, outer) in self.root_dirs.iter().enumerate() {
+            if self.root_dirs[..i].iter().any(|d| d.path == outer.path) {
+                continue;
+            }
+            for (j, inner) in self.root_dirs.iter().enumerate() {
+                let duplicate = outer.path == inner.path && i < j;
+                if duplicate || (outer.path != inner.path && inner.path.starts_with(&outer.path)) {
+                    overlaps.push((outer, inner));
+                }
+            }
+        }
+        overlaps
+    }
+
+    fn weight_of(&self, full_path: &str) -> i64 {
+        self.root_for(full_path).map(|dir| dir.weight).unwrap_or(0)
+    }
+
+    /// Root directories in the order their projects should be offered
+    fn roots_by_weight(&self) -> Vec<&RootDir> {
+        let mut roots: Vec<_> = self.root_dirs.iter().collect();
+        roots.sort_by_key(|dir| std::cmp::Reverse(dir.weight));
+        roots
+    }
+
+    /// Find a project by path or session name, falling back to any existing
+    /// directory so that projects which have not been scanned yet still work
+    fn resolve(&self, cache: &Cache, query: &str) -> Result<ProjectPath> {
+        if let Some(project) = cache.lookup(query) {
+            return Ok(project);
+        }
+        let expanded = tilde::expand(query).into_owned();
+        // there is nothing here to check a remote path against
+        let full_path = match remote::parse(&expanded) {
+            Some(_) => expanded,
+            None => std::fs::canonicalize(&expanded)
+                .wrap_err_with(|| format!("no project matching {:?}", query))?
+                .to_string_lossy()
+                .into_owned(),
+        };
+        let session_name = match self.root_for(&full_path) {
+            Some(dir) => dir.session_name_for(&full_path),
+            None => std::path::Path::new(&full_path)
+                .file_name()
+                .map(|name| name.to_string_lossy().into_owned())
+                .unwrap_or_else(|| full_path.clone()),
+        };
+        let mut project = ProjectPath {
+            full_path,
+            session_name,
+        };
+        // short names especially are shared, so it is suffixed as a scan would
+        unique_session_name(&mut cache.session_names(), &mut project);
+        Ok(project)
+    }
+
+    /// Arguments appended to new-session: global, then per root, then any
+    /// given on the command line
+    fn new_session_args(&self, project: &ProjectPath, extra: &[String]) -> Vec<String> {
+        let mut args = self.new_session_args.clone();
+        if let Some(dir) = self.root_for(&project.full_path) {
+            args.extend(dir.new_session_args.iter().cloned());
+        }
+        for (key, value) in self.env_for(project) {
+            args.push("-e".to_string());
+            args.push(format!("{}={}", key, value));
+        }
+        args.extend(extra.iter().cloned());
+        args
+    }
+
+    /// The template fields for `project`
+    fn vars<'a>(&self, project: &'a ProjectPath) -> template::Vars<'a> {
+        let root = self
+            .root_for(&project.full_path)
+            .map(|dir| dir.path.to_string_lossy().into_owned());
+        template::Vars::new(project, root)
+    }
+
+    /// The `env` values rendered for `project`, leaving out any which fail
+    fn env_for(&self, project: &ProjectPath) -> Vec<(String, String)> {
+        let vars = self.vars(project);
+        self.env
+            .iter()
+            .filter_map(|(key, value)| match vars.render(value) {
+                Ok(value) => Some((key.clone(), value)),
+                Err(e) => {
+                    log::warn!("rendering {}: {:?}", key, e);
+                    None
+                }
+            })
+            .collect()
+    }
+
+    /// The config file's exclusions together with those from `project ignore`
+    fn excludes(&self, state: &state::State) -> exclude::Excludes {
+        exclude::Excludes::new(self.exclude.iter().cloned().chain(state.ignored()))
+    }
+
+    /// The exclusions to scan with, none at all with --all
+    fn scan_excludes(&self, state: &state::State, all: bool) -> exclude::Excludes {
+        if all {
+            exclude::Excludes::new(std::iter::empty::<&str>())
+        } else {
+            self.excludes(state)
+        }
+    }
+
+    /// Whether the project has been left alone for longer than its root's
+    /// `ignore_older_than`. Projects not yet looked at by a scan count as
+    /// active.
+    fn is_dormant(&self, cache: &Cache, state: &state::State, full_path: &str) -> bool {
+        let limit = match self.root_for(full_path).and_then(|d| d.ignore_older_than) {
+            Some(limit) => limit.0.as_secs(),
+            None => return false,
+        };
+        let changed = match cache.last_changed(full_path) {
+            Some(changed) => changed.max(state.last_used(full_path)),
+            None => return false,
+        };
+        usage::now().saturating_sub(changed) > limit
+    }
+
+    /// Whether a path lives in the archive root and so should stay out of the picker
+    fn is_archived(&self, full_path: &str) -> bool {
+        self.archive
+            .as_ref()
+            .map(|archive| std::path::Path::new(full_path).starts_with(&archive.root))
+            .unwrap_or(false)
+    }
+}
+
+/// Describe a problem with a config value, with the line it is on if it is
+/// written there as is
+/// Fail with every problem found in the config, each with the line it is on
+fn report_problems<'a>(
+    config_txt: &str,
+    problems: impl Iterator<Item = (&'a str, eyre::Report)>,
+) -> Result<()> {
+    let problems: Vec<String> = problems
+        .map(|(value, problem)| locate(config_txt, value, &problem))
+        .collect();
+    if !problems.is_empty() {
+        eyre::bail!("{}", problems.join("\n"));
+    }
+    Ok(())
+}
+
+fn locate(config_txt: &str, value: &str, problem: &eyre::Report) -> String {
+    match config_txt
+        .lines()
+        .enumerate()
+        .find(|(_, line)| line.contains(value))
+    {
+        Some((i, line)) => format!("line {}: {}\n    {}", i + 1, problem, line.trim()),
+        None => problem.to_string(),
+    }
+}
+
+/// Make sure no two projects share a session name by suffixing later
+/// arrivals with "-2", "-3" and so on. `names` maps session names to the
+/// project using them; seeding it from the cache keeps names stable between runs.
+fn unique_session_name(names: &mut HashMap<String, String>, project: &mut ProjectPath) {
+    let base = project.session_name.clone();
+    let mut n = 1;
+    loop {
+        match names.get(&project.session_name) {
+            Some(owner) if owner != &project.full_path => {
+                n += 1;
+                project.session_name = format!("{}-{}", base, n);
+            }
+            Some(_) => return,
+            None => {
+                names.insert(project.session_name.clone(), project.full_path.clone());
+                return;
+            }
+        }
+    }
+}
+
+/// Walk `dir` and yield every git repository found beneath it, not descending
+/// into the `nested` roots which are scanned in their own right. Remote roots
+/// are searched over ssh or docker, or not at all when `offline`.
+fn discover_projects(
+    dir: &RootDir,
+    nested: Vec<PathBuf>,
+    offline: bool,
+) -> Box<dyn Iterator<Item = ProjectPath> + Send + '_> {
+    if let Some(location) = remote::parse(&dir.path.to_string_lossy()) {
+        // what the last scan found stays in the cache until the next one
+        if offline {
+            log::debug!("not scanning {} while offline", dir.path.display());
+            return Box::new(std::iter::empty());
+        }
+        let projects = location
+            .discover(dir.max_depth)
+            .filter(move |full_path| {
+                !nested
+                    .iter()
+                    .any(|n| std::path::Path::new(full_path).starts_with(n))
+            })
+            .map(move |full_path| ProjectPath {
+                session_name: dir.session_name_for(&full_path),
+                full_path,
+            });
+        return Box::new(projects);
+    }
+    let walker = ignore::WalkBuilder::new(dir.path.clone())
+        .max_depth(dir.max_depth)
+        .filter_entry(move |e| !nested.iter().any(|n| n == e.path()))
+        .build();
+    let projects = walker
+        .into_iter()
+        .filter_map(|e| e.ok())
+        .filter(|e| e.path().is_dir())
+        .filter(|e| e.path().join(".git").is_dir())
+        .filter_map(move |result| {
+            let path = result.into_path();
+            // names are kept as strings, which cannot hold other encodings
+            let full_path_str = match path.to_str() {
+                Some(s) => s.to_string(),
+                None => {
+                    log::warn!("skipping {}, its path is not UTF-8", path.display());
+                    return None;
+                }
+            };
+            let session_name = dir.session_name_for(&full_path_str);
+
+            Some(ProjectPath {
+                full_path: full_path_str,
+                session_name,
+            })
+        });
+    Box::new(projects)
+}
+
+fn compute_session_name(full_path_str: &str, dir_path_str: &str) -> String {
     let dir_removed = full_path_str
         .strip_prefix(dir_path_str)
         .unwrap_or(full_path_str);
@@ -258,7 +1883,9 @@ impl SkimOptionsFromEnv for SkimOptions<'_> {
 
         skim::SkimOptions {
             color: colour,
-            tiebreak: Some("begin".to_string()),
+            // items are sent heaviest root first, so the index breaks the
+            // remaining ties in favour of the root weights
+            tiebreak: Some("begin,index".to_string()),
             no_mouse: true,
             tabstop: Some("4"),
             inline_info: true,
@@ -267,70 +1894,850 @@ impl SkimOptionsFromEnv for SkimOptions<'_> {
     }
 }
 
-fn main() -> Result<()> {
+/// Exit status when what was asked for was already there: the directory for
+/// `new`, or the session when there was no client to switch
+const EXISTS_STATUS: u8 = 3;
+
+static EXISTED: AtomicBool = AtomicBool::new(false);
+
+/// Exit with [`EXISTS_STATUS`] once everything has been saved
+fn existed() {
+    EXISTED.store(true, Ordering::Relaxed);
+}
+
+fn main() -> Result<std::process::ExitCode> {
+    run()?;
+    Ok(if EXISTED.load(Ordering::Relaxed) {
+        std::process::ExitCode::from(EXISTS_STATUS)
+    } else {
+        std::process::ExitCode::SUCCESS
+    })
+}
+
+fn run() -> Result<()> {
     color_eyre::install().unwrap();
 
-    let args = Args::parse();
+    let mut args = Args::parse();
+    if args.verbose {
+        env_logger::Builder::new()
+            .filter_level(log::LevelFilter::Debug)
+            .init();
+    } else if std::env::var_os("RUST_LOG").is_some() {
+        env_logger::init();
+    }
 
-    let config_path = args.config.unwrap_or_else(|| {
+    // these run from shell prompts and status lines, and need nothing that
+    // parsing and checking the config would give them
+    match args.command.take() {
+        Some(Command::List { format, watch }) => {
+            return if watch {
+                list::watch(format).wrap_err("watching projects")
+            } else {
+                let cache = Cache::read_only().wrap_err("loading cache")?;
+                list::run(&cache, format).wrap_err("listing projects")
+            };
+        }
+        Some(Command::Prompt { path, starship }) => {
+            return prompt::run(path, starship).wrap_err("finding project");
+        }
+        Some(Command::Statusline { session }) => {
+            return statusline::run(session).wrap_err("summarising projects");
+        }
+        command => args.command = command,
+    }
+
+    let config_path = args.config.take().unwrap_or_else(|| {
         dirs::config_dir()
             .unwrap_or_else(|| PathBuf::from("~/.config"))
             .join("project")
             .join("config.toml")
     });
 
-    let cfg = Config::open(config_path).wrap_err("opening config")?;
+    let cfg = match Config::open(config_path.clone()) {
+        // discover is how a first config file gets written, but a config
+        // which is there and broken is still an error
+        Err(e)
+            if matches!(args.command, Some(Command::Discover { .. })) && !config_path.exists() =>
+        {
+            log::debug!("no usable config: {:?}", e);
+            Config::default()
+        }
+        Err(_) if !config_path.exists() => bootstrap::offer(&config_path)?,
+        res => res.wrap_err("opening config")?,
+    };
+    if let Some(patterns) = &cfg.redact {
+        redact::init(patterns.clone());
+    }
+    storage::init(cfg.compression);
 
-    let cache = Cache::new(args.clear).wrap_err("creating cache")?;
-    let (tx, rx): (skim::SkimItemSender, skim::SkimItemReceiver) = crossbeam_channel::unbounded();
-    let project_paths = cache.initial_paths();
-    let initial_tx = tx.clone();
-    for path in project_paths {
-        let _ = initial_tx.send(Arc::new(path));
+    if let Some(command) = args.command.take() {
+        if args.read_only && command.writes() {
+            eyre::bail!(
+                "this command changes the saved state or cache, which --read-only prevents"
+            );
+        }
+        return match command {
+            Command::Bench => bench::run(&cfg, args.offline).wrap_err("running benchmark"),
+            Command::New {
+                name,
+                template,
+                root,
+            } => {
+                let cache = open_cache(&args)?;
+                scaffold::run(
+                    &cfg,
+                    &cache,
+                    &name,
+                    &template,
+                    root.as_deref(),
+                    args.offline,
+                )
+                .wrap_err("creating project")
+            }
+            Command::SyncManifest { manifest, root } => {
+                let cache = open_cache(&args)?;
+                manifest::run(&cfg, &cache, &manifest, root.as_deref(), args.offline)
+                    .wrap_err("syncing manifest")
+            }
+            Command::Mirror {
+                source,
+                dir,
+                exclude,
+                archived,
+                forks,
+                https,
+            } => {
+                let cache = open_cache(&args)?;
+                let state = open_state(&args)?;
+                let options = mirror::Options {
+                    exclude,
+                    archived,
+                    forks,
+                    https,
+                };
+                mirror::run(&cfg, &cache, &state, &source, &dir, options, args.offline)
+                    .wrap_err("mirroring repositories")
+            }
+            Command::Archive { path } => {
+                let cache = open_cache(&args)?;
+                archive::run(&cfg, &cache, &path, args.yes).wrap_err("archiving project")
+            }
+            Command::List { .. } | Command::Prompt { .. } | Command::Statusline { .. } => {
+                unreachable!("run before reading the config")
+            }
+            Command::Ignore { pattern, remove } => {
+                let cache = open_cache(&args)?;
+                let state = open_state(&args)?;
+                exclude::run(&cfg, &cache, &state, pattern, remove).wrap_err("updating ignores")
+            }
+            Command::Daemon { command: None } => {
+                daemon::run(cfg, config_path, args.offline).wrap_err("running daemon")
+            }
+            Command::Daemon {
+                command: Some(DaemonCommand::Status),
+            } => daemon::status(),
+            Command::Daemon {
+                command: Some(DaemonCommand::Install { print }),
+            } => service::install(&config_path, print, args.dry_run).wrap_err("installing service"),
+            Command::Cache {
+                command: CacheCommand::Show { format },
+            } => {
+                let cache = open_cache(&args)?;
+                let state = open_state(&args)?;
+                cache::show(&cfg, &cache, &state, format).wrap_err("showing cache")
+            }
+            Command::Cache {
+                command: CacheCommand::Clear { root, pattern },
+            } => {
+                let cache = open_cache(&args)?;
+                let state = open_state(&args)?;
+                cache::clear(
+                    &cache,
+                    &state,
+                    root.as_deref(),
+                    pattern.as_deref(),
+                    args.yes,
+                )
+                .wrap_err("clearing cache")
+            }
+            Command::Track => {
+                // run every few seconds alongside everything else, so it
+                // saves only the activity it records
+                let state = open_shared_state(&args)?;
+                let afk_after = cfg.afk_after.map_or(activity::DEFAULT_AFK_AFTER, |d| d.0);
+                activity::record(&state, afk_after).wrap_err("recording activity")?;
+                state.save_activity().wrap_err("saving activity")
+            }
+            Command::Tokens => secret::check(&cfg.tokens),
+            Command::Check => {
+                let config_txt =
+                    std::fs::read_to_string(&config_path).wrap_err("reading config file")?;
+                cfg.check_commands(&config_txt)
+                    .wrap_err_with(|| format!("checking {}", config_path.display()))
+            }
+            Command::Sync => {
+                let cache = open_cache(&args)?;
+                let state = open_state(&args)?;
+                sync::run(&cfg, &cache, &state, args.offline).wrap_err("syncing")
+            }
+            Command::Rpc => {
+                let cache = open_cache(&args)?;
+                let state = open_shared_state(&args)?;
+                rpc::run(&cfg, &args, &cache, &state).wrap_err("serving rpc")
+            }
+            Command::Discover { depth, min_repos } => {
+                discover::run(&cfg, depth, min_repos).wrap_err("discovering roots")
+            }
+            Command::Import { source } => {
+                let cache = open_cache(&args)?;
+                let state = open_state(&args)?;
+                import::run(&cfg, &cache, &state, source).wrap_err("importing projects")
+            }
+            Command::Stats => {
+                let cache = open_cache(&args)?;
+                let state = open_state(&args)?;
+                stats::run(&cfg, &cache, &state).wrap_err("computing stats")
+            }
+            Command::ExportLayout { path, tool } => {
+                let project = resolve_project(&cfg, &args, &path)?;
+                layout::export(&project, tool).wrap_err("exporting layout")
+            }
+            Command::Browse { path } => {
+                let project = resolve_project(&cfg, &args, &path)?;
+                browse::run(&project, args.dry_run).wrap_err("opening browser")
+            }
+            Command::Path {
+                path,
+                session,
+                copy,
+            } => {
+                let project = resolve_project(&cfg, &args, &path)?;
+                let text = if session {
+                    project.session_name
+                } else {
+                    project.full_path
+                };
+                if copy {
+                    clipboard::copy(&text).wrap_err("copying to the clipboard")
+                } else {
+                    println!("{}", text);
+                    Ok(())
+                }
+            }
+            Command::Explain { path } => {
+                let cache = open_cache(&args)?;
+                let state = state::State::open_read_only().wrap_err("opening state")?;
+                explain::run(&cfg, &cache, &state, &path)
+            }
+            Command::Note { path, note } => {
+                let cache = open_cache(&args)?;
+                let state = open_state(&args)?;
+                let project = cfg.resolve(&cache, &path)?;
+                state.set_note(&project.full_path, note.trim());
+                Ok(())
+            }
+            Command::Open { path } => {
+                let state = open_state(&args)?;
+                let project = resolve_project(&cfg, &args, &path)?;
+                open_project(&cfg, &args, &state, &project)
+            }
+            Command::Back { client } => {
+                let state = open_state(&args)?;
+                history::go(&cfg, &args, &state, client, false).wrap_err("going back")
+            }
+            Command::Forward { client } => {
+                let state = open_state(&args)?;
+                history::go(&cfg, &args, &state, client, true).wrap_err("going forward")
+            }
+            Command::Undo => {
+                let cache = open_cache(&args)?;
+                let state = open_state(&args)?;
+                undo::run(&cache, &state).wrap_err("undoing")
+            }
+            Command::Manage => {
+                let cache = open_cache(&args)?;
+                let state = open_state(&args)?;
+                manage::run(&cfg, &cache, &state, args.yes, args.offline).wrap_err("managing cache")
+            }
+            Command::Sessions { command: None } => {
+                let cache = open_cache(&args)?;
+                sessions::run(&cache).wrap_err("listing sessions")
+            }
+            Command::Sessions {
+                command: Some(SessionsCommand::Prune { idle }),
+            } => sessions::prune(&cfg, idle.or(cfg.prune_idle_after), args.dry_run, args.yes)
+                .wrap_err("pruning sessions"),
+            Command::InstallKeybinding {
+                key,
+                style,
+                print,
+                file,
+            } => keybinding::run(&key, style, print, file).wrap_err("installing key binding"),
+        };
     }
 
+    let cache = if args.no_cache {
+        Cache::in_memory()
+    } else if args.read_only {
+        Cache::read_only().wrap_err("loading cache")?
+    } else {
+        Cache::new(args.clear).wrap_err("creating cache")?
+    };
+    let state = open_state(&args)?;
+    if args.scan_report {
+        return report::run(&cfg, &cache, &state, args.all, args.offline);
+    }
+    if args.plain {
+        return plain::run(&cfg, &args, &cache, &state);
+    }
+    let notes = cfg.project_notes();
+    let console = args.console || cfg.console;
+    let show_preview =
+        cfg.preview || console || cfg.forge.is_some() || !notes.is_empty() || state.has_notes();
+    let annotators = Annotators {
+        git: cfg
+            .git_info
+            .enabled
+            .then(|| git::Enricher::start(&cfg.git_info)),
+        sizes: cfg
+            .disk_usage_column
+            .then(|| usage::Sizer::start(cache.clone())),
+        forge: cfg
+            .forge
+            .as_ref()
+            .filter(|_| !args.offline)
+            .map(|forge| forge::Fetcher::start(forge, cfg.tokens.clone())),
+        recent: show_preview.then(|| files::RecentFiles::start(RECENT_FILES)),
+        notes: Arc::new(notes),
+        state: state.clone(),
+    };
+    let annotators = Arc::new(annotators);
+    let (tx, rx): (skim::SkimItemSender, skim::SkimItemReceiver) = crossbeam_channel::unbounded();
+    // projects from the config file need no walking, so they are listed from
+    // the start even when the cache has never seen them
+    scan_roots(
+        &cfg,
+        &cache,
+        &cfg.scan_excludes(&state, args.all),
+        args.offline,
+        |_| false,
+        |_| {},
+    );
+    // the scan thread owns the only sender, so skim sees the channel close and
+    // stops showing its loading indicator once the scan has finished
+    send_cached(&cfg, &cache, &state, &annotators, args.all, &tx);
+
     // spawn background thread which updates the cache
+    let cfg = Arc::new(cfg);
+    let scan_cfg = Arc::clone(&cfg);
+    let scan_cache = cache.clone();
+    let scan_annotators = Arc::clone(&annotators);
+    // worked out up front so the scan thread does not need the state
+    let excludes = cfg.scan_excludes(&state, args.all);
+    let offline = args.offline;
     std::thread::spawn(move || {
-        // walk the file system with the given config and update the cache
-        for dir in cfg.root_dirs {
-            let walker = ignore::WalkBuilder::new(dir.path.clone()).build();
-            let dir_path_str = dir.path.to_str().unwrap();
-            let matches = walker
-                .into_iter()
-                .filter_map(|e| e.ok())
-                .filter(|e| e.path().is_dir())
-                .filter(|e| e.path().join(".git").is_dir());
-            for result in matches {
-                let path = result.into_path();
-                let full_path_str = path.to_str().unwrap().to_string();
-                let session_name = compute_session_name(&full_path_str, dir_path_str);
-
-                let project_path = ProjectPath {
-                    full_path: full_path_str,
-                    session_name,
-                };
+        scan(&scan_cfg, &scan_cache, &excludes, offline, |project_path| {
+            let _ = tx.send(Arc::new(scan_annotators.item(project_path)));
+        });
+    });
+    signals::watch_picker(
+        Arc::clone(&cfg),
+        cache.clone(),
+        state.clone(),
+        cfg.scan_excludes(&state, args.all),
+        args.offline,
+    )?;
 
-                if let CacheState::Missing = cache.add(project_path.clone()) {
-                    let _ = tx.send(Arc::new(project_path));
+    let history = state.queries();
+    let header;
+    let typed;
+    let mut options = skim::SkimOptions::from_env();
+    if show_preview {
+        options.preview = Some("");
+    }
+    options.query_history = &history;
+    options.bind = vec!["ctrl-r:previous-history"];
+    if args.requery {
+        options.query = history.last().map(String::as_str);
+    }
+    options.expect = Some("alt-a".to_string());
+    if console {
+        return console::run(&cfg, &args, &cache, &state, &annotators, options, rx);
+    }
+    if let Some(by) = args.group_by.or(cfg.group_by) {
+        if let Some(project) = group::pick(&cfg, &args, &cache, &state, &annotators, by, options)? {
+            if args.files {
+                open_file(&cfg, &args, &state, &project)?;
+            } else {
+                open_project(&cfg, &args, &state, &project)?;
+            }
+        }
+        return Ok(());
+    }
+    let capped = cfg
+        .max_results
+        .filter(|_| options.query.is_none())
+        .and_then(|max| capped_items(&cfg, &cache, &state, &annotators, args.all, max));
+    let result = match capped {
+        // the first keystroke ends the capped picker, and the full one
+        // carries on from it
+        Some((capped_rx, hidden)) => {
+            header = format!("{} more projects, type to search them all", hidden);
+            options.header = Some(&header);
+            let expect = options.expect.replace(format!("alt-a,{}", typing_keys()));
+            let result = skim::Skim::run_with(&options, Some(capped_rx));
+            options.header = None;
+            options.expect = expect;
+            match result.as_ref().map(|result| result.final_key) {
+                Some(skim::prelude::Key::Char(c)) => {
+                    typed = c.to_string();
+                    options.query = Some(&typed);
+                    skim::Skim::run_with(&options, Some(rx))
                 }
+                _ => result,
             }
         }
-    });
-
-    let options = skim::SkimOptions::from_env();
-    if let Some(result) = skim::Skim::run_with(&options, Some(rx)) {
+        None => skim::Skim::run_with(&options, Some(rx)),
+    };
+    if let Some(result) = result {
         if result.is_abort {
             return Ok(());
         }
 
+        state.record_query(&result.query);
         let item = &result.selected_items[0];
-        // we know this is a ProjectPath, so downcast accordingly
-        let item: &ProjectPath = item.as_any().downcast_ref().unwrap();
+        // we know this is a ProjectItem, so downcast accordingly
+        let item: &ProjectItem = item.as_any().downcast_ref().unwrap();
+
+        if args.files {
+            open_file(&cfg, &args, &state, &item.path)?;
+        } else if cfg.action_menu || result.final_key == skim::prelude::Key::Alt('a') {
+            actions::run(&cfg, &args, &state, &item.path)?;
+        } else {
+            open_project(&cfg, &args, &state, &item.path)?;
+        }
+    }
+
+    Ok(())
+}
+
+/// Walk the file system with the given config and update the cache, calling
+/// `on_new` with each project which was not already cached. Remote roots are
+/// left as they were cached when `offline`.
+fn scan<F>(
+    cfg: &Config,
+    cache: &Cache,
+    excludes: &exclude::Excludes,
+    offline: bool,
+    on_new: F,
+) -> report::ScanReport
+where
+    F: FnMut(ProjectPath),
+{
+    scan_roots(cfg, cache, excludes, offline, |_| true, on_new)
+}
+
+/// As [`scan`], walking only the roots `include` picks
+fn scan_roots<I, F>(
+    cfg: &Config,
+    cache: &Cache,
+    excludes: &exclude::Excludes,
+    offline: bool,
+    include: I,
+    mut on_new: F,
+) -> report::ScanReport
+where
+    I: Fn(&RootDir) -> bool,
+    F: FnMut(ProjectPath),
+{
+    let mut indexing = Indexing {
+        names: cache.session_names(),
+        seen: HashSet::new(),
+        report: report::ScanReport::default(),
+        dated: Vec::new(),
+    };
+
+    let mut scanned = HashSet::new();
+    // projects from the config file go first, so their names win and roots
+    // which also find them leave them be. They are always listed, even when
+    // out of reach like an unmounted network share.
+    for project in &cfg.projects {
+        let mut project_path = project.project_path();
+        if let Ok(canonical) = std::fs::canonicalize(&project_path.full_path) {
+            let canonical = canonical.to_string_lossy().into_owned();
+            if canonical != project_path.full_path {
+                cache.remove(&project_path.full_path);
+                project_path.full_path = canonical;
+            }
+        }
+        if !indexing.seen.insert(project_path.full_path.clone()) {
+            indexing.report.duplicates += 1;
+            continue;
+        }
+        unique_session_name(&mut indexing.names, &mut project_path);
+        indexing.report.indexed += 1;
+        if let CacheState::Missing = cache.add(project_path.clone()) {
+            on_new(project_path);
+        }
+    }
+    let roots: Vec<&RootDir> = cfg
+        .roots_by_weight()
+        .into_iter()
+        .filter(|dir| scanned.insert(&dir.path) && include(dir))
+        .collect();
+    std::thread::scope(|s| {
+        // every root is walked at once on its own thread, while their
+        // projects are indexed here one root at a time in weight order so
+        // names do not depend on which walk finishes first
+        let walks: Vec<_> = roots
+            .iter()
+            .map(|&dir| {
+                // bounded so that roots waiting their turn pause their walks
+                // instead of holding every project they find in memory
+                let (tx, rx) = crossbeam_channel::bounded(WALK_BUFFER);
+                s.spawn(move || {
+                    let start = std::time::Instant::now();
+                    let mut found = 0;
+                    for project_path in discover_projects(dir, cfg.nested_roots(dir), offline) {
+                        found += 1;
+                        if tx.send(project_path).is_err() {
+                            return;
+                        }
+                    }
+                    log::debug!(
+                        "scanned {} in {:.2?}: {} projects",
+                        dir.path.display(),
+                        start.elapsed(),
+                        found
+                    );
+                });
+                (dir, rx)
+            })
+            .collect();
+        for (dir, rx) in walks {
+            index_root(cfg, cache, excludes, dir, rx, &mut indexing, &mut on_new);
+        }
+    });
+    update_last_changed(cache, indexing.dated, cfg.git_info.workers);
+    indexing.report
+}
+
+/// Look up when each project last changed, which runs git for each, on a
+/// few threads once everything is indexed rather than one at a time in the
+/// middle of the scan
+fn update_last_changed(cache: &Cache, full_paths: Vec<String>, workers: usize) {
+    let (tx, rx) = crossbeam_channel::unbounded();
+    for full_path in full_paths {
+        let _ = tx.send(full_path);
+    }
+    drop(tx);
+    std::thread::scope(|s| {
+        for _ in 0..workers.max(1) {
+            let rx = rx.clone();
+            s.spawn(move || {
+                for full_path in rx.iter() {
+                    cache.update_last_changed(&full_path);
+                }
+            });
+        }
+    });
+}
+
+/// How many projects a root's walk may find ahead of them being indexed
+const WALK_BUFFER: usize = 256;
+
+/// What a scan has come across so far
+struct Indexing {
+    /// session names taken, and the projects taking them
+    names: HashMap<String, String>,
+    seen: HashSet<String>,
+    report: report::ScanReport,
+    /// projects under roots with `ignore_older_than`, whose last change is
+    /// looked up after indexing
+    dated: Vec<String>,
+}
+
+/// Add the projects the walk of `dir` sends to the cache
+fn index_root<F>(
+    cfg: &Config,
+    cache: &Cache,
+    excludes: &exclude::Excludes,
+    dir: &RootDir,
+    rx: crossbeam_channel::Receiver<ProjectPath>,
+    indexing: &mut Indexing,
+    on_new: &mut F,
+) where
+    F: FnMut(ProjectPath),
+{
+    for mut project_path in rx.iter() {
+        // a repository reachable through a symlink or from two roots is
+        // indexed once, named after the first (heaviest) root to reach it
+        if let Ok(canonical) = std::fs::canonicalize(&project_path.full_path) {
+            let canonical = canonical.to_string_lossy().into_owned();
+            if canonical != project_path.full_path {
+                cache.remove(&project_path.full_path);
+                project_path.full_path = canonical;
+            }
+        }
+        if !indexing.seen.insert(project_path.full_path.clone()) {
+            indexing.report.duplicates += 1;
+            continue;
+        }
+        unique_session_name(&mut indexing.names, &mut project_path);
+        if cfg.is_archived(&project_path.full_path) {
+            indexing.report.archived += 1;
+            continue;
+        }
+        if let Some(pattern) = excludes.matching(&project_path.full_path) {
+            indexing.report.exclude(pattern);
+            continue;
+        }
+        indexing.report.indexed += 1;
+        // remote projects have no local files or history to look at
+        if dir.ignore_older_than.is_some() && !dir.is_remote() {
+            indexing.dated.push(project_path.full_path.clone());
+        }
+        if let CacheState::Missing = cache.add(project_path.clone()) {
+            on_new(project_path);
+        }
+    }
+}
+
+/// The cached projects which are not hidden, excluded or dormant, or all of
+/// them with `all`: pinned projects, then the heaviest roots, then the most
+/// recently opened first
+fn cached_projects(
+    cfg: &Config,
+    cache: &Cache,
+    state: &state::State,
+    all: bool,
+) -> Vec<ProjectPath> {
+    let excludes = cfg.excludes(state);
+    let mut project_paths: Vec<_> = cache
+        .initial_paths()
+        .into_iter()
+        .filter(|p| {
+            all || !(state.is_hidden(&p.full_path)
+                || excludes.matches(&p.full_path)
+                || cfg.is_dormant(cache, state, &p.full_path))
+        })
+        .collect();
+    project_paths.sort_by_key(|p| {
+        (
+            !state.is_pinned(&p.full_path),
+            std::cmp::Reverse(cfg.weight_of(&p.full_path)),
+            std::cmp::Reverse(state.last_used(&p.full_path)),
+        )
+    });
+    project_paths
+}
+
+/// Send the cached projects to the picker
+fn send_cached(
+    cfg: &Config,
+    cache: &Cache,
+    state: &state::State,
+    annotators: &Arc<Annotators>,
+    all: bool,
+    tx: &skim::SkimItemSender,
+) {
+    for path in cached_projects(cfg, cache, state, all) {
+        let _ = tx.send(Arc::new(annotators.item(path)));
+    }
+}
+
+/// The first `max` cached projects on a channel of their own, and how many
+/// more there are, or `None` when they all fit
+fn capped_items(
+    cfg: &Config,
+    cache: &Cache,
+    state: &state::State,
+    annotators: &Arc<Annotators>,
+    all: bool,
+    max: usize,
+) -> Option<(skim::SkimItemReceiver, usize)> {
+    let projects = cached_projects(cfg, cache, state, all);
+    let hidden = projects.len().checked_sub(max).filter(|&n| n > 0)?;
+    let (tx, rx): (skim::SkimItemSender, skim::SkimItemReceiver) = crossbeam_channel::unbounded();
+    for path in projects.into_iter().take(max) {
+        let _ = tx.send(Arc::new(annotators.item(path)));
+    }
+    Some((rx, hidden))
+}
+
+/// The keys which start a query, for the capped picker to hand over on
+fn typing_keys() -> String {
+    let keys: Vec<String> = ('a'..='z')
+        .chain('A'..='Z')
+        .chain('0'..='9')
+        .chain("-_./~".chars())
+        .map(String::from)
+        .collect();
+    keys.join(",")
+}
+
+/// Switch or attach to the session for `project`, honouring the command line flags
+fn open_project(
+    cfg: &Config,
+    args: &Args,
+    state: &state::State,
+    project: &ProjectPath,
+) -> Result<()> {
+    if let Some((outcome, session_name)) = launch(cfg, args, state, project, None)? {
+        outcome.report(&session_name);
+        record_switch(args, state, project, session_name);
+    }
+    Ok(())
+}
+
+/// Add a switch to the client's history for `project back`
+fn record_switch(args: &Args, state: &state::State, project: &ProjectPath, session_name: String) {
+    if !args.dry_run && !args.read_only {
+        let switched = ProjectPath {
+            full_path: project.full_path.clone(),
+            session_name,
+        };
+        history::record(state, &switched);
+    }
+}
+
+/// Choose a file in `project` and open the project with the file in the editor
+fn open_file(cfg: &Config, args: &Args, state: &state::State, project: &ProjectPath) -> Result<()> {
+    let file = match files::pick(project)? {
+        Some(file) => file,
+        None => return Ok(()),
+    };
+    if let Some((outcome, session_name)) = launch(cfg, args, state, project, Some(&file))? {
+        outcome.report(&session_name);
+        record_switch(args, state, project, session_name);
+    }
+    Ok(())
+}
+
+/// Open `project` without reporting on it, returning what happened in tmux
+/// and the session used, or `None` if the project has its own opener. With a
+/// `file`, it is opened in the editor too.
+fn launch(
+    cfg: &Config,
+    args: &Args,
+    state: &state::State,
+    project: &ProjectPath,
+    file: Option<&str>,
+) -> Result<Option<(tmux::Outcome, String)>> {
+    launch_with(cfg, args, state, project, file, cfg.on_existing, None)
+}
+
+/// As [`launch`], doing `on_existing` rather than what the config says when
+/// the session is already running, and switching `client` if one is given
+/// rather than the one the config picks
+fn launch_with(
+    cfg: &Config,
+    args: &Args,
+    state: &state::State,
+    project: &ProjectPath,
+    file: Option<&str>,
+    on_existing: tmux::OnExisting,
+    client: Option<&str>,
+) -> Result<Option<(tmux::Outcome, String)>> {
+    let opener = state
+        .opener(&project.full_path)
+        .or_else(|| cfg.opener_for(&project.full_path).cloned());
+    if !args.dry_run {
+        state.touch(&project.full_path);
+        if let Some(tracking) = cfg.tracking.as_ref().filter(|_| !args.read_only) {
+            tracking.switched(cfg, state, project);
+        }
+    }
+    let edit = file.map(files::edit_command);
+    let in_pod = opener.as_deref() == Some(k8s::OPENER);
+    if let Some(opener) = opener.filter(|o| o != "tmux" && o != k8s::OPENER) {
+        // the editor takes the place of the opener, as there is no session
+        // to open it in
+        let opener = match edit {
+            Some(edit) => edit,
+            None => cfg
+                .vars(project)
+                .render_command(&opener)
+                .wrap_err_with(|| format!("rendering opener {:?}", opener))?,
+        };
+        run_opener(cfg, &opener, project, args.dry_run)?;
+        return Ok(None);
+    }
 
-        let session = Tmux::new(item);
-        session.create().wrap_err("creating tmux session")?;
+    let secondary;
+    let project = if args.secondary {
+        secondary = tmux::secondary(project)?;
+        &secondary
+    } else {
+        project
+    };
+    if let Some(nvim) = &cfg.nvim {
+        // an editor here cannot open files on another machine
+        if !args.dry_run && !remote::is_remote(&project.full_path) {
+            nvim::sync(nvim, &cfg.vars(project));
+        }
     }
+    let shell = if in_pod {
+        let dev_pod = cfg
+            .dev_pod
+            .as_ref()
+            .ok_or_else(|| eyre::eyre!("the dev-pod opener needs a [dev_pod] section"))?;
+        let shell = cfg.shell_for(&project.full_path).map(String::as_str);
+        Some(dev_pod.shell(&project.full_path, shell)?)
+    } else {
+        cfg.session_shell(&project.full_path)
+    };
+    let outcome = Tmux::new(project)
+        .detach_others(args.detach_others)
+        .dry_run(args.dry_run)
+        .new_session_args(cfg.new_session_args(project, &args.tmux_args))
+        .shell(shell)
+        .client(client.map(str::to_string).or_else(|| {
+            cfg.switch_invoking_client
+                .then(tmux::invoking_client)
+                .flatten()
+        }))
+        .print_commands(args.print_commands)
+        .on_existing(on_existing)
+        .window_command(edit)
+        .create()
+        .wrap_err("creating tmux session")?;
+    Ok(Some((outcome, project.session_name.clone())))
+}
 
+/// Open a project with a command such as "code ." run from its directory
+fn run_opener(cfg: &Config, opener: &str, project: &ProjectPath, dry_run: bool) -> Result<()> {
+    let env = cfg.env_for(project);
+    let assignments: String = env
+        .iter()
+        .map(|(key, value)| {
+            let assignment = format!("{}={}", key, value);
+            format!("{} ", tmux::shell_quote(&redact::arg(&assignment)))
+        })
+        .collect();
+    let described = format!(
+        "cd {} && {}{}",
+        tmux::shell_quote(&project.full_path),
+        assignments,
+        opener
+    );
+    if dry_run {
+        println!("{}", described);
+        return Ok(());
+    }
+    log::debug!("running {}", described);
+    let status = std::process::Command::new("sh")
+        .arg("-c")
+        .arg(opener)
+        .current_dir(&project.full_path)
+        .env("PROJECT_NAME", &project.session_name)
+        .env("PROJECT_PATH", &project.full_path)
+        .envs(env)
+        .status()
+        .wrap_err_with(|| format!("running {:?}", opener))?;
+    if !status.success() {
+        eyre::bail!("opener {:?} failed: {}", opener, status);
+    }
     Ok(())
 }
 
@@ -338,6 +2745,294 @@ fn main() -> Result<()> {
 mod tests {
     use super::*;
 
+    #[test]
+    fn journal_replay() {
+        let journal = std::env::temp_dir().join(format!("project-journal-{}", std::process::id()));
+        std::fs::write(
+            &journal,
+            concat!(
+                r#"[{"FullPath":"/work/api","SessionName":"api"},100]"#,
+                "\n",
+                r#"[{"FullPath":"/work/api","SessionName":"work/api"},200]"#,
+                "\n",
+                r#"[{"FullPath":"/work/we"#,
+            ),
+        )
+        .unwrap();
+        let mut inner = CacheInner::default();
+        inner.replay(&journal);
+        let paths: Vec<_> = inner
+            .paths
+            .iter()
+            .map(|p| p.session_name.as_str())
+            .collect();
+        assert_eq!(paths, vec!["work/api"]);
+        assert_eq!(inner.added.get("/work/api"), Some(&100));
+
+        // catching up before a write keeps what this process already has
+        // and what it removed
+        let mut ours = CacheInner::default();
+        let api = ProjectPath {
+            full_path: "/work/api".to_string(),
+            session_name: "api".to_string(),
+        };
+        ours.insert(api, 50);
+        ours.catch_up(&journal, &HashSet::new());
+        let paths: Vec<_> = ours.paths.iter().map(|p| p.session_name.as_str()).collect();
+        assert_eq!(paths, vec!["api"]);
+        let mut ours = CacheInner::default();
+        ours.catch_up(&journal, &HashSet::from(["/work/api".to_string()]));
+        std::fs::remove_file(&journal).unwrap();
+        assert!(ours.paths.is_empty());
+    }
+
+    #[test]
+    fn cache_entries() {
+        let cache = Cache::in_memory();
+        let api = ProjectPath {
+            full_path: "/work/api".to_string(),
+            session_name: "api".to_string(),
+        };
+        cache.inner.write().unwrap().insert(api.clone(), 100);
+        cache
+            .inner
+            .write()
+            .unwrap()
+            .last_changed
+            .insert(api.full_path.clone(), 50);
+        let entry = cache.entry(&api.full_path).unwrap();
+        cache.remove(&api.full_path);
+        assert!(cache.entry(&api.full_path).is_none());
+        cache.restore(entry.clone());
+        assert_eq!(cache.entry(&api.full_path), Some(entry));
+        assert_eq!(cache.added(&api.full_path), Some(100));
+
+        // undo entries saved before more than the path was kept
+        let old: CacheEntry =
+            serde_json::from_str(r#"{"FullPath":"/work/api","SessionName":"api"}"#).unwrap();
+        assert_eq!(old.project, api);
+        assert_eq!(old.added, None);
+    }
+
+    #[test]
+    fn config_checks() {
+        let config_txt = r#"root_dirs = []
+
+[openers]
+"~/work/web" = "code {{.Pth}}"
+
+[env]
+GOOD = "{{.Branch}}"
+"#;
+        let cfg: Config = toml::from_str(config_txt).unwrap();
+        let err = cfg.check(config_txt).unwrap_err().to_string();
+        assert!(err.starts_with("line 4: unknown field .Pth"), "{}", err);
+        assert!(
+            err.ends_with("\"~/work/web\" = \"code {{.Pth}}\""),
+            "{}",
+            err
+        );
+
+        // shell syntax is only checked on asking
+        let config_txt = r#"root_dirs = []
+
+[shells]
+"~/work/web" = "if true; then echo"
+"#;
+        let cfg: Config = toml::from_str(config_txt).unwrap();
+        assert!(cfg.check(config_txt).is_ok());
+        let err = cfg.check_commands(config_txt).unwrap_err().to_string();
+        assert!(err.starts_with("line 4: shell syntax error"), "{}", err);
+    }
+
+    #[test]
+    fn session_name_templates() {
+        let mut dir = RootDir {
+            path: PathBuf::from("/Users/user/work"),
+            prefix: Some("w-".to_string()),
+            separator: None,
+            weight: 0,
+            session_name: None,
+            short_session_names: false,
+            new_session_args: Vec::new(),
+            shell: None,
+            max_depth: None,
+            ignore_older_than: None,
+        };
+        let full_path = "/Users/user/work/client/team/service";
+        assert_eq!(dir.session_name_for(full_path), "w-client/team/service");
+
+        dir.session_name = Some("{{.Parent}}/{{.Base}}".to_string());
+        assert_eq!(dir.session_name_for(full_path), "team/service");
+
+        dir.session_name = None;
+        dir.short_session_names = true;
+        assert_eq!(dir.session_name_for(full_path), "w-service");
+
+        dir.prefix = Some("work".to_string());
+        dir.separator = Some("/".to_string());
+        assert_eq!(dir.session_name_for(full_path), "work/service");
+    }
+
+    #[test]
+    fn overlapping_roots() {
+        let root = |path: &str| RootDir {
+            path: PathBuf::from(path),
+            ..Default::default()
+        };
+        let cfg = Config {
+            root_dirs: vec![
+                root("/src"),
+                root("/src/forks"),
+                root("/work"),
+                root("/src"),
+            ],
+            ..Default::default()
+        };
+        let overlaps: Vec<_> = cfg
+            .overlapping_roots()
+            .into_iter()
+            .map(|(outer, inner)| (outer.path.clone(), inner.path.clone()))
+            .collect();
+        assert_eq!(
+            overlaps,
+            vec![
+                (PathBuf::from("/src"), PathBuf::from("/src/forks")),
+                (PathBuf::from("/src"), PathBuf::from("/src")),
+            ]
+        );
+        assert_eq!(
+            cfg.nested_roots(&cfg.root_dirs[0]),
+            vec![PathBuf::from("/src/forks")]
+        );
+    }
+
+    #[test]
+    fn offline_remote_roots() {
+        let root = |path: &str| RootDir {
+            path: PathBuf::from(path),
+            ..Default::default()
+        };
+        let docker = root("docker:devbox:/workspace");
+        assert!(docker.is_remote());
+        assert!(root("ssh:build:/srv/src").is_remote());
+        assert!(!root("/work").is_remote());
+        // nothing is run in the container, so there is nothing to find
+        assert_eq!(discover_projects(&docker, Vec::new(), true).count(), 0);
+    }
+
+    #[test]
+    fn symlinked_roots() {
+        let dir = std::env::temp_dir().join(format!("project-symlinks-{}", std::process::id()));
+        let real = dir.join("real");
+        std::fs::create_dir_all(real.join("api")).unwrap();
+        std::os::unix::fs::symlink(&real, dir.join("link")).unwrap();
+        let real = std::fs::canonicalize(&real).unwrap();
+        let link = dir.join("link");
+
+        let mut cfg = Config {
+            root_dirs: vec![RootDir {
+                path: link.clone(),
+                weight: 3,
+                ..Default::default()
+            }],
+            openers: [(format!("{}/api/", link.display()), "code .".to_string())].into(),
+            protected: vec![format!("{}/api", link.display()), "work/web".to_string()],
+            ..Default::default()
+        };
+        cfg.canonicalize();
+        let api = real.join("api").to_string_lossy().into_owned();
+        assert_eq!(cfg.weight_of(&api), 3);
+        assert_eq!(cfg.opener_for(&api).map(String::as_str), Some("code ."));
+        assert_eq!(cfg.protected, vec![api.clone(), "work/web".to_string()]);
+        assert_eq!(canonical_key("/"), "/");
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+
+    #[test]
+    fn resolving_short_names() {
+        let dir = std::env::temp_dir().join(format!("project-short-{}", std::process::id()));
+        std::fs::create_dir_all(dir.join("team/service")).unwrap();
+        let dir = std::fs::canonicalize(&dir).unwrap();
+        let cfg = Config {
+            root_dirs: vec![RootDir {
+                path: dir.clone(),
+                short_session_names: true,
+                ..Default::default()
+            }],
+            ..Default::default()
+        };
+        let cache = Cache::in_memory();
+        cache.add(ProjectPath {
+            full_path: "/elsewhere/service".to_string(),
+            session_name: "service".to_string(),
+        });
+        let project = cfg
+            .resolve(&cache, &dir.join("team/service").to_string_lossy())
+            .unwrap();
+        std::fs::remove_dir_all(&dir).unwrap();
+        assert_eq!(project.session_name, "service-2");
+    }
+
+    #[test]
+    fn cdpath_entries() {
+        let roots = cdpath_roots(".:/srv/code/::relative:/opt/src");
+        let paths: Vec<_> = roots.iter().map(|d| d.path.clone()).collect();
+        assert_eq!(
+            paths,
+            vec![PathBuf::from("/srv/code"), PathBuf::from("/opt/src")]
+        );
+        assert!(roots.iter().all(|d| d.max_depth == Some(1)));
+    }
+
+    #[test]
+    fn session_name_collisions() {
+        let project = |path: &str| ProjectPath {
+            full_path: path.to_string(),
+            session_name: "service".to_string(),
+        };
+        let mut names = HashMap::new();
+
+        let mut a = project("/work/a/service");
+        let mut b = project("/work/b/service");
+        unique_session_name(&mut names, &mut a);
+        unique_session_name(&mut names, &mut b);
+        assert_eq!(a.session_name, "service");
+        assert_eq!(b.session_name, "service-2");
+
+        // seen again on a later scan, each keeps the name it was given
+        let mut b = project("/work/b/service");
+        unique_session_name(&mut names, &mut b);
+        assert_eq!(b.session_name, "service-2");
+    }
+
+    #[test]
+    fn root_paths() {
+        std::env::set_var("PROJECT_TEST_ROOT", "/srv/code");
+        assert_eq!(normalize_path("/work/").unwrap(), PathBuf::from("/work"));
+        assert_eq!(
+            normalize_path("/work//a/./b/../c").unwrap(),
+            PathBuf::from("/work/a/c")
+        );
+        assert_eq!(normalize_path("/../work").unwrap(), PathBuf::from("/work"));
+        assert_eq!(
+            normalize_path("$PROJECT_TEST_ROOT/forks/").unwrap(),
+            PathBuf::from("/srv/code/forks")
+        );
+        assert!(normalize_path("$PROJECT_TEST_UNSET/x").is_err());
+        assert_eq!(
+            normalize_path(r"C:\Users\me\src\").unwrap(),
+            PathBuf::from("/mnt/c/Users/me/src")
+        );
+
+        let root = RootDir {
+            path: normalize_path("/work/").unwrap(),
+            ..Default::default()
+        };
+        assert_eq!(root.session_name_for("/work/a/b"), "a/b");
+        assert_eq!(root.session_name_for("/work"), "work");
+    }
+
     #[test]
     fn session_name() {
         let full_path = "/Users/user/work/project/a/b/c";
@@ -0,0 +1,139 @@
+use eyre::{Result, WrapErr};
+use std::{borrow::Cow, io::Write, path::Path, sync::Arc};
+
+use skim::prelude::Key;
+
+use crate::{
+    confirm::confirm, remote, scan, state::State, undo, Cache, Config, ProjectPath,
+    SkimOptionsFromEnv,
+};
+
+const HELP: &str = "tab: select  ctrl-d: remove  ctrl-s: remove missing  ctrl-t: tag  ctrl-p: pin  ctrl-r: rescan  esc: quit";
+
+/// Whether a project's directory has gone. Remote projects cannot be checked
+/// from here, so they never count as missing.
+fn is_missing(full_path: &str) -> bool {
+    !remote::is_remote(full_path) && !Path::new(full_path).is_dir()
+}
+
+/// A cache entry, labelled so that typing "missing" or "pinned" filters on it
+struct ManageItem {
+    path: ProjectPath,
+    label: String,
+}
+
+impl ManageItem {
+    fn new(path: ProjectPath, state: &State) -> Self {
+        let mut label = path.full_path.clone();
+        if is_missing(&path.full_path) {
+            label.push_str("  [missing]");
+        }
+        if state.is_pinned(&path.full_path) {
+            label.push_str("  [pinned]");
+        }
+        let tags = state.tags(&path.full_path);
+        if !tags.is_empty() {
+            label.push_str(&format!("  [{}]", tags.join(", ")));
+        }
+        Self { path, label }
+    }
+}
+
+impl skim::SkimItem for ManageItem {
+    fn text(&self) -> Cow<str> {
+        Cow::Borrowed(&self.label)
+    }
+}
+
+fn prompt(message: &str) -> Result<String> {
+    print!("{}", message);
+    std::io::stdout().flush()?;
+    let mut line = String::new();
+    std::io::stdin()
+        .read_line(&mut line)
+        .wrap_err("reading input")?;
+    Ok(line.trim().to_string())
+}
+
+pub(crate) fn run(
+    cfg: &Config,
+    cache: &Cache,
+    state: &State,
+    yes: bool,
+    offline: bool,
+) -> Result<()> {
+    let mut options = skim::SkimOptions::from_env();
+    options.multi = true;
+    options.header = Some(HELP);
+    options.expect = Some("ctrl-d,ctrl-s,ctrl-t,ctrl-p,ctrl-r".to_string());
+
+    loop {
+        let (tx, rx): (skim::SkimItemSender, skim::SkimItemReceiver) =
+            crossbeam_channel::unbounded();
+        let mut paths = cache.initial_paths();
+        paths.sort_by(|a, b| a.full_path.cmp(&b.full_path));
+        for path in paths {
+            let _ = tx.send(Arc::new(ManageItem::new(path, state)));
+        }
+        drop(tx);
+
+        let result = match skim::Skim::run_with(&options, Some(rx)) {
+            Some(result) if !result.is_abort => result,
+            _ => return Ok(()),
+        };
+        let selected: Vec<ProjectPath> = result
+            .selected_items
+            .iter()
+            .filter_map(|item| item.as_any().downcast_ref::<ManageItem>())
+            .map(|item| item.path.clone())
+            .collect();
+
+        match result.final_key {
+            Key::Ctrl('d') => {
+                let question = format!("remove {} entries from the cache?", selected.len());
+                if !confirm(&question, yes)? {
+                    continue;
+                }
+                undo::remove(cache, state, "removing cache entries", &selected);
+                println!("removed {} entries", selected.len());
+            }
+            Key::Ctrl('s') => {
+                let missing: Vec<_> = cache
+                    .initial_paths()
+                    .into_iter()
+                    .filter(|p| is_missing(&p.full_path))
+                    .collect();
+                let question = format!("remove {} missing entries from the cache?", missing.len());
+                if !confirm(&question, yes)? {
+                    continue;
+                }
+                undo::remove(cache, state, "removing missing cache entries", &missing);
+                println!("removed {} missing entries", missing.len());
+            }
+            Key::Ctrl('t') => {
+                let tags = prompt(&format!(
+                    "tags for {} projects (comma separated, empty to clear): ",
+                    selected.len()
+                ))?;
+                let tags: Vec<String> = tags
+                    .split(',')
+                    .map(str::trim)
+                    .filter(|t| !t.is_empty())
+                    .map(str::to_string)
+                    .collect();
+                let full_paths: Vec<&str> = selected.iter().map(|p| p.full_path.as_str()).collect();
+                undo::set_tags(state, &full_paths, tags);
+            }
+            Key::Ctrl('p') => {
+                let full_paths: Vec<&str> = selected.iter().map(|p| p.full_path.as_str()).collect();
+                undo::toggle_pins(state, &full_paths);
+            }
+            Key::Ctrl('r') => {
+                let mut found = 0;
+                scan(cfg, cache, &cfg.excludes(state), offline, |_| found += 1);
+                println!("rescan found {} new projects", found);
+            }
+            _ => return Ok(()),
+        }
+    }
+}
@@ -0,0 +1,170 @@
+//! `project sync-manifest`: clone and update the repositories listed in a
+//! checked-in manifest, so everyone on a team gets the same workspace.
+//!
+//! ```toml
+//! # projects.toml
+//! [[repos]]
+//! url = "git@github.com:team/api.git"
+//! # where to put it in the root, the repository's name by default
+//! path = "services/api"
+//! # branch to check out when cloning, the remote's default otherwise
+//! branch = "main"
+//! ```
+
+use eyre::{Result, WrapErr};
+use serde::Deserialize;
+use std::path::{Component, Path, PathBuf};
+
+use crate::{bulk, scaffold, Cache, Config, ProjectPath};
+
+#[derive(Debug, Deserialize)]
+struct Manifest {
+    #[serde(default)]
+    repos: Vec<Repo>,
+}
+
+#[derive(Debug, Deserialize)]
+struct Repo {
+    url: String,
+    path: Option<PathBuf>,
+    branch: Option<String>,
+}
+
+/// The name a clone of `url` gets by default, as git picks it
+fn repo_name(url: &str) -> Option<&str> {
+    let name = url
+        .trim_end_matches('/')
+        .rsplit(|c| c == '/' || c == ':')
+        .next()?;
+    let name = name.strip_suffix(".git").unwrap_or(name);
+    Some(name).filter(|n| !n.is_empty())
+}
+
+impl Repo {
+    /// Git would take a URL starting with `-` for an option, such as
+    /// `--upload-pack=...` which runs a command
+    fn check_url(&self) -> Result<()> {
+        if self.url.starts_with('-') {
+            eyre::bail!("{:?} is not a repository URL", self.url);
+        }
+        Ok(())
+    }
+
+    /// Where the repository goes within the root. Manifests come from other
+    /// people, so nothing may point outside it.
+    fn relative_path(&self) -> Result<PathBuf> {
+        let path = match &self.path {
+            Some(path) => path.clone(),
+            None => PathBuf::from(
+                repo_name(&self.url)
+                    .ok_or_else(|| eyre::eyre!("no repository name in {:?}", self.url))?,
+            ),
+        };
+        if path.as_os_str().is_empty()
+            || !path.components().all(|c| matches!(c, Component::Normal(_)))
+        {
+            eyre::bail!("{} is not a path inside the root", path.display());
+        }
+        Ok(path)
+    }
+}
+
+pub(crate) fn run(
+    cfg: &Config,
+    cache: &Cache,
+    manifest_path: &Path,
+    root: Option<&Path>,
+    offline: bool,
+) -> Result<()> {
+    if offline {
+        eyre::bail!("syncing a manifest fetches from its remotes, which --offline does not allow");
+    }
+    let txt = std::fs::read_to_string(manifest_path)
+        .wrap_err_with(|| format!("reading {}", manifest_path.display()))?;
+    let manifest: Manifest = toml::from_str(&txt).wrap_err("parsing manifest")?;
+    let root = scaffold::choose_root(cfg, root)?;
+
+    // one broken repository should not hold up the rest
+    let mut failed = 0;
+    let mut jobs = Vec::new();
+    for repo in &manifest.repos {
+        match repo.check_url().and_then(|()| repo.relative_path()) {
+            Ok(relative) => jobs.push(bulk::Job {
+                url: repo.url.clone(),
+                branch: repo.branch.clone(),
+                dst: root.path.join(relative),
+            }),
+            Err(e) => {
+                eprintln!("{}: {:#}", repo.url, e);
+                failed += 1;
+            }
+        }
+    }
+    let key = std::fs::canonicalize(manifest_path).unwrap_or_else(|_| manifest_path.to_path_buf());
+    let key = format!("manifest {} {}", key.display(), root.path.display());
+    for (job, result) in bulk::run(&cfg.clone, &key, jobs) {
+        match result {
+            Ok(_) => {
+                let full_path = job.dst.to_string_lossy().into_owned();
+                cache.add(ProjectPath {
+                    session_name: root.session_name_for(&full_path),
+                    full_path,
+                });
+            }
+            Err(_) => failed += 1,
+        }
+    }
+    if failed > 0 {
+        eyre::bail!(
+            "{} of {} repositories failed to sync",
+            failed,
+            manifest.repos.len()
+        );
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn manifest_paths() {
+        let manifest: Manifest = toml::from_str(
+            r#"
+            [[repos]]
+            url = "git@github.com:team/api.git"
+
+            [[repos]]
+            url = "https://github.com/team/web/"
+            path = "apps/web"
+
+            [[repos]]
+            url = "https://example.com/evil.git"
+            path = "../../.ssh"
+            "#,
+        )
+        .unwrap();
+        let paths: Vec<_> = manifest
+            .repos
+            .iter()
+            .map(|r| r.relative_path().ok())
+            .collect();
+        assert_eq!(
+            paths,
+            vec![
+                Some(PathBuf::from("api")),
+                Some(PathBuf::from("apps/web")),
+                None
+            ]
+        );
+        assert_eq!(repo_name("host:repo"), Some("repo"));
+        assert!(manifest.repos[0].check_url().is_ok());
+        let option = Repo {
+            url: "--upload-pack=touch /tmp/pwned".to_string(),
+            path: Some(PathBuf::from("pwned")),
+            branch: None,
+        };
+        assert!(option.check_url().is_err());
+    }
+}
@@ -0,0 +1,161 @@
+//! `project mirror`: keep a clone of every repository of a GitHub
+//! organisation or GitLab group in one directory, for the scanner to index
+
+use eyre::{Result, WrapErr};
+use std::path::Path;
+
+use crate::{
+    bulk, exclude::Excludes, forge, ssh, state::State, tilde, toml_string, Cache, Config,
+    ProjectPath,
+};
+
+/// What to mirror: `github:org`, `gitlab:group/subgroup`, or a self-hosted
+/// forge's host in place of the kind, as `host:owner`
+fn parse_source(source: &str) -> Option<(String, String)> {
+    let (host, owner) = source.split_once(':')?;
+    let host = match host {
+        "github" => "github.com",
+        "gitlab" => "gitlab.com",
+        host => host,
+    };
+    let owner = owner.trim_matches('/');
+    (!host.is_empty() && !owner.is_empty()).then(|| (host.to_string(), owner.to_string()))
+}
+
+/// Which of an owner's repositories to mirror, and how
+pub(crate) struct Options {
+    /// globs matched like the config file's `exclude`
+    pub(crate) exclude: Vec<String>,
+    pub(crate) archived: bool,
+    pub(crate) forks: bool,
+    /// clone over HTTPS rather than SSH
+    pub(crate) https: bool,
+}
+
+pub(crate) fn run(
+    cfg: &Config,
+    cache: &Cache,
+    state: &State,
+    source: &str,
+    dir: &Path,
+    options: Options,
+    offline: bool,
+) -> Result<()> {
+    if offline {
+        eyre::bail!("mirroring lists and fetches repositories, which --offline does not allow");
+    }
+    let (host, owner) = parse_source(source)
+        .ok_or_else(|| eyre::eyre!("{:?} is not a source such as github:myorg", source))?;
+    let token = cfg
+        .tokens
+        .get(&host)
+        .ok_or_else(|| eyre::eyre!("no token for {} in the [tokens] section", host))?
+        .resolve()
+        .wrap_err_with(|| format!("reading token for {}", host))?;
+    let repos = forge::repositories(cfg.forge.as_ref(), &host, &owner, &token)
+        .wrap_err_with(|| format!("listing repositories of {}", owner))?;
+
+    let dir = tilde::expand(&dir.to_string_lossy()).into_owned();
+    let dir = Path::new(&dir);
+    let excludes = cfg.excludes(state);
+    let flag_excludes = Excludes::new(&options.exclude);
+    let root = cfg.root_for(&dir.to_string_lossy());
+
+    let mut skipped = 0;
+    let mut jobs = Vec::new();
+    for repo in &repos {
+        let dst = dir.join(&repo.name);
+        let full_path = dst.to_string_lossy();
+        if (repo.archived && !options.archived)
+            || (repo.fork && !options.forks)
+            || excludes.matches(&full_path)
+            || flag_excludes.matches(&full_path)
+        {
+            skipped += 1;
+            continue;
+        }
+        let url = if options.https {
+            &repo.https_url
+        } else {
+            &repo.ssh_url
+        };
+        jobs.push(bulk::Job {
+            url: url.clone(),
+            branch: None,
+            dst,
+        });
+    }
+
+    if !options.https && !cfg.clone.ssh_hosts.contains_key(&host) {
+        let hosts = ssh::hosts();
+        let aliases = ssh::aliases_for(&hosts, &host);
+        if let Some(alias) = aliases.first() {
+            eprintln!(
+                "~/.ssh/config connects to {} as {}, to clone through it add to the config file:\n\n[clone.ssh_hosts]\n{} = {}\n",
+                host,
+                aliases.join(", "),
+                toml_string(&host),
+                toml_string(alias)
+            );
+        }
+    }
+
+    let key = format!("mirror {} {}", source, dir.display());
+    let (mut synced, mut failed) = (0, 0);
+    for (job, result) in bulk::run(&cfg.clone, &key, jobs) {
+        if result.is_err() {
+            failed += 1;
+            continue;
+        }
+        synced += 1;
+        if let Some(root) = root {
+            let full_path = job.dst.to_string_lossy().into_owned();
+            cache.add(ProjectPath {
+                session_name: root.session_name_for(&full_path),
+                full_path,
+            });
+        }
+    }
+
+    eprintln!(
+        "mirrored {} of {} repositories, skipped {}",
+        synced,
+        repos.len(),
+        skipped
+    );
+    if root.is_none() {
+        eprintln!(
+            "{} is not in a root directory, add it to the config file to find these projects:\n\n[[root_dirs]]\npath = {}",
+            dir.display(),
+            toml_string(&dir.display().to_string())
+        );
+    }
+    if failed > 0 {
+        eyre::bail!("{} repositories failed to sync", failed);
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn sources() {
+        let source = |s| parse_source(s);
+        assert_eq!(
+            source("github:myorg"),
+            Some(("github.com".to_string(), "myorg".to_string()))
+        );
+        assert_eq!(
+            source("gitlab:team/tools/"),
+            Some(("gitlab.com".to_string(), "team/tools".to_string()))
+        );
+        assert_eq!(
+            source("git.example.com:ops"),
+            Some(("git.example.com".to_string(), "ops".to_string()))
+        );
+        assert_eq!(source("myorg"), None);
+        assert_eq!(source("github:"), None);
+    }
+}
@@ -0,0 +1,133 @@
+//! Keep a Neovim running in the project's session pointed at the project
+
+use serde::{Deserialize, Serialize};
+use std::{path::Path, process::Command, time::Duration};
+
+use crate::{
+    git::output_with_timeout,
+    template::{self, Vars},
+};
+
+/// How long to wait on a Neovim which may be busy or wedged
+const TIMEOUT: Duration = Duration::from_secs(1);
+
+#[derive(Debug, Serialize, Deserialize)]
+pub(crate) struct NvimConfig {
+    /// server socket of the session's Neovim, a template with the project's
+    /// fields, e.g. "/tmp/nvim-{{.Session}}.sock" to match
+    /// `nvim --listen /tmp/nvim-$(tmux display -p '#S').sock`
+    socket: String,
+    /// Ex command run on switching, e.g. "source {{.Path}}/Session.vim"
+    #[serde(default = "default_command")]
+    command: String,
+}
+
+fn default_command() -> String {
+    "cd {{.Path}}".to_string()
+}
+
+impl NvimConfig {
+    pub(crate) fn templates(&self) -> [&str; 2] {
+        [&self.socket, &self.command]
+    }
+
+    fn render(&self, template: &str, vars: &Vars, escape: bool) -> eyre::Result<String> {
+        template::render(template, |name| {
+            let value = vars.lookup(name)?;
+            Some(if escape && name == "Path" {
+                fnameescape(&value)
+            } else {
+                value
+            })
+        })
+    }
+}
+
+/// Escape a file name for an Ex command as Vim's `fnameescape()` does, since
+/// besides splitting arguments on spaces Ex expands `%` and `#` to buffer
+/// names, ends the command at `|`, and so on
+fn fnameescape(name: &str) -> String {
+    let mut escaped = String::with_capacity(name.len());
+    if name.starts_with('+') || name == "-" {
+        escaped.push('\\');
+    }
+    for c in name.chars() {
+        if " \t\n*?[{`$\\%#'\"|!<".contains(c) {
+            escaped.push('\\');
+        }
+        escaped.push(c);
+    }
+    escaped
+}
+
+/// Wrap an Ex command for `--remote-expr`, which unlike `--remote-send` does
+/// not depend on the mode Neovim is in
+fn remote_expr(command: &str) -> String {
+    format!("execute('{}')", command.replace('\'', "''"))
+}
+
+/// Send the configured command to the project's Neovim, if it has one
+/// listening. Failures are only logged as the switch itself has worked.
+pub(crate) fn sync(cfg: &NvimConfig, vars: &Vars) {
+    let socket = cfg.render(&cfg.socket, vars, false);
+    let command = cfg.render(&cfg.command, vars, true);
+    let (socket, command) = match (socket, command) {
+        (Ok(socket), Ok(command)) => (socket, command),
+        (Err(e), _) | (_, Err(e)) => {
+            log::warn!("rendering nvim settings: {:?}", e);
+            return;
+        }
+    };
+    if !Path::new(&socket).exists() {
+        return;
+    }
+    let out = output_with_timeout(
+        Command::new("nvim")
+            .arg("--server")
+            .arg(&socket)
+            .arg("--remote-expr")
+            .arg(remote_expr(&command)),
+        TIMEOUT,
+    );
+    if out.is_none() {
+        log::warn!("sending {:?} to nvim at {}", command, socket);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::ProjectPath;
+
+    #[test]
+    fn commands() {
+        let cfg = NvimConfig {
+            socket: "/tmp/nvim-{{.Session}}.sock".to_string(),
+            command: default_command(),
+        };
+        let project = ProjectPath {
+            full_path: "/home/me/it's here".to_string(),
+            session_name: "here".to_string(),
+        };
+        let vars = Vars::new(&project, None);
+        assert_eq!(
+            cfg.render(&cfg.socket, &vars, false).unwrap(),
+            "/tmp/nvim-here.sock"
+        );
+        let command = cfg.render(&cfg.command, &vars, true).unwrap();
+        assert_eq!(
+            remote_expr(&command),
+            "execute('cd /home/me/it\\''s\\ here')"
+        );
+    }
+
+    #[test]
+    fn escaping() {
+        assert_eq!(fnameescape("/work/plain"), "/work/plain");
+        assert_eq!(
+            fnameescape("/work/a b%c#d|e\\f"),
+            "/work/a\\ b\\%c\\#d\\|e\\\\f"
+        );
+        assert_eq!(fnameescape("+x"), "\\+x");
+    }
+}
@@ -0,0 +1,61 @@
+use eyre::{Result, WrapErr};
+use std::io::{BufRead, Write};
+
+use crate::{cached_projects, open_project, scan, state::State, Args, Cache, Config};
+
+/// Pick a project from a numbered list, for screen readers and terminals
+/// which cannot show the full screen picker
+pub(crate) fn run(cfg: &Config, args: &Args, cache: &Cache, state: &State) -> Result<()> {
+    eprintln!("scanning for projects...");
+    scan(
+        cfg,
+        cache,
+        &cfg.scan_excludes(state, args.all),
+        args.offline,
+        |_| {},
+    );
+    let projects = cached_projects(cfg, cache, state, args.all);
+
+    let stdin = std::io::stdin();
+    let mut lines = stdin.lock().lines();
+    let mut filter = String::new();
+    loop {
+        let mut shown: Vec<_> = projects
+            .iter()
+            .filter(|p| p.full_path.contains(&filter))
+            .collect();
+        let hidden = cfg
+            .max_results
+            .map(|max| shown.len().saturating_sub(max))
+            .unwrap_or(0);
+        shown.truncate(shown.len() - hidden);
+        for (i, project) in shown.iter().enumerate() {
+            println!("{}. {}", i + 1, project.full_path);
+        }
+        if hidden > 0 {
+            println!("... and {} more, type text to narrow the list", hidden);
+        }
+        if shown.is_empty() {
+            println!("no projects match {:?}", filter);
+        }
+
+        eprint!("project number, text to filter by, or blank to quit: ");
+        std::io::stderr().flush()?;
+        let line = match lines.next() {
+            Some(line) => line.wrap_err("reading choice")?,
+            None => return Ok(()),
+        };
+        let line = line.trim();
+        if line.is_empty() {
+            return Ok(());
+        }
+
+        match line.parse::<usize>() {
+            Ok(n) if n >= 1 && n <= shown.len() => {
+                return open_project(cfg, args, state, shown[n - 1]);
+            }
+            Ok(n) => eprintln!("{} is not between 1 and {}", n, shown.len()),
+            Err(_) => filter = line.to_string(),
+        }
+    }
+}
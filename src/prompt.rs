@@ -0,0 +1,159 @@
+//! `project prompt`: the project a directory is in, for a shell prompt segment
+
+use eyre::{Result, WrapErr};
+use serde::{Deserialize, Serialize};
+use std::path::{Path, PathBuf};
+
+use crate::{
+    cache_file, index,
+    tmux::{self, SessionState},
+    usage::now,
+    Cache, ProjectPath,
+};
+
+/// How long an answer is reused for the same directory, as prompts are drawn
+/// again after every command
+const TTL_SECS: u64 = 3;
+
+/// The last answer, so redrawing the prompt in the same directory neither
+/// reads the cache nor runs tmux
+#[derive(Debug, Serialize, Deserialize)]
+struct Saved {
+    dir: PathBuf,
+    project: Option<ProjectPath>,
+    state: SessionState,
+    /// seconds since the unix epoch
+    at: u64,
+}
+
+fn saved_file() -> Result<PathBuf> {
+    Ok(cache_file()?.with_file_name("prompt.json"))
+}
+
+/// The saved answer for `dir`, unless it is too old or projects have been
+/// found since
+fn load(dir: &Path) -> Option<Saved> {
+    let saved: Saved =
+        serde_json::from_str(&std::fs::read_to_string(saved_file().ok()?).ok()?).ok()?;
+    let cache_modified = std::fs::metadata(cache_file().ok()?)
+        .and_then(|m| m.modified())
+        .ok()?
+        .duration_since(std::time::UNIX_EPOCH)
+        .ok()?
+        .as_secs();
+    (saved.dir == dir && now() < saved.at + TTL_SECS && cache_modified <= saved.at).then(|| saved)
+}
+
+fn save(saved: &Saved) {
+    let res = saved_file().and_then(|path| {
+        std::fs::write(path, serde_json::to_string(saved)?).wrap_err("writing prompt cache")
+    });
+    if let Err(e) = res {
+        log::debug!("saving prompt: {:?}", e);
+    }
+}
+
+/// The deepest cached project containing `dir`, from the index when it is up
+/// to date so that the cache is rarely read
+fn containing(dir: &Path) -> Result<Option<ProjectPath>> {
+    match index::containing(&cache_file()?, dir) {
+        index::Lookup::Found(project) => return Ok(Some(project)),
+        index::Lookup::Absent => return Ok(None),
+        index::Lookup::Unknown => {}
+    }
+    let cache = Cache::read_only().wrap_err("loading cache")?;
+    Ok(cache
+        .snapshot()
+        .paths
+        .into_iter()
+        .filter(|p| dir.starts_with(&p.full_path))
+        .max_by_key(|p| p.full_path.len()))
+}
+
+/// The directory the shell is in, keeping the path it was reached by through
+/// symlinks
+fn current_dir() -> Result<PathBuf> {
+    match std::env::var_os("PWD") {
+        Some(pwd) => Ok(PathBuf::from(pwd)),
+        None => std::env::current_dir().wrap_err("finding current directory"),
+    }
+}
+
+/// The project `dir` is in, trying the path as given and then with symlinks
+/// resolved
+fn project_for(dir: &Path) -> Result<Option<ProjectPath>> {
+    if let Some(project) = containing(dir)? {
+        return Ok(Some(project));
+    }
+    match std::fs::canonicalize(&dir) {
+        Ok(canonical) if canonical != *dir => containing(&canonical),
+        _ => Ok(None),
+    }
+}
+
+fn segment(project: &ProjectPath, state: SessionState) -> String {
+    match state {
+        SessionState::Absent => project.session_name.clone(),
+        SessionState::Detached => format!("{} (detached)", project.session_name),
+        SessionState::Attached => format!("{} (attached)", project.session_name),
+    }
+}
+
+/// A single line with a glyph for the session, as custom modules in
+/// starship and segments in powerlevel10k show their command's output as it
+/// is and hide themselves when it is empty
+fn starship_segment(project: &ProjectPath, state: SessionState) -> String {
+    match state {
+        SessionState::Absent => project.session_name.clone(),
+        SessionState::Detached => format!("○ {}", project.session_name),
+        SessionState::Attached => format!("● {}", project.session_name),
+    }
+}
+
+/// Print the project's name and whether its session is running, or nothing
+/// outside of projects. Answers are reused for a few seconds.
+pub(crate) fn run(dir: Option<PathBuf>, starship: bool) -> Result<()> {
+    let dir = match dir {
+        Some(dir) => dir,
+        None => current_dir()?,
+    };
+    let saved = match load(&dir) {
+        Some(saved) => saved,
+        None => {
+            let project = project_for(&dir)?;
+            let state = project.as_ref().map_or(SessionState::Absent, |p| {
+                tmux::session_state(&p.session_name)
+            });
+            let saved = Saved {
+                dir,
+                project,
+                state,
+                at: now(),
+            };
+            save(&saved);
+            saved
+        }
+    };
+    match (&saved.project, starship) {
+        (Some(project), true) => print!("{}", starship_segment(project, saved.state)),
+        (Some(project), false) => println!("{}", segment(project, saved.state)),
+        (None, _) => {}
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn segments() {
+        let project = ProjectPath {
+            full_path: "/work/api".to_string(),
+            session_name: "api".to_string(),
+        };
+        assert_eq!(segment(&project, SessionState::Absent), "api");
+        assert_eq!(segment(&project, SessionState::Attached), "api (attached)");
+        assert_eq!(starship_segment(&project, SessionState::Detached), "○ api");
+    }
+}
@@ -0,0 +1,61 @@
+//! Hide the values of secret looking variables, such as `GITHUB_TOKEN=...`,
+//! in commands printed by --dry-run and in logs so they can be shared
+
+use std::{borrow::Cow, sync::OnceLock};
+
+static PATTERNS: OnceLock<Vec<String>> = OnceLock::new();
+
+pub(crate) fn default_patterns() -> Vec<String> {
+    ["TOKEN", "SECRET", "KEY", "PASSWORD"]
+        .iter()
+        .map(|p| p.to_string())
+        .collect()
+}
+
+/// Use `patterns` rather than the defaults, from the config file
+pub(crate) fn init(patterns: Vec<String>) {
+    let _ = PATTERNS.set(patterns);
+}
+
+fn patterns() -> &'static [String] {
+    PATTERNS.get_or_init(default_patterns)
+}
+
+/// `arg` with the value hidden if it assigns a variable whose name contains
+/// one of the patterns, ignoring case
+pub(crate) fn arg(arg: &str) -> Cow<'_, str> {
+    redact_with(arg, patterns())
+}
+
+fn redact_with<'a>(arg: &'a str, patterns: &[String]) -> Cow<'a, str> {
+    let name = match arg.split_once('=') {
+        Some((name, _)) => name,
+        None => return Cow::Borrowed(arg),
+    };
+    let is_variable =
+        !name.is_empty() && name.chars().all(|c| c.is_ascii_alphanumeric() || c == '_');
+    let upper = name.to_uppercase();
+    if is_variable && patterns.iter().any(|p| upper.contains(&p.to_uppercase())) {
+        Cow::Owned(format!("{}=***", name))
+    } else {
+        Cow::Borrowed(arg)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn redaction() {
+        let patterns = default_patterns();
+        assert_eq!(
+            redact_with("GITHUB_TOKEN=abc", &patterns),
+            "GITHUB_TOKEN=***"
+        );
+        assert_eq!(redact_with("api_key=abc", &patterns), "api_key=***");
+        assert_eq!(redact_with("EDITOR=vim", &patterns), "EDITOR=vim");
+        assert_eq!(redact_with("--key=abc", &patterns), "--key=abc");
+        assert_eq!(redact_with("/tmp/secret", &patterns), "/tmp/secret");
+    }
+}
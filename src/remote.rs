@@ -0,0 +1,263 @@
+//! Roots on other machines or in containers, written `ssh:host:/path` where
+//! the host can be an alias from ~/.ssh/config, or `docker:container:/path`
+//! for a running container such as a devcontainer. Their projects are found
+//! by a single `find` run on the far side and streamed back as it goes,
+//! rather than a round trip per directory, and their sessions run a shell
+//! there.
+
+use std::{
+    io::{BufRead, BufReader, Read},
+    process::{Child, Command, Stdio},
+    thread::JoinHandle,
+};
+
+use crate::tmux::shell_quote;
+
+/// How to reach a remote location
+#[derive(Debug, PartialEq, Eq)]
+enum Transport {
+    Ssh(String),
+    Docker(String),
+}
+
+/// A root or project on another machine
+#[derive(Debug, PartialEq, Eq)]
+pub(crate) struct Location {
+    transport: Transport,
+    /// the absolute path on the far side
+    path: String,
+}
+
+/// The location `full_path` names, if it is a remote one
+pub(crate) fn parse(full_path: &str) -> Option<Location> {
+    let (kind, rest) = full_path.split_once(':')?;
+    let (name, path) = rest.split_once(':')?;
+    if name.is_empty() || !path.starts_with('/') {
+        return None;
+    }
+    let transport = match kind {
+        "ssh" => Transport::Ssh(name.to_string()),
+        "docker" => Transport::Docker(name.to_string()),
+        _ => return None,
+    };
+    Some(Location {
+        transport,
+        path: path.to_string(),
+    })
+}
+
+/// Whether `full_path` is on another machine or in a container, where
+/// nothing here can look at its files
+pub(crate) fn is_remote(full_path: &str) -> bool {
+    parse(full_path).is_some()
+}
+
+/// Finds the repositories below `path` like the local scan: hidden
+/// directories are skipped and a project is a directory holding `.git`
+fn find_script(path: &str, max_depth: Option<usize>) -> String {
+    let max_depth = max_depth
+        .map(|depth| format!(" -maxdepth {}", depth + 1))
+        .unwrap_or_default();
+    format!(
+        "find {} -mindepth 1{} \\( -type d -name .git -print -prune \\) -o \\( -name '.*' -prune \\) 2>/dev/null",
+        shell_quote(path),
+        max_depth
+    )
+}
+
+impl Location {
+    /// How full paths below this location start, e.g. "ssh:devbox:"
+    fn prefix(&self) -> String {
+        match &self.transport {
+            Transport::Ssh(host) => format!("ssh:{}:", host),
+            Transport::Docker(container) => format!("docker:{}:", container),
+        }
+    }
+
+    /// A command running `script` through a shell at the location
+    fn command(&self, script: &str) -> Command {
+        match &self.transport {
+            Transport::Ssh(host) => {
+                let mut cmd = Command::new("ssh");
+                // scans run behind the picker, where nobody can answer a
+                // password prompt
+                cmd.args(["-o", "BatchMode=yes", "-o", "ConnectTimeout=10", "--"])
+                    .arg(host)
+                    .arg(script);
+                cmd
+            }
+            Transport::Docker(container) => {
+                let mut cmd = Command::new("docker");
+                cmd.args(["exec", container, "sh", "-c", script]);
+                cmd
+            }
+        }
+    }
+
+    /// The command for a session's windows: a login shell in the project
+    /// directory at the location, `shell` or the user's own there
+    pub(crate) fn shell(&self, shell: Option<&str>) -> String {
+        let shell = shell.unwrap_or("\"${SHELL:-sh}\" -l");
+        match &self.transport {
+            Transport::Ssh(host) => {
+                let script = format!("cd {} && exec {}", shell_quote(&self.path), shell);
+                format!("ssh -t -- {} {}", shell_quote(host), shell_quote(&script))
+            }
+            // containers often have no SHELL set, leaving plain sh
+            Transport::Docker(container) => format!(
+                "docker exec -it -w {} {} sh -c {}",
+                shell_quote(&self.path),
+                shell_quote(container),
+                shell_quote(&format!("exec {}", shell))
+            ),
+        }
+    }
+
+    /// The full paths of the projects below this location, as the remote
+    /// `find` reports them
+    pub(crate) fn discover(&self, max_depth: Option<usize>) -> Walk {
+        let label = format!("{}{}", self.prefix(), self.path);
+        let child = self
+            .command(&find_script(&self.path, max_depth))
+            .stdin(Stdio::null())
+            .stdout(Stdio::piped())
+            .stderr(Stdio::piped())
+            .spawn();
+        let mut child = match child {
+            Ok(child) => Some(child),
+            Err(e) => {
+                log::warn!("scanning {}: {}", label, e);
+                None
+            }
+        };
+        let lines = child
+            .as_mut()
+            .and_then(|child| child.stdout.take())
+            .map(|stdout| BufReader::new(stdout).lines());
+        // read alongside stdout, so that a chatty remote cannot fill the
+        // stderr pipe and stall before finishing its output
+        let stderr = child
+            .as_mut()
+            .and_then(|child| child.stderr.take())
+            .map(|mut pipe| {
+                std::thread::spawn(move || {
+                    let mut stderr = String::new();
+                    let _ = pipe.read_to_string(&mut stderr);
+                    stderr
+                })
+            });
+        Walk {
+            prefix: self.prefix(),
+            label,
+            child,
+            lines,
+            stderr,
+        }
+    }
+}
+
+/// The project a line of `find` output names, e.g. "/srv/api/.git" under
+/// "ssh:devbox:" is "ssh:devbox:/srv/api"
+fn project_of(prefix: &str, line: &str) -> Option<String> {
+    let path = line.strip_suffix("/.git")?;
+    Some(format!("{}{}", prefix, path))
+}
+
+/// Projects streamed back from a remote `find`
+pub(crate) struct Walk {
+    prefix: String,
+    label: String,
+    child: Option<Child>,
+    lines: Option<std::io::Lines<BufReader<std::process::ChildStdout>>>,
+    stderr: Option<JoinHandle<String>>,
+}
+
+impl Walk {
+    /// Reap the remote command, reporting why it failed if it did
+    fn finish(&mut self) {
+        self.lines = None;
+        let mut child = match self.child.take() {
+            Some(child) => child,
+            None => return,
+        };
+        let status = child.wait();
+        let stderr = self
+            .stderr
+            .take()
+            .and_then(|reader| reader.join().ok())
+            .unwrap_or_default();
+        match status {
+            Ok(status) if status.success() => {}
+            // find exits non-zero over unreadable directories, which are
+            // only skipped, so just the connection failing is worth a warning
+            Ok(_) if stderr.trim().is_empty() => {}
+            Ok(status) => log::warn!("scanning {}: {}: {}", self.label, status, stderr.trim()),
+            Err(e) => log::warn!("scanning {}: {}", self.label, e),
+        }
+    }
+}
+
+impl Iterator for Walk {
+    type Item = String;
+
+    fn next(&mut self) -> Option<String> {
+        loop {
+            match self.lines.as_mut()?.next() {
+                Some(Ok(line)) => {
+                    if let Some(project) = project_of(&self.prefix, &line) {
+                        return Some(project);
+                    }
+                }
+                Some(Err(_)) | None => {
+                    self.finish();
+                    return None;
+                }
+            }
+        }
+    }
+}
+
+impl Drop for Walk {
+    fn drop(&mut self) {
+        // a scan which stops early leaves nothing running on the far side
+        if let Some(child) = self.child.as_mut() {
+            let _ = child.kill();
+        }
+        self.finish();
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn locations() {
+        let location = parse("ssh:devbox:/srv/work").unwrap();
+        assert_eq!(location.prefix(), "ssh:devbox:");
+        assert_eq!(parse("/srv/work"), None);
+        assert_eq!(parse("ftp:devbox:/srv/work"), None);
+        assert_eq!(parse("ssh:devbox:work"), None);
+        assert!(is_remote("docker:dev:/workspace"));
+        assert!(!is_remote("/srv/ssh:devbox:/work"));
+
+        assert_eq!(
+            find_script("/srv/my work", Some(2)),
+            "find '/srv/my work' -mindepth 1 -maxdepth 3 \\( -type d -name .git -print -prune \\) -o \\( -name '.*' -prune \\) 2>/dev/null"
+        );
+        assert_eq!(
+            project_of("ssh:devbox:", "/srv/work/api/.git").as_deref(),
+            Some("ssh:devbox:/srv/work/api")
+        );
+        assert_eq!(
+            parse("ssh:devbox:/srv/work/api").unwrap().shell(None),
+            "ssh -t -- devbox 'cd /srv/work/api && exec \"${SHELL:-sh}\" -l'"
+        );
+        assert_eq!(
+            parse("docker:dev:/workspace/api")
+                .unwrap()
+                .shell(Some("zsh")),
+            "docker exec -it -w /workspace/api dev sh -c 'exec zsh'"
+        );
+    }
+}
@@ -0,0 +1,156 @@
+//! `project --scan-report`: what a scan indexed, and what it skipped and why,
+//! to check that exclude rules, depth limits and ignore files do what was meant
+
+use eyre::Result;
+use std::{
+    collections::{BTreeMap, HashSet},
+    path::PathBuf,
+};
+
+use crate::{discover_projects, scan, state::State, Cache, Config, RootDir};
+
+/// Counts kept by every scan, which are cheap to collect
+#[derive(Debug, Default)]
+pub(crate) struct ScanReport {
+    /// projects found and kept, new or already cached
+    pub(crate) indexed: usize,
+    /// projects left out by each exclude pattern
+    pub(crate) excluded: BTreeMap<String, usize>,
+    /// projects left out for being in the archive root
+    pub(crate) archived: usize,
+    /// repositories reached a second time, through a symlink or another root
+    pub(crate) duplicates: usize,
+    /// filled in by [`run`] only, as it takes a second, slower walk
+    roots: Vec<RootReport>,
+}
+
+#[derive(Debug)]
+struct RootReport {
+    path: PathBuf,
+    max_depth: Option<usize>,
+    /// repositories one level deeper than max_depth
+    too_deep: usize,
+    /// repositories the scan did not see because of .gitignore, .ignore or
+    /// hidden directories
+    ignored: usize,
+}
+
+impl ScanReport {
+    pub(crate) fn exclude(&mut self, pattern: &str) {
+        *self.excluded.entry(pattern.to_string()).or_insert(0) += 1;
+    }
+}
+
+impl std::fmt::Display for ScanReport {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        writeln!(f, "indexed {} projects", self.indexed)?;
+        for (pattern, count) in &self.excluded {
+            writeln!(f, "skipped {} matching exclude rule {:?}", count, pattern)?;
+        }
+        if self.archived > 0 {
+            writeln!(f, "skipped {} in the archive", self.archived)?;
+        }
+        if self.duplicates > 0 {
+            writeln!(
+                f,
+                "skipped {} reached a second time, through a symlink or another root",
+                self.duplicates
+            )?;
+        }
+        for root in &self.roots {
+            if root.too_deep == 0 && root.ignored == 0 {
+                continue;
+            }
+            writeln!(f, "{}:", root.path.display())?;
+            if let (Some(max_depth), true) = (root.max_depth, root.too_deep > 0) {
+                writeln!(f, "  {} just below max_depth {}", root.too_deep, max_depth)?;
+            }
+            if root.ignored > 0 {
+                writeln!(
+                    f,
+                    "  {} hidden by ignore files or in hidden directories",
+                    root.ignored
+                )?;
+            }
+        }
+        Ok(())
+    }
+}
+
+/// Walk `dir` again without the usual filters and one level deeper, counting
+/// the repositories the scan missed
+fn unreached(dir: &RootDir, nested: Vec<PathBuf>, offline: bool) -> RootReport {
+    let seen: HashSet<PathBuf> = discover_projects(dir, nested.clone(), offline)
+        .map(|p| PathBuf::from(p.full_path))
+        .collect();
+    let mut report = RootReport {
+        path: dir.path.clone(),
+        max_depth: dir.max_depth,
+        too_deep: 0,
+        ignored: 0,
+    };
+    let walker = ignore::WalkBuilder::new(&dir.path)
+        .standard_filters(false)
+        .max_depth(dir.max_depth.map(|depth| depth + 1))
+        .filter_entry(move |e| e.file_name() != ".git" && !nested.iter().any(|n| n == e.path()))
+        .build();
+    for entry in walker.filter_map(|e| e.ok()) {
+        if !entry.path().join(".git").is_dir() || seen.contains(entry.path()) {
+            continue;
+        }
+        if dir.max_depth.map_or(false, |max| entry.depth() > max) {
+            report.too_deep += 1;
+        } else {
+            report.ignored += 1;
+        }
+    }
+    report
+}
+
+pub(crate) fn run(
+    cfg: &Config,
+    cache: &Cache,
+    state: &State,
+    all: bool,
+    offline: bool,
+) -> Result<()> {
+    let mut report = scan(cfg, cache, &cfg.scan_excludes(state, all), offline, |_| {});
+    for dir in cfg.roots_by_weight() {
+        report
+            .roots
+            .push(unreached(dir, cfg.nested_roots(dir), offline));
+    }
+    print!("{}", report);
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn summary() {
+        let mut report = ScanReport {
+            indexed: 12,
+            duplicates: 1,
+            ..Default::default()
+        };
+        report.exclude("node_modules");
+        report.exclude("node_modules");
+        report.roots.push(RootReport {
+            path: PathBuf::from("/work"),
+            max_depth: Some(2),
+            too_deep: 3,
+            ignored: 0,
+        });
+        assert_eq!(
+            report.to_string(),
+            "indexed 12 projects
+skipped 2 matching exclude rule \"node_modules\"
+skipped 1 reached a second time, through a symlink or another root
+/work:
+  3 just below max_depth 2
+"
+        );
+    }
+}
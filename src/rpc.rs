@@ -0,0 +1,233 @@
+//! Line delimited JSON-RPC 2.0 over stdin and stdout, so editor plugins can
+//! embed the switcher without parsing the text output of other commands
+//!
+//! Methods:
+//! - `list`: all projects, in picker order
+//! - `query` `{"query": "..."}`: projects whose path contains every term
+//! - `open` `{"path": "..."}`: open a project by path or session name
+//! - `addUsage` `{"path": "..."}`: record a project as just used
+
+use eyre::{Result, WrapErr};
+use serde::{Deserialize, Serialize};
+use serde_json::{json, Value};
+use std::{
+    fs::File,
+    io::{BufRead, BufReader, Write},
+    os::unix::io::{AsRawFd, FromRawFd},
+};
+
+use crate::{cached_projects, launch, state::State, Args, Cache, Config, ProjectPath};
+
+const PARSE_ERROR: i64 = -32700;
+const METHOD_NOT_FOUND: i64 = -32601;
+const INVALID_PARAMS: i64 = -32602;
+/// the request was understood but carrying it out failed
+const SERVER_ERROR: i64 = -32000;
+
+#[derive(Deserialize)]
+struct Request {
+    #[serde(default)]
+    id: Value,
+    method: String,
+    #[serde(default)]
+    params: Value,
+}
+
+#[derive(Serialize)]
+struct Response {
+    jsonrpc: &'static str,
+    id: Value,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    result: Option<Value>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    error: Option<RpcError>,
+}
+
+#[derive(Serialize)]
+struct RpcError {
+    code: i64,
+    message: String,
+}
+
+impl RpcError {
+    fn new(code: i64, message: impl Into<String>) -> Self {
+        Self {
+            code,
+            message: message.into(),
+        }
+    }
+}
+
+#[derive(Deserialize)]
+struct QueryParams {
+    query: String,
+}
+
+#[derive(Deserialize)]
+struct PathParams {
+    path: String,
+}
+
+/// Whether `full_path` contains every whitespace separated term of `query`,
+/// ignoring case
+fn matches_query(full_path: &str, query: &str) -> bool {
+    let full_path = full_path.to_lowercase();
+    query
+        .split_whitespace()
+        .all(|term| full_path.contains(&term.to_lowercase()))
+}
+
+struct Server<'a> {
+    cfg: &'a Config,
+    args: &'a Args,
+    cache: &'a Cache,
+    state: &'a State,
+}
+
+impl Server<'_> {
+    fn entry(&self, project: &ProjectPath) -> Value {
+        json!({
+            "path": project.full_path,
+            "session_name": project.session_name,
+            "pinned": self.state.is_pinned(&project.full_path),
+            "tags": self.state.tags(&project.full_path),
+        })
+    }
+
+    fn resolve(&self, params: Value) -> std::result::Result<ProjectPath, RpcError> {
+        let params: PathParams = serde_json::from_value(params)
+            .map_err(|e| RpcError::new(INVALID_PARAMS, e.to_string()))?;
+        self.cfg
+            .resolve(self.cache, &params.path)
+            .map_err(|e| RpcError::new(SERVER_ERROR, format!("{:#}", e)))
+    }
+
+    fn handle(&self, method: &str, params: Value) -> std::result::Result<Value, RpcError> {
+        match method {
+            "list" => {
+                let projects = cached_projects(self.cfg, self.cache, self.state, false);
+                Ok(projects.iter().map(|p| self.entry(p)).collect())
+            }
+            "query" => {
+                let params: QueryParams = serde_json::from_value(params)
+                    .map_err(|e| RpcError::new(INVALID_PARAMS, e.to_string()))?;
+                let projects = cached_projects(self.cfg, self.cache, self.state, false);
+                Ok(projects
+                    .iter()
+                    .filter(|p| matches_query(&p.full_path, &params.query))
+                    .map(|p| self.entry(p))
+                    .collect())
+            }
+            "open" => {
+                let project = self.resolve(params)?;
+                let launched = launch(self.cfg, self.args, self.state, &project, None)
+                    .map_err(|e| RpcError::new(SERVER_ERROR, format!("{:#}", e)))?;
+                self.save_usage(&project);
+                Ok(match launched {
+                    Some((outcome, session_name)) => json!({
+                        "outcome": outcome.describe(),
+                        "session_name": session_name,
+                    }),
+                    None => json!({ "outcome": "opener" }),
+                })
+            }
+            "addUsage" => {
+                let project = self.resolve(params)?;
+                self.state.touch(&project.full_path);
+                self.save_usage(&project);
+                Ok(Value::Null)
+            }
+            other => Err(RpcError::new(
+                METHOD_NOT_FOUND,
+                format!("unknown method {:?}", other),
+            )),
+        }
+    }
+
+    /// The state is shared with every other invocation for as long as the
+    /// server runs, so only what a request changed is saved
+    fn save_usage(&self, project: &ProjectPath) {
+        if let Err(e) = self.state.save_usage(&project.full_path) {
+            log::warn!("saving state: {:?}", e);
+        }
+    }
+
+    fn respond(&self, line: &str) -> Option<Response> {
+        let request: Request = match serde_json::from_str(line) {
+            Ok(request) => request,
+            Err(e) => {
+                return Some(Response {
+                    jsonrpc: "2.0",
+                    id: Value::Null,
+                    result: None,
+                    error: Some(RpcError::new(PARSE_ERROR, e.to_string())),
+                })
+            }
+        };
+        let outcome = self.handle(&request.method, request.params);
+        // requests without an id are notifications, which get no response
+        if request.id.is_null() {
+            return None;
+        }
+        let (result, error) = match outcome {
+            Ok(result) => (Some(result), None),
+            Err(error) => (None, Some(error)),
+        };
+        Some(Response {
+            jsonrpc: "2.0",
+            id: request.id,
+            result,
+            error,
+        })
+    }
+}
+
+/// Take the request and response streams off fds 0 and 1, leaving /dev/null
+/// and stderr in their place, so that openers, hooks and tmux started while
+/// serving can neither swallow requests nor write into responses
+fn take_stdio() -> Result<(File, File)> {
+    let null = File::open("/dev/null").wrap_err("opening /dev/null")?;
+    unsafe {
+        let input = libc::dup(0);
+        let output = libc::dup(1);
+        if input < 0 || output < 0 || libc::dup2(null.as_raw_fd(), 0) < 0 || libc::dup2(2, 1) < 0 {
+            return Err(std::io::Error::last_os_error()).wrap_err("redirecting stdio");
+        }
+        Ok((File::from_raw_fd(input), File::from_raw_fd(output)))
+    }
+}
+
+/// Serve requests, one per line, until stdin is closed
+pub(crate) fn run(cfg: &Config, args: &Args, cache: &Cache, state: &State) -> Result<()> {
+    let server = Server {
+        cfg,
+        args,
+        cache,
+        state,
+    };
+    let (input, mut output) = take_stdio()?;
+    for line in BufReader::new(input).lines() {
+        let line = line.wrap_err("reading request")?;
+        if line.trim().is_empty() {
+            continue;
+        }
+        if let Some(response) = server.respond(&line) {
+            let mut bytes = serde_json::to_vec(&response).wrap_err("encoding response")?;
+            bytes.push(b'\n');
+            output.write_all(&bytes).wrap_err("writing response")?;
+        }
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn query_terms() {
+        assert!(matches_query("/home/me/work/Billing-API", "work api"));
+        assert!(matches_query("/home/me/work/billing-api", ""));
+        assert!(!matches_query("/home/me/work/billing-api", "work frontend"));
+    }
+}
@@ -0,0 +1,145 @@
+use eyre::{Result, WrapErr};
+use std::{
+    path::{Path, PathBuf},
+    process::Command,
+};
+
+use serde::{Deserialize, Serialize};
+
+use crate::{tilde, tmux::Tmux, unique_session_name, Cache, Config, ProjectPath, RootDir};
+
+#[derive(Debug, Serialize, Deserialize)]
+pub(crate) struct Template {
+    name: String,
+    /// local directory or git repository to copy the project from
+    source: String,
+    /// shell commands run inside the new project once it has been created
+    #[serde(default)]
+    init: Vec<String>,
+}
+
+impl Template {
+    pub(crate) fn init(&self) -> &[String] {
+        &self.init
+    }
+}
+
+fn copy_dir(src: &Path, dst: &Path) -> Result<()> {
+    std::fs::create_dir_all(dst).wrap_err_with(|| format!("creating {}", dst.display()))?;
+    for entry in std::fs::read_dir(src).wrap_err_with(|| format!("reading {}", src.display()))? {
+        let entry = entry?;
+        if entry.file_name() == ".git" {
+            continue;
+        }
+        let target = dst.join(entry.file_name());
+        if entry.file_type()?.is_dir() {
+            copy_dir(&entry.path(), &target)?;
+        } else {
+            std::fs::copy(entry.path(), &target)
+                .wrap_err_with(|| format!("copying {}", entry.path().display()))?;
+        }
+    }
+    Ok(())
+}
+
+fn clone_template(url: &str, dst: &Path) -> Result<()> {
+    let status = Command::new("git")
+        .args(["clone", "--depth", "1", "--", url])
+        .arg(dst)
+        .status()
+        .wrap_err("running git clone")?;
+    if !status.success() {
+        eyre::bail!("cloning template {} failed: {}", url, status);
+    }
+    // the project starts its own history rather than continuing the template's
+    std::fs::remove_dir_all(dst.join(".git")).wrap_err("removing template history")?;
+    Ok(())
+}
+
+fn run_init(template: &Template, name: &str, dst: &Path) -> Result<()> {
+    for cmd in &template.init {
+        log::info!("running {:?} in {}", cmd, dst.display());
+        let status = Command::new("sh")
+            .arg("-c")
+            .arg(cmd)
+            .current_dir(dst)
+            .env("PROJECT_NAME", name)
+            .env("PROJECT_PATH", dst)
+            .status()
+            .wrap_err_with(|| format!("running {:?}", cmd))?;
+        if !status.success() {
+            eyre::bail!("init command {:?} failed: {}", cmd, status);
+        }
+    }
+    Ok(())
+}
+
+pub(crate) fn choose_root<'a>(cfg: &'a Config, root: Option<&Path>) -> Result<&'a RootDir> {
+    match root {
+        Some(root) => {
+            let root = tilde::expand(&root.to_string_lossy()).into_owned();
+            cfg.root_dirs
+                .iter()
+                .find(|dir| dir.path == PathBuf::from(&root))
+                .ok_or_else(|| eyre::eyre!("{} is not a configured root", root))
+        }
+        None => cfg
+            .root_dirs
+            .first()
+            .ok_or_else(|| eyre::eyre!("no root directories configured")),
+    }
+}
+
+pub(crate) fn run(
+    cfg: &Config,
+    cache: &Cache,
+    name: &str,
+    template_name: &str,
+    root: Option<&Path>,
+    offline: bool,
+) -> Result<()> {
+    let template = cfg
+        .templates
+        .iter()
+        .find(|t| t.name == template_name)
+        .ok_or_else(|| eyre::eyre!("no template named {:?}", template_name))?;
+    let root = choose_root(cfg, root)?;
+
+    let dst = root.path.join(name);
+    if dst.exists() {
+        eprintln!("{} already exists", dst.display());
+        crate::existed();
+        return Ok(());
+    }
+
+    let source = tilde::expand(&template.source).into_owned();
+    if Path::new(&source).is_dir() {
+        copy_dir(Path::new(&source), &dst).wrap_err("copying template")?;
+    } else if offline {
+        eyre::bail!(
+            "template {:?} is cloned from {}, which --offline does not allow",
+            template.name,
+            source
+        );
+    } else {
+        clone_template(&source, &dst).wrap_err("cloning template")?;
+    }
+    run_init(template, name, &dst).wrap_err("initialising project")?;
+
+    let full_path = dst.to_string_lossy().into_owned();
+    let session_name = root.session_name_for(&full_path);
+    let mut project = ProjectPath {
+        full_path,
+        session_name,
+    };
+    unique_session_name(&mut cache.session_names(), &mut project);
+    cache.add(project.clone());
+
+    let outcome = Tmux::new(&project)
+        .new_session_args(cfg.new_session_args(&project, &[]))
+        .on_existing(cfg.on_existing)
+        .create()
+        .wrap_err("creating tmux session")?;
+    outcome.report(&project.session_name);
+    Ok(())
+}
@@ -0,0 +1,81 @@
+//! API tokens for remote sources, kept out of the config file itself
+
+use eyre::{Result, WrapErr};
+use serde::{Deserialize, Serialize};
+use std::{collections::BTreeMap, process::Command};
+
+/// Where to find a token, e.g. `{ command = "pass show github/token" }`
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub(crate) enum Secret {
+    /// an environment variable
+    Env(String),
+    /// a shell command printing the token, such as a password manager
+    Command(String),
+    /// the system keyring: the macOS keychain or the freedesktop secret
+    /// service through secret-tool
+    Keyring { service: String, account: String },
+}
+
+fn stdout_of(cmd: &mut Command, what: &str) -> Result<String> {
+    let output = cmd.output().wrap_err_with(|| format!("running {}", what))?;
+    if !output.status.success() {
+        eyre::bail!(
+            "{} failed: {}",
+            what,
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    Ok(String::from_utf8_lossy(&output.stdout).trim().to_string())
+}
+
+impl Secret {
+    pub(crate) fn resolve(&self) -> Result<String> {
+        let token = match self {
+            Secret::Env(var) => std::env::var(var).wrap_err_with(|| format!("reading ${}", var))?,
+            Secret::Command(command) => stdout_of(
+                Command::new("sh").arg("-c").arg(command),
+                &format!("{:?}", command),
+            )?,
+            Secret::Keyring { service, account } if cfg!(target_os = "macos") => stdout_of(
+                Command::new("security").args([
+                    "find-generic-password",
+                    "-s",
+                    service,
+                    "-a",
+                    account,
+                    "-w",
+                ]),
+                "security find-generic-password",
+            )?,
+            Secret::Keyring { service, account } => stdout_of(
+                Command::new("secret-tool")
+                    .args(["lookup", "service", service, "account", account]),
+                "secret-tool lookup",
+            )?,
+        };
+        if token.is_empty() {
+            eyre::bail!("token is empty");
+        }
+        Ok(token)
+    }
+}
+
+/// `project tokens`: check each configured token can be found, without
+/// printing it
+pub(crate) fn check(tokens: &BTreeMap<String, Secret>) -> Result<()> {
+    let mut failed = false;
+    for (host, secret) in tokens {
+        match secret.resolve() {
+            Ok(token) => println!("{}: ok ({} characters)", host, token.len()),
+            Err(e) => {
+                failed = true;
+                println!("{}: {:#}", host, e);
+            }
+        }
+    }
+    if failed {
+        eyre::bail!("some tokens could not be read");
+    }
+    Ok(())
+}
@@ -0,0 +1,177 @@
+//! `project daemon install`: run the daemon as a user service so indexing
+//! survives reboots
+
+use eyre::{Result, WrapErr};
+use std::{
+    path::{Path, PathBuf},
+    process::Command,
+};
+
+/// Name of the systemd unit and the launchd label
+const SYSTEMD_UNIT: &str = "project-daemon.service";
+const LAUNCHD_LABEL: &str = "com.github.simonrw.project-daemon";
+
+fn systemd_unit(exe: &str, config: &Path) -> String {
+    format!(
+        "[Unit]\n\
+         Description=Keep the project picker's cache up to date\n\
+         \n\
+         [Service]\n\
+         ExecStart={} --config {} daemon\n\
+         Restart=on-failure\n\
+         \n\
+         [Install]\n\
+         WantedBy=default.target\n",
+        systemd_quote(exe),
+        systemd_quote(&config.to_string_lossy())
+    )
+}
+
+/// Quote an ExecStart argument, where systemd would otherwise split on spaces
+/// and expand `%` specifiers and `$` variables
+fn systemd_quote(arg: &str) -> String {
+    let escaped = arg
+        .replace('\\', "\\\\")
+        .replace('"', "\\\"")
+        .replace('%', "%%")
+        .replace('$', "$$");
+    format!("\"{}\"", escaped)
+}
+
+fn xml_escape(s: &str) -> String {
+    s.replace('&', "&amp;")
+        .replace('<', "&lt;")
+        .replace('>', "&gt;")
+}
+
+fn launchd_plist(exe: &str, config: &Path) -> String {
+    let args = [
+        exe.to_string(),
+        "--config".to_string(),
+        config.display().to_string(),
+        "daemon".to_string(),
+    ];
+    let args: String = args
+        .iter()
+        .map(|a| format!("        <string>{}</string>\n", xml_escape(a)))
+        .collect();
+    format!(
+        r#"<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+    <key>Label</key>
+    <string>{}</string>
+    <key>ProgramArguments</key>
+    <array>
+{}    </array>
+    <key>RunAtLoad</key>
+    <true/>
+    <key>KeepAlive</key>
+    <true/>
+</dict>
+</plist>
+"#,
+        LAUNCHD_LABEL, args
+    )
+}
+
+fn run_command(cmd: &mut Command, dry_run: bool) -> Result<()> {
+    if dry_run {
+        println!("{:?}", cmd);
+        return Ok(());
+    }
+    let status = cmd
+        .status()
+        .wrap_err_with(|| format!("running {:?}", cmd))?;
+    if !status.success() {
+        eyre::bail!("{:?} failed: {}", cmd, status);
+    }
+    Ok(())
+}
+
+fn write_file(path: &Path, contents: &str, dry_run: bool) -> Result<()> {
+    if dry_run {
+        println!("would write {}:\n{}", path.display(), contents);
+        return Ok(());
+    }
+    if let Some(dir) = path.parent() {
+        std::fs::create_dir_all(dir).wrap_err_with(|| format!("creating {}", dir.display()))?;
+    }
+    std::fs::write(path, contents).wrap_err_with(|| format!("writing {}", path.display()))?;
+    println!("wrote {}", path.display());
+    Ok(())
+}
+
+/// Write and enable a service running the daemon with `config`, printing it
+/// instead when `print` is set
+pub(crate) fn install(config: &Path, print: bool, dry_run: bool) -> Result<()> {
+    let exe = std::env::current_exe().wrap_err("finding path to this program")?;
+    let exe = exe.to_string_lossy();
+    // the service does not start from the current directory
+    let config = std::fs::canonicalize(config).unwrap_or_else(|_| config.to_path_buf());
+    let home = dirs::home_dir().unwrap_or_else(|| PathBuf::from("~"));
+
+    if cfg!(target_os = "macos") {
+        let plist = launchd_plist(&exe, &config);
+        if print {
+            print!("{}", plist);
+            return Ok(());
+        }
+        let path = home
+            .join("Library/LaunchAgents")
+            .join(format!("{}.plist", LAUNCHD_LABEL));
+        write_file(&path, &plist, dry_run)?;
+        run_command(
+            Command::new("launchctl").arg("load").arg("-w").arg(&path),
+            dry_run,
+        )
+    } else {
+        let unit = systemd_unit(&exe, &config);
+        if print {
+            print!("{}", unit);
+            return Ok(());
+        }
+        let path = dirs::config_dir()
+            .unwrap_or_else(|| home.join(".config"))
+            .join("systemd/user")
+            .join(SYSTEMD_UNIT);
+        write_file(&path, &unit, dry_run)?;
+        run_command(
+            Command::new("systemctl").args(["--user", "daemon-reload"]),
+            dry_run,
+        )?;
+        run_command(
+            Command::new("systemctl").args(["--user", "enable", "--now", SYSTEMD_UNIT]),
+            dry_run,
+        )
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn service_files() {
+        let unit = systemd_unit(
+            "/usr/bin/project",
+            Path::new("/home/me/.config/project/config.toml"),
+        );
+        assert!(unit.contains(
+            "ExecStart=\"/usr/bin/project\" --config \"/home/me/.config/project/config.toml\" daemon\n"
+        ));
+        let unit = systemd_unit(
+            "/home/me/my bin/project",
+            Path::new("/home/me/100%/$HOME/config.toml"),
+        );
+        assert!(unit.contains(
+            "ExecStart=\"/home/me/my bin/project\" --config \"/home/me/100%%/$$HOME/config.toml\" daemon\n"
+        ));
+
+        let plist = launchd_plist("/opt/a&b/project", Path::new("/c.toml"));
+        assert!(plist.contains(
+            "        <string>/opt/a&amp;b/project</string>\n        <string>--config</string>\n"
+        ));
+    }
+}
@@ -0,0 +1,95 @@
+use eyre::Result;
+
+use std::path::Path;
+
+use crate::{
+    confirm::confirm, duration::HumanDuration, remote, text, tmux, tmux::Tmux, usage, Cache,
+    Config, ProjectPath,
+};
+
+pub(crate) fn run(cache: &Cache) -> Result<()> {
+    let sessions = tmux::sessions()?;
+    let width = sessions
+        .iter()
+        .map(|s| text::width(&s.name))
+        .max()
+        .unwrap_or(0);
+    let projects = cache.initial_paths();
+    for session in sessions {
+        // sessions created before the option existed can still be matched by name
+        let project = session.project_path.or_else(|| {
+            projects
+                .iter()
+                .find(|p| p.session_name == session.name)
+                .map(|p| p.full_path.clone())
+        });
+        println!(
+            "{}  {}",
+            text::pad(&session.name, width),
+            project.as_deref().unwrap_or("unmanaged")
+        );
+    }
+    Ok(())
+}
+
+/// Kill the sessions of projects which are gone or have been idle for longer
+/// than `idle`, once the user agrees
+pub(crate) fn prune(
+    cfg: &Config,
+    idle: Option<HumanDuration>,
+    dry_run: bool,
+    yes: bool,
+) -> Result<()> {
+    let now = usage::now();
+    let mut doomed = Vec::new();
+    for session in tmux::sessions()? {
+        // only touch sessions this tool created
+        let full_path = match session.project_path {
+            Some(full_path) => full_path,
+            None => continue,
+        };
+
+        // there is no telling from here whether a remote project still exists
+        let reason = if !remote::is_remote(&full_path) && !Path::new(&full_path).is_dir() {
+            format!("{} no longer exists", full_path)
+        } else if let Some(idle) =
+            idle.filter(|idle| now.saturating_sub(session.activity) > idle.0.as_secs())
+        {
+            format!("idle for more than {}", idle)
+        } else {
+            continue;
+        };
+
+        let project = ProjectPath {
+            full_path,
+            session_name: session.name,
+        };
+        if cfg.is_protected(&project) {
+            log::debug!("keeping protected session {}", project.session_name);
+            continue;
+        }
+        doomed.push((project, reason));
+    }
+
+    if dry_run {
+        for (project, reason) in &doomed {
+            Tmux::new(project).dry_run(true).kill()?;
+            println!("would kill {}: {}", project.session_name, reason);
+        }
+        return Ok(());
+    }
+    if doomed.is_empty() {
+        return Ok(());
+    }
+    for (project, reason) in &doomed {
+        println!("{}: {}", project.session_name, reason);
+    }
+    if !confirm(&format!("kill {} sessions?", doomed.len()), yes)? {
+        return Ok(());
+    }
+    for (project, _) in &doomed {
+        Tmux::new(project).kill()?;
+        println!("killed {}", project.session_name);
+    }
+    Ok(())
+}
@@ -0,0 +1,107 @@
+//! Scripted control of long running processes without the socket: SIGUSR1
+//! rescans and SIGTERM saves before exiting
+
+use eyre::{Result, WrapErr};
+use signal_hook::consts::{SIGINT, SIGTERM, SIGUSR1};
+use std::{
+    fs::File,
+    io::Write,
+    os::unix::io::AsRawFd,
+    sync::{
+        atomic::{AtomicBool, Ordering},
+        Arc,
+    },
+};
+
+use crate::{exclude::Excludes, scan, state::State, Cache, Config};
+
+/// Signals noted for the daemon to act on between iterations of its loop
+pub(crate) struct Flags {
+    rescan: Arc<AtomicBool>,
+    terminate: Arc<AtomicBool>,
+}
+
+impl Flags {
+    pub(crate) fn register() -> Result<Self> {
+        let rescan = Arc::new(AtomicBool::new(false));
+        let terminate = Arc::new(AtomicBool::new(false));
+        signal_hook::flag::register(SIGUSR1, Arc::clone(&rescan)).wrap_err("handling SIGUSR1")?;
+        for signal in [SIGTERM, SIGINT] {
+            signal_hook::flag::register(signal, Arc::clone(&terminate))
+                .wrap_err("handling termination")?;
+        }
+        Ok(Self { rescan, terminate })
+    }
+
+    /// Whether a rescan was asked for since the last call
+    pub(crate) fn take_rescan(&self) -> bool {
+        self.rescan.swap(false, Ordering::Relaxed)
+    }
+
+    pub(crate) fn terminated(&self) -> bool {
+        self.terminate.load(Ordering::Relaxed)
+    }
+}
+
+/// The terminal as it was before the picker took it over
+struct Terminal {
+    tty: File,
+    termios: libc::termios,
+}
+
+impl Terminal {
+    fn save() -> Option<Self> {
+        let tty = std::fs::OpenOptions::new()
+            .read(true)
+            .write(true)
+            .open("/dev/tty")
+            .ok()?;
+        let mut termios: libc::termios = unsafe { std::mem::zeroed() };
+        let rc = unsafe { libc::tcgetattr(tty.as_raw_fd(), &mut termios) };
+        (rc == 0).then(|| Self { tty, termios })
+    }
+
+    /// Undo the picker's raw mode, alternate screen and hidden cursor, which
+    /// it would only do itself on its way out
+    fn restore(&mut self) {
+        let _ = self.tty.write_all(b"\x1b[?25h\x1b[?1049l");
+        let _ = self.tty.flush();
+        unsafe { libc::tcsetattr(self.tty.as_raw_fd(), libc::TCSANOW, &self.termios) };
+    }
+}
+
+/// Handle signals while the picker is open: SIGUSR1 rescans into the cache,
+/// which console mode shows on its next round, and SIGTERM saves the state
+/// and cache rather than losing changes made in this run. The picker cannot
+/// be told to stop, so the terminal is put back as it was before exiting.
+pub(crate) fn watch_picker(
+    cfg: Arc<Config>,
+    cache: Cache,
+    state: State,
+    excludes: Excludes,
+    offline: bool,
+) -> Result<()> {
+    let mut signals =
+        signal_hook::iterator::Signals::new([SIGUSR1, SIGTERM]).wrap_err("handling signals")?;
+    // taken now, before the picker starts
+    let mut terminal = Terminal::save();
+    std::thread::spawn(move || {
+        for signal in signals.forever() {
+            if signal == SIGUSR1 {
+                scan(&cfg, &cache, &excludes, offline, |_| {});
+                continue;
+            }
+            if let Some(terminal) = &mut terminal {
+                terminal.restore();
+            }
+            if let Err(e) = state.write() {
+                log::warn!("saving state: {:?}", e);
+            }
+            if let Err(e) = cache.write() {
+                log::warn!("saving cache: {:?}", e);
+            }
+            std::process::exit(128 + signal);
+        }
+    });
+    Ok(())
+}
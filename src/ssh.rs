@@ -0,0 +1,134 @@
+//! Hosts from ~/.ssh/config. Going through an alias rather than the real
+//! host name lets ssh apply its identity, port and ProxyJump settings.
+
+use std::collections::BTreeMap;
+
+/// A `Host` entry naming a single host, and the `HostName` it connects to
+#[derive(Debug, PartialEq, Eq)]
+pub(crate) struct Host {
+    pub(crate) alias: String,
+    pub(crate) hostname: Option<String>,
+}
+
+/// The `Host` entries of an ssh config file. Patterns such as `*.internal`
+/// name no single host and are left out, as are `Match` blocks and included
+/// files.
+fn parse(config: &str) -> Vec<Host> {
+    let mut hosts: Vec<Host> = Vec::new();
+    // how many entries at the end of `hosts` the current block applies to
+    let mut current = 0;
+    for line in config.lines() {
+        let line = line.trim();
+        if line.is_empty() || line.starts_with('#') {
+            continue;
+        }
+        let (keyword, value) = match line.split_once(|c: char| c.is_whitespace() || c == '=') {
+            Some((keyword, value)) => (keyword, value.trim_start_matches(['=', ' ', '\t'])),
+            None => (line, ""),
+        };
+        match keyword.to_ascii_lowercase().as_str() {
+            "host" => {
+                let before = hosts.len();
+                hosts.extend(
+                    value
+                        .split_whitespace()
+                        .filter(|alias| !alias.contains(['*', '?', '!']))
+                        .map(|alias| Host {
+                            alias: alias.to_string(),
+                            hostname: None,
+                        }),
+                );
+                current = hosts.len() - before;
+            }
+            "match" => current = 0,
+            "hostname" => {
+                let start = hosts.len() - current;
+                for host in &mut hosts[start..] {
+                    host.hostname.get_or_insert_with(|| value.to_string());
+                }
+            }
+            _ => {}
+        }
+    }
+    hosts
+}
+
+/// The hosts in the user's ssh config file
+pub(crate) fn hosts() -> Vec<Host> {
+    dirs::home_dir()
+        .and_then(|home| std::fs::read_to_string(home.join(".ssh").join("config")).ok())
+        .map(|config| parse(&config))
+        .unwrap_or_default()
+}
+
+/// Aliases in the ssh config which connect to `hostname`
+pub(crate) fn aliases_for<'a>(hosts: &'a [Host], hostname: &str) -> Vec<&'a str> {
+    hosts
+        .iter()
+        .filter(|host| host.alias != hostname && host.hostname.as_deref() == Some(hostname))
+        .map(|host| host.alias.as_str())
+        .collect()
+}
+
+/// `url` going through the alias `aliases` gives for its host, for
+/// `user@host:path` and `ssh://user@host/path` URLs. Other URLs, such as
+/// HTTPS ones, do not use ssh and are left alone.
+pub(crate) fn with_alias(url: &str, aliases: &BTreeMap<String, String>) -> String {
+    let (scheme, rest) = match url.strip_prefix("ssh://") {
+        Some(rest) => ("ssh://", rest),
+        None if url.contains("://") => return url.to_string(),
+        None => ("", url),
+    };
+    let (user, rest) = match rest.split_once('@') {
+        Some((user, rest)) if !user.contains(['/', ':']) => (Some(user), rest),
+        _ => (None, rest),
+    };
+    let end = rest.find([':', '/']).unwrap_or(rest.len());
+    let (host, path) = rest.split_at(end);
+    match aliases.get(host) {
+        Some(alias) => format!(
+            "{}{}{}{}",
+            scheme,
+            user.map(|user| format!("{}@", user)).unwrap_or_default(),
+            alias,
+            path
+        ),
+        None => url.to_string(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn aliases() {
+        let hosts = parse(
+            "# work account\nHost github-work gh-work\n  HostName github.com\n  IdentityFile ~/.ssh/work\n\nHost *.internal\n  ProxyJump bastion\n\nHost bastion\nHostName=bastion.example.com\n",
+        );
+        assert_eq!(
+            aliases_for(&hosts, "github.com"),
+            vec!["github-work", "gh-work"]
+        );
+        assert_eq!(hosts[2].hostname.as_deref(), Some("bastion.example.com"));
+
+        let aliases: BTreeMap<String, String> =
+            [("github.com".to_string(), "github-work".to_string())].into();
+        assert_eq!(
+            with_alias("git@github.com:team/api.git", &aliases),
+            "git@github-work:team/api.git"
+        );
+        assert_eq!(
+            with_alias("ssh://git@github.com:22/team/api.git", &aliases),
+            "ssh://git@github-work:22/team/api.git"
+        );
+        assert_eq!(
+            with_alias("https://github.com/team/api.git", &aliases),
+            "https://github.com/team/api.git"
+        );
+        assert_eq!(
+            with_alias("git@gitlab.com:team/api.git", &aliases),
+            "git@gitlab.com:team/api.git"
+        );
+    }
+}
@@ -0,0 +1,608 @@
+use eyre::{Result, WrapErr};
+use std::{
+    collections::{BTreeMap, BTreeSet},
+    path::{Path, PathBuf},
+    sync::{Arc, RwLock},
+};
+
+use serde::{Deserialize, Serialize};
+
+/// User data which, unlike the cache, cannot be rebuilt by rescanning
+#[derive(Debug)]
+pub(crate) struct State {
+    inner: Arc<RwLock<StateInner>>,
+    /// where the state is saved, `None` when opened read only
+    loc: Option<PathBuf>,
+    /// whether this is the instance from [`State::open`], which saves on drop
+    owner: bool,
+}
+
+impl Clone for State {
+    fn clone(&self) -> Self {
+        Self {
+            inner: Arc::clone(&self.inner),
+            loc: self.loc.clone(),
+            owner: false,
+        }
+    }
+}
+
+/// How many picker queries are remembered
+const MAX_QUERIES: usize = 50;
+
+/// Sorted collections keep the file stable between writes, so that copies
+/// synced between machines diff and merge cleanly
+#[derive(Debug, Default, Clone, Deserialize, Serialize)]
+pub(crate) struct StateInner {
+    #[serde(default)]
+    notes: BTreeMap<String, String>,
+    #[serde(default)]
+    tags: BTreeMap<String, Vec<String>>,
+    /// projects left out of the picker
+    #[serde(default)]
+    hidden: BTreeSet<String>,
+    /// projects listed before everything else in the picker
+    #[serde(default)]
+    pinned: BTreeSet<String>,
+    /// commands used to open projects instead of a tmux session
+    #[serde(default)]
+    openers: BTreeMap<String, String>,
+    /// when each project was last opened, in seconds since the unix epoch
+    #[serde(default)]
+    last_used: BTreeMap<String, u64>,
+    /// the project last switched to, for time tracking
+    #[serde(default)]
+    current: Option<crate::tracking::Current>,
+    /// seconds of activity per project per UTC day, from `project track`
+    #[serde(default)]
+    time_spent: BTreeMap<String, BTreeMap<String, u64>>,
+    /// the latest activity `project track` has seen in each session
+    #[serde(default)]
+    last_activity: BTreeMap<String, u64>,
+    /// paths and globs added with `project ignore`
+    #[serde(default)]
+    ignored: Vec<String>,
+    /// recent picker queries, oldest first
+    #[serde(default)]
+    queries: Vec<String>,
+    /// switches between projects keyed by tmux client, for `project back`
+    #[serde(default)]
+    history: BTreeMap<String, crate::history::History>,
+    /// recent changes for `project undo`, oldest first
+    #[serde(default)]
+    undo: Vec<crate::undo::Mutation>,
+    /// when each note, tag list, opener, hide, pin and ignore pattern was
+    /// last set or removed, keyed by kind and then path, so that merging can
+    /// tell a removal here from an entry this machine has not seen yet
+    #[serde(default)]
+    changed: BTreeMap<String, u64>,
+}
+
+/// The key in [`StateInner::changed`] for an entry of `kind`
+fn change_key(kind: &str, key: &str) -> String {
+    format!("{} {}", kind, key)
+}
+
+/// Which of two machines changed an entry last: `Some(true)` for theirs,
+/// `Some(false)` for ours, including ties, and `None` when neither recorded
+/// a change, as with files written before changes were recorded
+fn theirs_newer(
+    ours: &BTreeMap<String, u64>,
+    theirs: &BTreeMap<String, u64>,
+    key: &str,
+) -> Option<bool> {
+    match (ours.get(key), theirs.get(key)) {
+        (None, None) => None,
+        (ours, theirs) => Some(theirs > ours),
+    }
+}
+
+/// Merge one kind of entry, the most recent change winning whether it set
+/// or removed the entry. Without a recorded change ours is kept if we have
+/// it and theirs added otherwise.
+fn merge_entries<V>(
+    kind: &str,
+    ours: &mut BTreeMap<String, V>,
+    mut theirs: BTreeMap<String, V>,
+    our_changes: &BTreeMap<String, u64>,
+    their_changes: &BTreeMap<String, u64>,
+) {
+    let keys: BTreeSet<String> = ours.keys().chain(theirs.keys()).cloned().collect();
+    for key in keys {
+        match theirs_newer(our_changes, their_changes, &change_key(kind, &key)) {
+            Some(true) => match theirs.remove(&key) {
+                Some(value) => {
+                    ours.insert(key, value);
+                }
+                None => {
+                    ours.remove(&key);
+                }
+            },
+            Some(false) => {}
+            None => {
+                if let Some(value) = theirs.remove(&key) {
+                    ours.entry(key).or_insert(value);
+                }
+            }
+        }
+    }
+}
+
+/// Sets and lists as maps, for [`merge_entries`]
+fn keyed<I: IntoIterator<Item = String>>(keys: I) -> BTreeMap<String, ()> {
+    keys.into_iter().map(|key| (key, ())).collect()
+}
+
+impl StateInner {
+    /// Fold in the state from another machine. Notes, tags, openers, hidden
+    /// and pinned projects and ignore patterns take whichever machine changed
+    /// them last, so removals such as unpinning carry over too; the later
+    /// time or the larger time spent is kept.
+    pub(crate) fn merge(&mut self, other: StateInner) {
+        let (ours, theirs) = (&self.changed, &other.changed);
+        merge_entries("notes", &mut self.notes, other.notes, ours, theirs);
+        merge_entries("tags", &mut self.tags, other.tags, ours, theirs);
+        merge_entries("openers", &mut self.openers, other.openers, ours, theirs);
+        for (kind, set, other_set) in [
+            ("hidden", &mut self.hidden, other.hidden),
+            ("pinned", &mut self.pinned, other.pinned),
+        ] {
+            let mut merged = keyed(std::mem::take(set));
+            merge_entries(kind, &mut merged, keyed(other_set), ours, theirs);
+            *set = merged.into_keys().collect();
+        }
+        let mut ignored = keyed(self.ignored.iter().cloned());
+        let their_ignored = keyed(other.ignored.iter().cloned());
+        merge_entries("ignored", &mut ignored, their_ignored, ours, theirs);
+        // ours keep their order, followed by theirs
+        self.ignored.retain(|p| ignored.contains_key(p));
+        for pattern in other.ignored {
+            if ignored.contains_key(&pattern) && !self.ignored.contains(&pattern) {
+                self.ignored.push(pattern);
+            }
+        }
+        for (key, at) in other.changed {
+            let changed = self.changed.entry(key).or_default();
+            *changed = (*changed).max(at);
+        }
+        for (full_path, at) in other.last_used {
+            let last_used = self.last_used.entry(full_path).or_default();
+            *last_used = (*last_used).max(at);
+        }
+        for (full_path, days) in other.time_spent {
+            let ours = self.time_spent.entry(full_path).or_default();
+            for (day, secs) in days {
+                let spent = ours.entry(day).or_default();
+                *spent = (*spent).max(secs);
+            }
+        }
+        // there is no telling whose queries are more recent, so the other
+        // machine's go before ours
+        let mut queries = other.queries;
+        queries.retain(|q| !self.queries.contains(q));
+        queries.append(&mut self.queries);
+        self.queries = queries;
+        let excess = self.queries.len().saturating_sub(MAX_QUERIES);
+        self.queries.drain(..excess);
+    }
+
+    /// Rewrite every project path with `f`. The current project, session
+    /// activity, switch history and changes to undo belong to this machine
+    /// and are dropped.
+    pub(crate) fn map_paths<F>(self, f: F) -> Self
+    where
+        F: Fn(&str) -> String,
+    {
+        fn keys<V, F: Fn(&str) -> String>(map: BTreeMap<String, V>, f: &F) -> BTreeMap<String, V> {
+            map.into_iter().map(|(k, v)| (f(&k), v)).collect()
+        }
+        StateInner {
+            notes: keys(self.notes, &f),
+            tags: keys(self.tags, &f),
+            hidden: self.hidden.iter().map(|p| f(p)).collect(),
+            pinned: self.pinned.iter().map(|p| f(p)).collect(),
+            openers: keys(self.openers, &f),
+            last_used: keys(self.last_used, &f),
+            current: None,
+            time_spent: keys(self.time_spent, &f),
+            last_activity: BTreeMap::new(),
+            ignored: self.ignored.iter().map(|p| f(p)).collect(),
+            queries: self.queries,
+            history: BTreeMap::new(),
+            undo: Vec::new(),
+            changed: self
+                .changed
+                .into_iter()
+                .map(|(key, at)| match key.split_once(' ') {
+                    Some((kind, path)) => (change_key(kind, &f(path)), at),
+                    None => (key, at),
+                })
+                .collect(),
+        }
+    }
+
+    /// Record that the `kind` entry for `key` has just been set or removed
+    fn mark(&mut self, kind: &str, key: &str) {
+        self.changed
+            .insert(change_key(kind, key), crate::usage::now());
+    }
+}
+
+pub(crate) fn state_file() -> Result<PathBuf> {
+    let data_dir = dirs::data_dir()
+        .unwrap_or_else(|| PathBuf::from("~/.local/share"))
+        .join("project");
+    std::fs::create_dir_all(&data_dir).wrap_err("creating data directory")?;
+    Ok(data_dir.join("state.json"))
+}
+
+fn read_file(loc: &Path) -> Result<StateInner> {
+    match crate::storage::read(loc) {
+        Ok(txt) => serde_json::from_str(&txt).wrap_err("parsing state file"),
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => Ok(StateInner::default()),
+        Err(e) => Err(eyre::eyre!("IO error: {:?}", e)),
+    }
+}
+
+impl State {
+    pub(crate) fn open() -> Result<Self> {
+        let loc = state_file()?;
+        let inner = read_file(&loc)?;
+        Ok(Self {
+            inner: Arc::new(RwLock::new(inner)),
+            loc: Some(loc),
+            owner: true,
+        })
+    }
+
+    /// Open the state for reading only, for long running processes which
+    /// should not overwrite changes made while they run and for `--read-only`.
+    /// Changes are kept in memory but never saved.
+    pub(crate) fn open_read_only() -> Result<Self> {
+        let mut state = Self::open()?;
+        state.loc = None;
+        state.owner = false;
+        Ok(state)
+    }
+
+    /// Open the state for a long running process which saves only what it
+    /// changes, through methods such as [`State::save_usage`], leaving the
+    /// rest of the file as other processes saved it in the meantime
+    pub(crate) fn open_shared() -> Result<Self> {
+        let mut state = Self::open()?;
+        state.owner = false;
+        Ok(state)
+    }
+
+    pub(crate) fn write(&self) -> Result<()> {
+        let loc = match &self.loc {
+            Some(loc) => loc,
+            None => return Ok(()),
+        };
+        let _file_lock = crate::storage::lock(loc)?;
+        let lock = self.inner.read().unwrap();
+        crate::storage::write(loc, &*lock).wrap_err("writing state file")
+    }
+
+    /// Read the state file, change it with `f` and write it back, holding
+    /// the file lock throughout
+    fn update_saved<F: FnOnce(&mut StateInner)>(&self, f: F) -> Result<()> {
+        let loc = match &self.loc {
+            Some(loc) => loc,
+            None => return Ok(()),
+        };
+        let _file_lock = crate::storage::lock(loc)?;
+        let mut saved = read_file(loc)?;
+        f(&mut saved);
+        crate::storage::write(loc, &saved).wrap_err("writing state file")
+    }
+
+    /// Save session activity and the time spent in each project, which only
+    /// ever grow, so that a sample saved meanwhile by another `project track`
+    /// is kept if it got further
+    pub(crate) fn save_activity(&self) -> Result<()> {
+        let (time_spent, last_activity) = {
+            let lock = self.inner.read().unwrap();
+            (lock.time_spent.clone(), lock.last_activity.clone())
+        };
+        self.update_saved(|saved| {
+            for (full_path, days) in time_spent {
+                let spent = saved.time_spent.entry(full_path).or_default();
+                for (day, secs) in days {
+                    let total = spent.entry(day).or_default();
+                    *total = (*total).max(secs);
+                }
+            }
+            for (session_name, at) in last_activity {
+                let latest = saved.last_activity.entry(session_name).or_default();
+                *latest = (*latest).max(at);
+            }
+        })
+    }
+
+    /// Save when `full_path` was last used and the current project
+    pub(crate) fn save_usage(&self, full_path: &str) -> Result<()> {
+        let (last_used, current) = {
+            let lock = self.inner.read().unwrap();
+            (lock.last_used.get(full_path).copied(), lock.current.clone())
+        };
+        self.update_saved(|saved| {
+            if let Some(at) = last_used {
+                saved.last_used.insert(full_path.to_string(), at);
+            }
+            if current.is_some() {
+                saved.current = current;
+            }
+        })
+    }
+
+    pub(crate) fn snapshot(&self) -> StateInner {
+        self.inner.read().unwrap().clone()
+    }
+
+    pub(crate) fn merge(&self, other: StateInner) {
+        self.inner.write().unwrap().merge(other);
+    }
+
+    pub(crate) fn has_notes(&self) -> bool {
+        !self.inner.read().unwrap().notes.is_empty()
+    }
+
+    pub(crate) fn note(&self, full_path: &str) -> Option<String> {
+        self.inner.read().unwrap().notes.get(full_path).cloned()
+    }
+
+    /// Attach a note to a project, or remove its note if `note` is empty
+    pub(crate) fn set_note(&self, full_path: &str, note: &str) {
+        let mut lock = self.inner.write().unwrap();
+        lock.mark("notes", full_path);
+        if note.is_empty() {
+            lock.notes.remove(full_path);
+        } else {
+            lock.notes.insert(full_path.to_string(), note.to_string());
+        }
+    }
+
+    pub(crate) fn tags(&self, full_path: &str) -> Vec<String> {
+        let lock = self.inner.read().unwrap();
+        lock.tags.get(full_path).cloned().unwrap_or_default()
+    }
+
+    pub(crate) fn set_tags(&self, full_path: &str, tags: Vec<String>) {
+        let mut lock = self.inner.write().unwrap();
+        lock.mark("tags", full_path);
+        if tags.is_empty() {
+            lock.tags.remove(full_path);
+        } else {
+            lock.tags.insert(full_path.to_string(), tags);
+        }
+    }
+
+    pub(crate) fn hide(&self, full_path: &str) {
+        let mut lock = self.inner.write().unwrap();
+        lock.mark("hidden", full_path);
+        lock.hidden.insert(full_path.to_string());
+    }
+
+    pub(crate) fn unhide(&self, full_path: &str) {
+        let mut lock = self.inner.write().unwrap();
+        lock.mark("hidden", full_path);
+        lock.hidden.remove(full_path);
+    }
+
+    pub(crate) fn is_hidden(&self, full_path: &str) -> bool {
+        self.inner.read().unwrap().hidden.contains(full_path)
+    }
+
+    pub(crate) fn is_pinned(&self, full_path: &str) -> bool {
+        self.inner.read().unwrap().pinned.contains(full_path)
+    }
+
+    pub(crate) fn opener(&self, full_path: &str) -> Option<String> {
+        self.inner.read().unwrap().openers.get(full_path).cloned()
+    }
+
+    /// Open a project with `opener` from now on, or go back to the config
+    /// file's choice if `opener` is empty
+    pub(crate) fn set_opener(&self, full_path: &str, opener: &str) {
+        let mut lock = self.inner.write().unwrap();
+        lock.mark("openers", full_path);
+        if opener.is_empty() {
+            lock.openers.remove(full_path);
+        } else {
+            lock.openers
+                .insert(full_path.to_string(), opener.to_string());
+        }
+    }
+
+    pub(crate) fn last_used(&self, full_path: &str) -> u64 {
+        let lock = self.inner.read().unwrap();
+        lock.last_used.get(full_path).copied().unwrap_or(0)
+    }
+
+    /// Count a project as used at `at` unless it has been used since, for
+    /// history imported from other tools
+    pub(crate) fn seed_last_used(&self, full_path: &str, at: u64) {
+        let mut lock = self.inner.write().unwrap();
+        let last_used = lock.last_used.entry(full_path.to_string()).or_default();
+        *last_used = (*last_used).max(at);
+    }
+
+    /// Record that a project has just been opened
+    pub(crate) fn touch(&self, full_path: &str) {
+        let mut lock = self.inner.write().unwrap();
+        lock.last_used
+            .insert(full_path.to_string(), crate::usage::now());
+    }
+
+    pub(crate) fn current(&self) -> Option<crate::tracking::Current> {
+        self.inner.read().unwrap().current.clone()
+    }
+
+    pub(crate) fn set_current(&self, current: crate::tracking::Current) {
+        self.inner.write().unwrap().current = Some(current);
+    }
+
+    pub(crate) fn last_activity(&self, session_name: &str) -> Option<u64> {
+        let lock = self.inner.read().unwrap();
+        lock.last_activity.get(session_name).copied()
+    }
+
+    pub(crate) fn record_activity(&self, session_name: &str, at: u64) {
+        let mut lock = self.inner.write().unwrap();
+        lock.last_activity.insert(session_name.to_string(), at);
+    }
+
+    pub(crate) fn add_time(&self, full_path: &str, day: &str, secs: u64) {
+        let mut lock = self.inner.write().unwrap();
+        *lock
+            .time_spent
+            .entry(full_path.to_string())
+            .or_default()
+            .entry(day.to_string())
+            .or_default() += secs;
+    }
+
+    /// Seconds spent per day, keyed by project path
+    pub(crate) fn time_spent(&self) -> BTreeMap<String, BTreeMap<String, u64>> {
+        self.inner.read().unwrap().time_spent.clone()
+    }
+
+    pub(crate) fn ignored(&self) -> Vec<String> {
+        self.inner.read().unwrap().ignored.clone()
+    }
+
+    pub(crate) fn ignore(&self, pattern: &str) {
+        let mut lock = self.inner.write().unwrap();
+        lock.mark("ignored", pattern);
+        if !lock.ignored.iter().any(|p| p == pattern) {
+            lock.ignored.push(pattern.to_string());
+        }
+    }
+
+    /// Stop ignoring `pattern`, returning whether it was ignored
+    pub(crate) fn unignore(&self, pattern: &str) -> bool {
+        let mut lock = self.inner.write().unwrap();
+        lock.mark("ignored", pattern);
+        let before = lock.ignored.len();
+        lock.ignored.retain(|p| p != pattern);
+        lock.ignored.len() != before
+    }
+
+    pub(crate) fn queries(&self) -> Vec<String> {
+        self.inner.read().unwrap().queries.clone()
+    }
+
+    /// Remember a picker query, moving it to the end if it was used before
+    pub(crate) fn record_query(&self, query: &str) {
+        let query = query.trim();
+        if query.is_empty() {
+            return;
+        }
+        let mut lock = self.inner.write().unwrap();
+        lock.queries.retain(|q| q != query);
+        lock.queries.push(query.to_string());
+        let excess = lock.queries.len().saturating_sub(MAX_QUERIES);
+        lock.queries.drain(..excess);
+    }
+
+    pub(crate) fn history(&self, client: &str) -> crate::history::History {
+        let lock = self.inner.read().unwrap();
+        lock.history.get(client).cloned().unwrap_or_default()
+    }
+
+    pub(crate) fn update_history<F>(&self, client: &str, f: F)
+    where
+        F: FnOnce(&mut crate::history::History),
+    {
+        let mut lock = self.inner.write().unwrap();
+        f(lock.history.entry(client.to_string()).or_default());
+    }
+
+    pub(crate) fn push_undo(&self, mutation: crate::undo::Mutation) {
+        let mut lock = self.inner.write().unwrap();
+        lock.undo.push(mutation);
+        let excess = lock.undo.len().saturating_sub(crate::undo::MAX_UNDO);
+        lock.undo.drain(..excess);
+    }
+
+    pub(crate) fn pop_undo(&self) -> Option<crate::undo::Mutation> {
+        self.inner.write().unwrap().undo.pop()
+    }
+
+    pub(crate) fn toggle_pin(&self, full_path: &str) {
+        let mut lock = self.inner.write().unwrap();
+        lock.mark("pinned", full_path);
+        if !lock.pinned.remove(full_path) {
+            lock.pinned.insert(full_path.to_string());
+        }
+    }
+}
+
+impl Drop for State {
+    fn drop(&mut self) {
+        // picker entries and background threads hold clones which may outlive
+        // the one opened in main, so only that one saves
+        if !self.owner {
+            return;
+        }
+        if let Err(e) = self.write() {
+            log::warn!("saving state: {:?}", e);
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn merging() {
+        let mut ours = StateInner::default();
+        ours.notes.insert("/a".to_string(), "ours".to_string());
+        ours.pinned.insert("/a".to_string());
+        ours.last_used.insert("/a".to_string(), 10);
+        ours.ignored.push("vendor".to_string());
+        ours.queries = vec!["api".to_string(), "web".to_string()];
+
+        let mut theirs = StateInner::default();
+        theirs.notes.insert("/a".to_string(), "theirs".to_string());
+        theirs.notes.insert("/b".to_string(), "theirs".to_string());
+        theirs.pinned.insert("/b".to_string());
+        theirs.last_used.insert("/a".to_string(), 20);
+        theirs.ignored.push("vendor".to_string());
+        theirs.ignored.push("scratch".to_string());
+        theirs.queries = vec!["web".to_string(), "infra".to_string()];
+
+        ours.merge(theirs);
+        assert_eq!(ours.notes["/a"], "ours");
+        assert_eq!(ours.notes["/b"], "theirs");
+        assert_eq!(ours.pinned.len(), 2);
+        assert_eq!(ours.last_used["/a"], 20);
+        assert_eq!(ours.ignored, vec!["vendor", "scratch"]);
+        assert_eq!(ours.queries, vec!["infra", "api", "web"]);
+    }
+
+    #[test]
+    fn merging_removals() {
+        let mut theirs = StateInner::default();
+        theirs.pinned.insert("/a".to_string());
+        theirs.pinned.insert("/b".to_string());
+        theirs.ignored.push("vendor".to_string());
+
+        // this machine synced the pins, then unpinned /a
+        let mut ours = theirs.clone();
+        ours.pinned.remove("/a");
+        ours.mark("pinned", "/a");
+        ours.merge(theirs.clone());
+        assert_eq!(ours.pinned.iter().collect::<Vec<_>>(), vec!["/b"]);
+
+        // and the other machine takes the unpin on its next sync, but keeps
+        // an ignore pattern it added since
+        theirs.ignored.push("scratch".to_string());
+        theirs.mark("ignored", "scratch");
+        theirs.merge(ours);
+        assert_eq!(theirs.pinned.iter().collect::<Vec<_>>(), vec!["/b"]);
+        assert_eq!(theirs.ignored, vec!["vendor", "scratch"]);
+    }
+}
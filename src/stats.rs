@@ -0,0 +1,73 @@
+use eyre::Result;
+use std::path::Path;
+
+use crate::{activity, state::State, usage, Cache, Config};
+
+/// Number of projects listed in the largest projects section
+const LARGEST: usize = 10;
+
+/// Days covered by the time spent section
+const RECENT_DAYS: u64 = 7;
+
+fn hours_minutes(secs: u64) -> String {
+    format!("{}h{:02}m", secs / 3600, secs % 3600 / 60)
+}
+
+pub(crate) fn run(cfg: &Config, cache: &Cache, state: &State) -> Result<()> {
+    let mut sized: Vec<_> = cache
+        .initial_paths()
+        .into_iter()
+        .map(|p| {
+            let bytes = cache.disk_usage(&p.full_path);
+            (p, bytes)
+        })
+        .collect();
+    sized.sort_by(|a, b| {
+        b.1.cmp(&a.1)
+            .then_with(|| a.0.full_path.cmp(&b.0.full_path))
+    });
+
+    let total: u64 = sized.iter().map(|(_, bytes)| bytes).sum();
+    println!("{} projects, {} on disk", sized.len(), usage::human(total));
+
+    println!();
+    for dir in &cfg.root_dirs {
+        let (count, bytes) = sized
+            .iter()
+            .filter(|(p, _)| Path::new(&p.full_path).starts_with(&dir.path))
+            .fold((0, 0), |(count, bytes), (_, b)| (count + 1, bytes + b));
+        println!(
+            "{:>8}  {:>5} projects  {}",
+            usage::human(bytes),
+            count,
+            dir.path.display()
+        );
+    }
+
+    println!();
+    println!("largest projects:");
+    for (p, bytes) in sized.iter().take(LARGEST) {
+        println!("{:>8}  {}", usage::human(*bytes), p.full_path);
+    }
+
+    let since = activity::day(usage::now().saturating_sub((RECENT_DAYS - 1) * 24 * 60 * 60));
+    let mut spent: Vec<(String, String, u64)> = state
+        .time_spent()
+        .into_iter()
+        .flat_map(|(path, days)| {
+            days.into_iter()
+                .filter(|(day, _)| *day >= since)
+                .map(move |(day, secs)| (day, path.clone(), secs))
+        })
+        .collect();
+    if !spent.is_empty() {
+        spent.sort();
+        println!();
+        println!("time spent in the last {} days (UTC):", RECENT_DAYS);
+        for (day, path, secs) in spent {
+            println!("{}  {:>7}  {}", day, hours_minutes(secs), path);
+        }
+    }
+
+    Ok(())
+}
@@ -0,0 +1,62 @@
+//! `project statusline`: a short summary for the tmux status line, e.g.
+//! `set -g status-right '#(project statusline --session "#S")'`
+
+use eyre::Result;
+use std::{collections::BTreeSet, path::Path};
+
+use crate::{git, tmux};
+
+/// The current project's name, if any, and how many of the projects with
+/// sessions have uncommitted changes
+fn summary(current: Option<&str>, dirty: usize) -> String {
+    let mut parts = Vec::new();
+    if let Some(current) = current {
+        parts.push(current.to_string());
+    }
+    if dirty > 0 {
+        parts.push(format!("{} dirty", dirty));
+    }
+    parts.join(" · ")
+}
+
+pub(crate) fn run(session: Option<String>) -> Result<()> {
+    let sessions = tmux::sessions()?;
+    let session = session.or_else(tmux::current_session);
+    // only sessions this tool created belong to projects
+    let current = sessions
+        .iter()
+        .find(|s| Some(&s.name) == session.as_ref() && s.project_path.is_some())
+        .map(|s| s.name.as_str());
+
+    let paths: BTreeSet<&str> = sessions
+        .iter()
+        .filter_map(|s| s.project_path.as_deref())
+        .collect();
+    let dirty = std::thread::scope(|scope| {
+        let handles: Vec<_> = paths
+            .iter()
+            .map(|path| scope.spawn(move || git::is_dirty(Path::new(path))))
+            .collect();
+        handles
+            .into_iter()
+            .map(|handle| handle.join().unwrap_or(false))
+            .filter(|dirty| *dirty)
+            .count()
+    });
+
+    println!("{}", summary(current, dirty));
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn summaries() {
+        assert_eq!(summary(Some("api"), 2), "api · 2 dirty");
+        assert_eq!(summary(Some("api"), 0), "api");
+        assert_eq!(summary(None, 1), "1 dirty");
+        assert_eq!(summary(None, 0), "");
+    }
+}
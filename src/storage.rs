@@ -0,0 +1,132 @@
+//! Reading and writing the cache and state files, optionally compressed.
+//! Compressed files keep their names and are recognised by their first
+//! bytes, so changing the setting never strands what was written before.
+
+use std::{
+    fs::File,
+    io::{Read, Write},
+    os::unix::io::AsRawFd,
+    path::Path,
+    sync::OnceLock,
+};
+
+use eyre::{Result, WrapErr};
+use serde::{Deserialize, Serialize};
+
+#[derive(Debug, Default, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub(crate) enum Compression {
+    #[default]
+    None,
+    Gzip,
+    Zstd,
+}
+
+const GZIP_MAGIC: &[u8] = &[0x1f, 0x8b];
+const ZSTD_MAGIC: &[u8] = &[0x28, 0xb5, 0x2f, 0xfd];
+
+static COMPRESSION: OnceLock<Compression> = OnceLock::new();
+
+/// Compress files written from now on, from the config file
+pub(crate) fn init(compression: Compression) {
+    let _ = COMPRESSION.set(compression);
+}
+
+fn compression() -> Compression {
+    COMPRESSION.get().copied().unwrap_or_default()
+}
+
+fn decode(bytes: Vec<u8>) -> std::io::Result<String> {
+    let mut txt = String::new();
+    if bytes.starts_with(GZIP_MAGIC) {
+        flate2::read::GzDecoder::new(&bytes[..]).read_to_string(&mut txt)?;
+    } else if bytes.starts_with(ZSTD_MAGIC) {
+        zstd::stream::read::Decoder::new(&bytes[..])?.read_to_string(&mut txt)?;
+    } else {
+        txt = String::from_utf8(bytes)
+            .map_err(|e| std::io::Error::new(std::io::ErrorKind::InvalidData, e))?;
+    }
+    Ok(txt)
+}
+
+/// The contents of `path`, decompressed if need be
+pub(crate) fn read(path: &Path) -> std::io::Result<String> {
+    decode(std::fs::read(path)?)
+}
+
+fn encode<T: Serialize>(value: &T, compression: Compression) -> Result<Vec<u8>> {
+    Ok(match compression {
+        Compression::None => serde_json::to_vec_pretty(value)?,
+        // nobody reads these by eye, so there is no point in spacing them out
+        Compression::Gzip => {
+            let mut encoder =
+                flate2::write::GzEncoder::new(Vec::new(), flate2::Compression::default());
+            serde_json::to_writer(&mut encoder, value)?;
+            encoder.finish()?
+        }
+        Compression::Zstd => {
+            let mut encoder = zstd::stream::write::Encoder::new(Vec::new(), 0)?;
+            serde_json::to_writer(&mut encoder, value)?;
+            encoder.finish()?
+        }
+    })
+}
+
+/// Write `value` to `path` as JSON, compressed as the config asks
+pub(crate) fn write<T: Serialize>(path: &Path, value: &T) -> Result<()> {
+    let bytes = encode(value, compression()).wrap_err("encoding")?;
+    let mut f = std::fs::File::create(path).wrap_err("creating file")?;
+    f.write_all(&bytes).wrap_err("writing file")
+}
+
+/// An exclusive lock on a file, released when dropped
+pub(crate) struct Lock(#[allow(dead_code)] File);
+
+/// Wait for an exclusive lock on `path`, through a `.lock` file beside it so
+/// that replacing `path` does not lose the lock, for read-modify-write
+/// cycles which other processes must not interleave with
+pub(crate) fn lock(path: &Path) -> Result<Lock> {
+    let f = File::options()
+        .create(true)
+        .write(true)
+        .open(path.with_extension("lock"))
+        .wrap_err("opening lock file")?;
+    if unsafe { libc::flock(f.as_raw_fd(), libc::LOCK_EX) } != 0 {
+        return Err(std::io::Error::last_os_error()).wrap_err("locking");
+    }
+    Ok(Lock(f))
+}
+
+/// An exclusive lock on an open file, released when dropped
+pub(crate) struct FileLock<'a>(&'a File);
+
+/// Wait for an exclusive lock on `f` itself, for files such as the cache
+/// journal which are kept open and only ever appended to or emptied
+pub(crate) fn lock_file(f: &File) -> Result<FileLock<'_>> {
+    if unsafe { libc::flock(f.as_raw_fd(), libc::LOCK_EX) } != 0 {
+        return Err(std::io::Error::last_os_error()).wrap_err("locking");
+    }
+    Ok(FileLock(f))
+}
+
+impl Drop for FileLock<'_> {
+    fn drop(&mut self) {
+        unsafe { libc::flock(self.0.as_raw_fd(), libc::LOCK_UN) };
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn round_trips() {
+        let value = vec!["/work/api".to_string(), "/work/web".to_string()];
+        for compression in [Compression::None, Compression::Gzip, Compression::Zstd] {
+            let bytes = encode(&value, compression).unwrap();
+            let txt = decode(bytes).unwrap();
+            let back: Vec<String> = serde_json::from_str(&txt).unwrap();
+            assert_eq!(back, value, "{:?}", compression);
+        }
+    }
+}
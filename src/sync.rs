@@ -0,0 +1,173 @@
+//! `project sync`: share the state and cache with other machines through a
+//! git repository, or a directory kept in step by something like Syncthing
+
+use eyre::{Result, WrapErr};
+use serde::{de::DeserializeOwned, Deserialize, Serialize};
+use std::{
+    path::{Path, PathBuf},
+    process::{Command, Output},
+};
+
+use crate::{
+    state::{State, StateInner},
+    tilde, Cache, CacheInner, Config,
+};
+
+const STATE_FILE: &str = "state.json";
+const CACHE_FILE: &str = "cache.json";
+
+#[derive(Debug, Serialize, Deserialize)]
+pub(crate) struct SyncConfig {
+    /// a git checkout used for nothing else, or a directory synced some other way
+    dir: String,
+}
+
+/// Paths in the shared files start with `~` so that machines whose home
+/// directories differ still agree on them
+fn to_shared(path: &str, home: &str) -> String {
+    match path.strip_prefix(home) {
+        Some(rest) if rest.is_empty() || rest.starts_with('/') => format!("~{}", rest),
+        _ => path.to_string(),
+    }
+}
+
+fn from_shared(path: &str, home: &str) -> String {
+    match path.strip_prefix('~') {
+        Some(rest) if rest.is_empty() || rest.starts_with('/') => format!("{}{}", home, rest),
+        _ => path.to_string(),
+    }
+}
+
+fn read<T: DeserializeOwned>(path: &Path) -> Result<Option<T>> {
+    match std::fs::read_to_string(path) {
+        Ok(txt) => serde_json::from_str(&txt)
+            .map(Some)
+            .wrap_err_with(|| format!("parsing {}", path.display())),
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => Ok(None),
+        Err(e) => Err(e).wrap_err_with(|| format!("reading {}", path.display())),
+    }
+}
+
+fn write<T: Serialize>(path: &Path, value: &T) -> Result<()> {
+    let mut txt = serde_json::to_string_pretty(value)?;
+    txt.push('\n');
+    std::fs::write(path, txt).wrap_err_with(|| format!("writing {}", path.display()))
+}
+
+fn git(dir: &Path, args: &[&str]) -> Result<Output> {
+    Command::new("git")
+        .arg("-C")
+        .arg(dir)
+        .args(args)
+        .output()
+        .wrap_err("running git")
+}
+
+/// Run git, failing with its error output if it fails
+fn git_ok(dir: &Path, args: &[&str]) -> Result<()> {
+    let output = git(dir, args)?;
+    if !output.status.success() {
+        eyre::bail!(
+            "git {} failed: {}",
+            args.join(" "),
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    Ok(())
+}
+
+fn hostname() -> String {
+    Command::new("hostname")
+        .output()
+        .ok()
+        .map(|output| String::from_utf8_lossy(&output.stdout).trim().to_string())
+        .filter(|name| !name.is_empty())
+        .unwrap_or_else(|| "unknown host".to_string())
+}
+
+pub(crate) fn run(cfg: &Config, cache: &Cache, state: &State, offline: bool) -> Result<()> {
+    let sync = cfg
+        .sync
+        .as_ref()
+        .ok_or_else(|| eyre::eyre!("add a [sync] section to the config file first"))?;
+    let dir = PathBuf::from(tilde::expand(&sync.dir).as_ref());
+    std::fs::create_dir_all(&dir).wrap_err("creating sync directory")?;
+    let home = dirs::home_dir()
+        .ok_or_else(|| eyre::eyre!("finding home directory"))?
+        .to_string_lossy()
+        .into_owned();
+
+    let is_repo = dir.join(".git").exists();
+    let upstream = is_repo
+        && git(&dir, &["rev-parse", "--abbrev-ref", "@{u}"])?
+            .status
+            .success();
+    if upstream && !offline {
+        git_ok(&dir, &["fetch", "--quiet"])?;
+        // the files are merged below rather than by git, and anything this
+        // machine pushed before is already in its own state
+        git_ok(&dir, &["reset", "--quiet", "--hard", "@{u}"])?;
+    }
+
+    let state_path = dir.join(STATE_FILE);
+    if let Some(theirs) = read::<StateInner>(&state_path)? {
+        state.merge(theirs.map_paths(|p| from_shared(p, &home)));
+    }
+    write(
+        &state_path,
+        &state.snapshot().map_paths(|p| to_shared(p, &home)),
+    )?;
+
+    // the shared cache lists every machine's projects, but only those which
+    // exist here are added to this machine's
+    let cache_path = dir.join(CACHE_FILE);
+    let mut shared = cache.snapshot();
+    if let Some(theirs) = read::<CacheInner>(&cache_path)? {
+        let mut theirs = theirs.map_paths(|p| from_shared(p, &home));
+        shared.merge(theirs.clone());
+        theirs.paths.retain(|p| Path::new(&p.full_path).is_dir());
+        cache.merge(theirs);
+    }
+    shared.sizes.clear();
+    let known = shared.paths.len();
+    write(&cache_path, &shared.map_paths(|p| to_shared(p, &home)))?;
+
+    if is_repo {
+        git_ok(&dir, &["add", STATE_FILE, CACHE_FILE])?;
+        let unchanged = git(&dir, &["diff", "--cached", "--quiet"])?
+            .status
+            .success();
+        if !unchanged {
+            let message = format!("sync from {}", hostname());
+            git_ok(&dir, &["commit", "--quiet", "-m", &message])?;
+        }
+        if upstream && !offline {
+            git_ok(&dir, &["push", "--quiet"])
+                .wrap_err("pushing, another machine may have synced meanwhile so try again")?;
+        }
+    }
+    println!(
+        "synced with {}, {} projects known across machines",
+        dir.display(),
+        known
+    );
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn shared_paths() {
+        let home = "/home/me";
+        assert_eq!(to_shared("/home/me/work/a", home), "~/work/a");
+        assert_eq!(to_shared("/home/me", home), "~");
+        assert_eq!(to_shared("/home/meg/a", home), "/home/meg/a");
+        assert_eq!(to_shared("/srv/a", home), "/srv/a");
+
+        assert_eq!(from_shared("~/work/a", "/Users/me"), "/Users/me/work/a");
+        assert_eq!(from_shared("~bob/a", "/Users/me"), "~bob/a");
+        assert_eq!(from_shared("/srv/a", "/Users/me"), "/srv/a");
+    }
+}
@@ -0,0 +1,211 @@
+//! Minimal `{{.Field}}` templates, following the syntax of Go's text/template
+//! for the simple substitutions users write in the config file
+//!
+//! Openers, the tracking command, Neovim settings and `env` values all see
+//! the same project fields, from [`Vars`]:
+//!
+//! - `{{.Path}}`: the project's full path
+//! - `{{.Name}}`: its session name, also available as `{{.Session}}`
+//! - `{{.Base}}`: the last component of its path
+//! - `{{.Root}}`: the root directory it was found under
+//! - `{{.Branch}}`: the branch checked out, empty when detached or not a repository
+//! - `{{.Remote}}`: the URL of its origin remote, empty without one
+//! - `{{.WindowsPath}}`: under WSL, the path Windows programs know it by
+//!
+//! Openers and the tracking command run in the shell, and the values put in
+//! them are quoted for it.
+//!
+//! Session name templates are rendered while scanning, before any of that is
+//! known, and have fields of their own.
+
+use eyre::{Result, WrapErr};
+use std::{path::Path, process::Command};
+
+use crate::{git, tmux::shell_quote, wsl, ProjectPath};
+
+/// The fields [`Vars`] provides
+pub(crate) const PROJECT_FIELDS: &[&str] = &[
+    "Path",
+    "Name",
+    "Session",
+    "Base",
+    "Root",
+    "Branch",
+    "Remote",
+    "WindowsPath",
+];
+
+/// The fields session name templates can use
+pub(crate) const SESSION_NAME_FIELDS: &[&str] = &["Prefix", "Relative", "Base", "Parent", "Root"];
+
+/// Check that `template` parses and uses only `fields`
+pub(crate) fn check(template: &str, fields: &[&str]) -> Result<()> {
+    render(template, |name| fields.contains(&name).then(String::new)).map(|_| ())
+}
+
+/// Check the syntax of a shell command without running it
+pub(crate) fn check_command(command: &str) -> Result<()> {
+    let output = Command::new("sh")
+        .args(["-n", "-c", command])
+        .output()
+        .wrap_err("running sh")?;
+    if !output.status.success() {
+        let stderr = String::from_utf8_lossy(&output.stderr);
+        eyre::bail!("shell syntax error in {:?}: {}", command, stderr.trim());
+    }
+    Ok(())
+}
+
+/// The fields templates can use for a project. Branch and remote come from
+/// git, which is only asked when a template uses them.
+pub(crate) struct Vars<'a> {
+    project: &'a ProjectPath,
+    root: Option<String>,
+}
+
+impl<'a> Vars<'a> {
+    /// `root` is the root directory containing the project, if it is under one
+    pub(crate) fn new(project: &'a ProjectPath, root: Option<String>) -> Self {
+        Self { project, root }
+    }
+
+    pub(crate) fn lookup(&self, name: &str) -> Option<String> {
+        let path = Path::new(&self.project.full_path);
+        let file_name = |p: Option<&Path>| {
+            p.and_then(|p| p.file_name())
+                .map(|name| name.to_string_lossy().into_owned())
+                .unwrap_or_default()
+        };
+        match name {
+            "Path" => Some(self.project.full_path.clone()),
+            "Name" | "Session" => Some(self.project.session_name.clone()),
+            "Base" => Some(file_name(Some(path))),
+            // projects outside the roots, such as CDPATH entries' children,
+            // count their parent directory as the root
+            "Root" => Some(self.root.clone().unwrap_or_else(|| {
+                path.parent()
+                    .map(|p| p.to_string_lossy().into_owned())
+                    .unwrap_or_default()
+            })),
+            "Branch" => Some(git::current_branch(path).unwrap_or_default()),
+            "Remote" => Some(git::origin_url(path).unwrap_or_default()),
+            // outside WSL there is no other form of the path to give
+            "WindowsPath" => Some(
+                wsl::to_windows(&self.project.full_path)
+                    .unwrap_or_else(|| self.project.full_path.clone()),
+            ),
+            _ => None,
+        }
+    }
+
+    pub(crate) fn render(&self, template: &str) -> Result<String> {
+        render(template, |name| self.lookup(name))
+    }
+
+    /// Render a template which is run by the shell, quoting each value so
+    /// that a space or `;` in a path or branch name stays part of it
+    pub(crate) fn render_command(&self, template: &str) -> Result<String> {
+        render(template, |name| {
+            self.lookup(name)
+                .map(|value| shell_quote(&value).into_owned())
+        })
+    }
+}
+
+/// Substitute each `{{.Name}}` in `template` with the value `lookup` gives for `Name`
+pub(crate) fn render<F>(template: &str, lookup: F) -> Result<String>
+where
+    F: Fn(&str) -> Option<String>,
+{
+    let mut out = String::with_capacity(template.len());
+    let mut rest = template;
+    while let Some(start) = rest.find("{{") {
+        out.push_str(&rest[..start]);
+        let after = &rest[start + 2..];
+        let end = after
+            .find("}}")
+            .ok_or_else(|| eyre::eyre!("unclosed {{{{ in template {:?}", template))?;
+        let action = after[..end].trim();
+        let name = action.strip_prefix('.').ok_or_else(|| {
+            eyre::eyre!(
+                "unsupported action {:?} in template {:?}, expected {{{{.Name}}}}",
+                action,
+                template
+            )
+        })?;
+        let value = lookup(name)
+            .ok_or_else(|| eyre::eyre!("unknown field .{} in template {:?}", name, template))?;
+        out.push_str(&value);
+        rest = &after[end + 2..];
+    }
+    out.push_str(rest);
+    Ok(out)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn lookup(name: &str) -> Option<String> {
+        match name {
+            "Prefix" => Some("work-".to_string()),
+            "Base" => Some("service".to_string()),
+            _ => None,
+        }
+    }
+
+    #[test]
+    fn substitution() {
+        assert_eq!(
+            render("{{.Prefix}}{{ .Base }}", lookup).unwrap(),
+            "work-service"
+        );
+        assert_eq!(render("plain", lookup).unwrap(), "plain");
+    }
+
+    #[test]
+    fn project_fields() {
+        let project = ProjectPath {
+            full_path: "/work/clients/acme".to_string(),
+            session_name: "clients/acme".to_string(),
+        };
+        let vars = Vars::new(&project, Some("/work".to_string()));
+        assert_eq!(
+            vars.render("{{.Root}} {{.Name}} {{.Base}} {{.Path}}")
+                .unwrap(),
+            "/work clients/acme acme /work/clients/acme"
+        );
+        assert_eq!(
+            Vars::new(&project, None).render("{{.Root}}").unwrap(),
+            "/work/clients"
+        );
+        assert!(vars.render("{{.Prefix}}").is_err());
+
+        let project = ProjectPath {
+            full_path: "/work/my app;rm -rf ~".to_string(),
+            session_name: "app".to_string(),
+        };
+        assert_eq!(
+            Vars::new(&project, None)
+                .render_command("code {{.Path}}/docs")
+                .unwrap(),
+            "code '/work/my app;rm -rf ~'/docs"
+        );
+    }
+
+    #[test]
+    fn checks() {
+        assert!(check("code {{.Path}}", PROJECT_FIELDS).is_ok());
+        assert!(check("{{.Prefix}}{{.Base}}", PROJECT_FIELDS).is_err());
+        assert!(check("{{.Prefix}}{{.Base}}", SESSION_NAME_FIELDS).is_ok());
+        assert!(check_command("cd {{.Path}} && make").is_ok());
+        assert!(check_command("if true; then echo").is_err());
+    }
+
+    #[test]
+    fn errors() {
+        assert!(render("{{.Missing}}", lookup).is_err());
+        assert!(render("{{.Base", lookup).is_err());
+        assert!(render("{{Base}}", lookup).is_err());
+    }
+}
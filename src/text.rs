@@ -0,0 +1,51 @@
+//! Laying out names in columns by how wide they show in a terminal rather
+//! than how many bytes they take, so CJK and emoji line up
+
+use std::borrow::Cow;
+use unicode_width::{UnicodeWidthChar, UnicodeWidthStr};
+
+/// The number of terminal columns `s` takes
+pub(crate) fn width(s: &str) -> usize {
+    UnicodeWidthStr::width(s)
+}
+
+/// `s` followed by enough spaces to fill `columns`
+pub(crate) fn pad(s: &str, columns: usize) -> String {
+    format!("{}{}", s, " ".repeat(columns.saturating_sub(width(s))))
+}
+
+/// `s` cut down to at most `columns` wide, ending with "…" when shortened.
+/// Characters are never split, so a wide one that would straddle the limit
+/// is left out.
+pub(crate) fn truncate(s: &str, columns: usize) -> Cow<'_, str> {
+    if width(s) <= columns {
+        return Cow::Borrowed(s);
+    }
+    let mut out = String::new();
+    let mut used = 0;
+    for c in s.chars() {
+        let w = c.width().unwrap_or(0);
+        if used + w + 1 > columns {
+            break;
+        }
+        out.push(c);
+        used += w;
+    }
+    out.push('…');
+    Cow::Owned(out)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn wide_characters() {
+        assert_eq!(width("プロジェクト"), 12);
+        assert_eq!(pad("日本", 6), "日本  ");
+        assert_eq!(pad("abc", 2), "abc");
+        assert_eq!(truncate("feature/日本語のブランチ", 12), "feature/日…");
+        assert_eq!(truncate("short", 12), "short");
+        assert_eq!(width(&truncate("🦀🦀🦀🦀", 6)), 5);
+    }
+}
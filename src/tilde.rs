@@ -0,0 +1,93 @@
+//! `~` and `~user` expansion for paths in the config file and on the command
+//! line
+
+use std::{
+    borrow::Cow,
+    ffi::{CStr, CString, OsStr},
+    os::unix::ffi::OsStrExt,
+    path::PathBuf,
+};
+
+/// Expand a leading `~` to the current user's home directory and `~user` to
+/// that user's, leaving the path alone when the home directory is unknown
+pub(crate) fn expand(path: &str) -> Cow<str> {
+    expand_with(path, |user| {
+        if user.is_empty() {
+            dirs::home_dir()
+        } else {
+            home_of(user)
+        }
+    })
+}
+
+fn expand_with<F>(path: &str, home: F) -> Cow<str>
+where
+    F: FnOnce(&str) -> Option<PathBuf>,
+{
+    let rest = match path.strip_prefix('~') {
+        Some(rest) => rest,
+        None => return Cow::Borrowed(path),
+    };
+    let (user, rest) = rest.split_at(rest.find('/').unwrap_or(rest.len()));
+    match home(user) {
+        Some(dir) => Cow::Owned(format!("{}{}", dir.to_string_lossy(), rest)),
+        None => Cow::Borrowed(path),
+    }
+}
+
+/// Home directory of `user` from the password database
+fn home_of(user: &str) -> Option<PathBuf> {
+    let name = CString::new(user).ok()?;
+    let mut buf = vec![0; 1024];
+    loop {
+        // SAFETY: every pointer is valid for the duration of the call, and
+        // `pwd` borrows from `buf` which outlives its use below
+        let mut pwd: libc::passwd = unsafe { std::mem::zeroed() };
+        let mut result = std::ptr::null_mut();
+        let rc = unsafe {
+            libc::getpwnam_r(
+                name.as_ptr(),
+                &mut pwd,
+                buf.as_mut_ptr(),
+                buf.len(),
+                &mut result,
+            )
+        };
+        if rc == libc::ERANGE && buf.len() < 1 << 20 {
+            buf.resize(buf.len() * 2, 0);
+            continue;
+        }
+        if rc != 0 || result.is_null() || pwd.pw_dir.is_null() {
+            return None;
+        }
+        let dir = unsafe { CStr::from_ptr(pwd.pw_dir) };
+        return Some(PathBuf::from(OsStr::from_bytes(dir.to_bytes())));
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn expansions() {
+        let home = |user: &str| match user {
+            "" => Some(PathBuf::from("/home/me")),
+            "bob" => Some(PathBuf::from("/home/bob")),
+            _ => None,
+        };
+        assert_eq!(expand_with("~", home), "/home/me");
+        assert_eq!(expand_with("~/work", home), "/home/me/work");
+        assert_eq!(expand_with("~bob", home), "/home/bob");
+        assert_eq!(expand_with("~bob/src/x", home), "/home/bob/src/x");
+        assert_eq!(expand_with("~nobody/x", home), "~nobody/x");
+        assert_eq!(expand_with("/srv/~bob", home), "/srv/~bob");
+        assert_eq!(expand_with("work", home), "work");
+    }
+
+    #[test]
+    fn unknown_users() {
+        assert_eq!(home_of("no such user"), None);
+        assert_eq!(home_of("nul\0byte"), None);
+    }
+}
@@ -0,0 +1,714 @@
+//! Driving tmux, which has to be 1.9 or later: sessions are created with
+//! `new-session -c` and targeted by exact name with "=name"
+
+use eyre::{Result, WrapErr};
+use serde::{Deserialize, Serialize};
+use std::io::{BufRead, Write};
+use std::process::{Command, ExitStatus, Output};
+
+use crate::{redact, ProjectPath};
+
+/// A tmux invocation kept as plain arguments, so callers can add arbitrary
+/// flags from the config file
+pub(crate) struct TmuxCommand {
+    args: Vec<String>,
+}
+
+impl TmuxCommand {
+    pub(crate) fn new(subcommand: &str) -> Self {
+        Self {
+            args: vec![subcommand.to_string()],
+        }
+    }
+
+    pub(crate) fn arg(mut self, arg: impl Into<String>) -> Self {
+        self.args.push(arg.into());
+        self
+    }
+
+    pub(crate) fn args<I, S>(mut self, args: I) -> Self
+    where
+        I: IntoIterator<Item = S>,
+        S: Into<String>,
+    {
+        self.args.extend(args.into_iter().map(Into::into));
+        self
+    }
+
+    fn command(&self) -> Command {
+        log::debug!("running {}", self);
+        let mut cmd = Command::new("tmux");
+        cmd.args(&self.args);
+        cmd
+    }
+
+    /// Run with the terminal attached, as needed by attach-session
+    pub(crate) fn status(&self) -> Result<ExitStatus> {
+        self.command()
+            .status()
+            .wrap_err_with(|| format!("running tmux {}", self.args[0]))
+    }
+
+    pub(crate) fn output(&self) -> Result<Output> {
+        self.command()
+            .output()
+            .wrap_err_with(|| format!("running tmux {}", self.args[0]))
+    }
+
+    /// Run, failing with tmux's error message if it exits unsuccessfully
+    pub(crate) fn run(&self) -> Result<Output> {
+        let output = self.output()?;
+        if !output.status.success() {
+            eyre::bail!(
+                "tmux {} failed: {}",
+                self.args[0],
+                String::from_utf8_lossy(&output.stderr).trim()
+            );
+        }
+        Ok(output)
+    }
+}
+
+impl TmuxCommand {
+    /// The command as a line for tmux's own command parser, as control mode
+    /// clients take them. Nothing is redacted, as the line has to work.
+    pub(crate) fn command_line(&self) -> String {
+        self.args
+            .iter()
+            .map(|arg| shell_quote(arg))
+            .collect::<Vec<_>>()
+            .join(" ")
+    }
+}
+
+impl std::fmt::Display for TmuxCommand {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "tmux")?;
+        for arg in &self.args {
+            write!(f, " {}", shell_quote(&redact::arg(arg)))?;
+        }
+        Ok(())
+    }
+}
+
+/// Quote `s` for a POSIX shell, leaving it alone when that is unnecessary
+pub(crate) fn shell_quote(s: &str) -> std::borrow::Cow<'_, str> {
+    let safe = |c: char| c.is_ascii_alphanumeric() || "-_=./:@%+,".contains(c);
+    if !s.is_empty() && s.chars().all(safe) {
+        std::borrow::Cow::Borrowed(s)
+    } else {
+        std::borrow::Cow::Owned(format!("'{}'", s.replace('\'', "'\\''")))
+    }
+}
+
+/// Session option recording the project a session was created for
+pub(crate) const PROJECT_PATH_OPTION: &str = "@project_path";
+
+/// A live tmux session
+pub(crate) struct Session {
+    pub(crate) name: String,
+    /// the project recorded when this tool created the session
+    pub(crate) project_path: Option<String>,
+    /// seconds since the unix epoch of the last activity in the session
+    pub(crate) activity: u64,
+}
+
+/// All sessions on the tmux server, or none if no server is running
+pub(crate) fn sessions() -> Result<Vec<Session>> {
+    let output = TmuxCommand::new("list-sessions")
+        .arg("-F")
+        .arg(format!(
+            "#{{session_name}}\t#{{session_activity}}\t#{{{}}}",
+            PROJECT_PATH_OPTION
+        ))
+        .output()?;
+    if !output.status.success() {
+        let stderr = String::from_utf8_lossy(&output.stderr);
+        if stderr.contains("no server running") || stderr.contains("error connecting") {
+            return Ok(Vec::new());
+        }
+        eyre::bail!("tmux list-sessions failed: {}", stderr.trim());
+    }
+
+    Ok(String::from_utf8_lossy(&output.stdout)
+        .lines()
+        .filter_map(|line| {
+            let mut fields = line.splitn(3, '\t');
+            let name = fields.next()?.to_string();
+            let activity = fields.next()?.parse().unwrap_or(0);
+            let project_path = fields.next().filter(|p| !p.is_empty()).map(str::to_string);
+            Some(Session {
+                name,
+                project_path,
+                activity,
+            })
+        })
+        .collect())
+}
+
+/// A pane of a live session
+pub(crate) struct Pane {
+    pub(crate) window_index: u32,
+    pub(crate) window_name: String,
+    /// the window's layout, as select-layout takes it
+    pub(crate) window_layout: String,
+    pub(crate) path: String,
+    /// the program running in the foreground, often just the shell
+    pub(crate) command: String,
+}
+
+/// The panes of the session called `name`, window by window
+pub(crate) fn panes(name: &str) -> Result<Vec<Pane>> {
+    let output = TmuxCommand::new("list-panes")
+        .args(["-s", "-t"])
+        .arg(format!("={}", name))
+        .arg("-F")
+        .arg("#{window_index}\t#{window_name}\t#{window_layout}\t#{pane_current_path}\t#{pane_current_command}")
+        .output()?;
+    if !output.status.success() {
+        eyre::bail!(
+            "tmux list-panes failed: {}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    Ok(String::from_utf8_lossy(&output.stdout)
+        .lines()
+        .filter_map(|line| {
+            let mut fields = line.splitn(5, '\t');
+            Some(Pane {
+                window_index: fields.next()?.parse().ok()?,
+                window_name: fields.next()?.to_string(),
+                window_layout: fields.next()?.to_string(),
+                path: fields.next()?.to_string(),
+                command: fields.next().unwrap_or_default().to_string(),
+            })
+        })
+        .collect())
+}
+
+/// The session of the client running this, when run from inside tmux
+pub(crate) fn current_session() -> Option<String> {
+    let output = TmuxCommand::new("display-message")
+        .args(["-p", "#{session_name}"])
+        .output()
+        .ok()?;
+    let name = String::from_utf8_lossy(&output.stdout).trim().to_string();
+    (output.status.success() && !name.is_empty()).then(|| name)
+}
+
+/// The terminal of the tmux client running this, which identifies it
+pub(crate) fn current_client() -> Option<String> {
+    let output = TmuxCommand::new("display-message")
+        .args(["-p", "#{client_tty}"])
+        .output()
+        .ok()?;
+    let tty = String::from_utf8_lossy(&output.stdout).trim().to_string();
+    (output.status.success() && !tty.is_empty()).then(|| tty)
+}
+
+fn client_for_pane(list_clients: &str, pane: &str) -> Option<String> {
+    list_clients.lines().find_map(|line| {
+        let (tty, pane_id) = line.split_once('\t')?;
+        (pane_id == pane).then(|| tty.to_string())
+    })
+}
+
+/// The client showing the pane this runs in, which is the one the user typed
+/// into, rather than the most recently active one tmux would otherwise pick
+pub(crate) fn invoking_client() -> Option<String> {
+    let pane = std::env::var("TMUX_PANE").ok()?;
+    let output = TmuxCommand::new("list-clients")
+        .args(["-F", "#{client_tty}\t#{pane_id}"])
+        .output()
+        .ok()
+        .filter(|output| output.status.success())?;
+    client_for_pane(&String::from_utf8_lossy(&output.stdout), &pane)
+}
+
+/// The session `client` is showing
+pub(crate) fn client_session(client: &str) -> Option<String> {
+    let output = TmuxCommand::new("display-message")
+        .args(["-c", client, "-p", "#{client_session}"])
+        .output()
+        .ok()?;
+    let name = String::from_utf8_lossy(&output.stdout).trim().to_string();
+    (output.status.success() && !name.is_empty()).then(|| name)
+}
+
+/// Whether a session is running and whether any client is showing it
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub(crate) enum SessionState {
+    Absent,
+    Detached,
+    Attached,
+}
+
+/// The state of the session called `name`, asking tmux about that session
+/// alone so it stays quick with many sessions
+pub(crate) fn session_state(name: &str) -> SessionState {
+    let output = TmuxCommand::new("display-message")
+        .args(["-p", "-t"])
+        .arg(format!("={}:", name))
+        .arg("#{session_attached}")
+        .output();
+    let clients = match output {
+        Ok(output) if output.status.success() => String::from_utf8_lossy(&output.stdout)
+            .trim()
+            .parse::<u32>()
+            .ok(),
+        _ => None,
+    };
+    // without a server tmux prints nothing rather than failing
+    match clients {
+        None => SessionState::Absent,
+        Some(0) => SessionState::Detached,
+        Some(_) => SessionState::Attached,
+    }
+}
+
+/// `name` made usable as a tmux session name. Targets treat . and : as window
+/// and pane separators, so tmux itself swaps them out of new session names,
+/// and control characters would garble its status line. Anything else,
+/// including non-ASCII text, is left alone.
+pub(crate) fn session_name(name: &str) -> String {
+    name.chars()
+        .map(|c| match c {
+            '.' | ':' => '-',
+            c if c.is_control() => '-',
+            c => c,
+        })
+        .collect()
+}
+
+/// Name for another session on a project whose session `base` is running:
+/// the branch name as a suffix when that is free, otherwise `-2`, `-3`...
+fn secondary_session_name(base: &str, branch: Option<&str>, taken: &[&str]) -> String {
+    if let Some(branch) = branch {
+        let name = format!("{}-{}", base, session_name(branch));
+        if !taken.contains(&name.as_str()) {
+            return name;
+        }
+    }
+    (2..)
+        .map(|n| format!("{}-{}", base, n))
+        .find(|name| !taken.contains(&name.as_str()))
+        .unwrap()
+}
+
+/// The project with a name for a second session, so a long job can run in
+/// one while editing in another. The project is unchanged if its session is
+/// not running yet.
+pub(crate) fn secondary(project: &ProjectPath) -> Result<ProjectPath> {
+    let sessions = sessions()?;
+    let taken: Vec<&str> = sessions.iter().map(|s| s.name.as_str()).collect();
+    if !taken.contains(&project.session_name.as_str()) {
+        return Ok(project.clone());
+    }
+    let branch = crate::git::current_branch(std::path::Path::new(&project.full_path));
+    Ok(ProjectPath {
+        full_path: project.full_path.clone(),
+        session_name: secondary_session_name(&project.session_name, branch.as_deref(), &taken),
+    })
+}
+
+/// How [`Tmux::create`] got the user to the project's session
+pub(crate) enum Outcome {
+    Switched,
+    Attached,
+    /// no client was available, so the session was only created if missing
+    Ensured {
+        created: bool,
+    },
+}
+
+impl Outcome {
+    pub(crate) fn describe(&self) -> &'static str {
+        match self {
+            Outcome::Switched => "switched",
+            Outcome::Attached => "attached",
+            Outcome::Ensured { created: true } => "created",
+            Outcome::Ensured { created: false } => "exists",
+        }
+    }
+
+    /// Tell scripts what happened when there was no client to switch, and
+    /// exit with a status of its own if the session was already there
+    pub(crate) fn report(&self, session_name: &str) {
+        if let Outcome::Ensured { created } = self {
+            println!("{} {}", self.describe(), session_name);
+            if !created {
+                crate::existed();
+            }
+        }
+    }
+}
+
+/// What to do when the project's session is already running
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "kebab-case")]
+pub(crate) enum OnExisting {
+    /// go to the session as it is
+    #[default]
+    Switch,
+    /// open a fresh window in the project directory, then go to the session
+    NewWindow,
+    /// ask which of the above to do
+    Prompt,
+}
+
+impl OnExisting {
+    /// Settle a prompt by asking on the terminal, falling back to switching
+    /// when there is nobody to ask
+    fn resolve(self, session_name: &str) -> Result<Self> {
+        if self != OnExisting::Prompt {
+            return Ok(self);
+        }
+        if !is_interactive() {
+            return Ok(OnExisting::Switch);
+        }
+        eprint!(
+            "session {} already exists: [s]witch to it or open a [n]ew window? ",
+            session_name
+        );
+        std::io::stderr().flush()?;
+        let mut answer = String::new();
+        std::io::stdin()
+            .lock()
+            .read_line(&mut answer)
+            .wrap_err("reading answer")?;
+        Ok(match answer.trim() {
+            "n" | "new" | "new-window" => OnExisting::NewWindow,
+            _ => OnExisting::Switch,
+        })
+    }
+}
+
+pub(crate) fn is_interactive() -> bool {
+    use std::io::IsTerminal;
+    std::io::stdin().is_terminal() && std::io::stdout().is_terminal()
+}
+
+pub(crate) struct Tmux<'a> {
+    path: &'a ProjectPath,
+    detach_others: bool,
+    new_session_args: Vec<String>,
+    on_existing: OnExisting,
+    window_command: Option<String>,
+    shell: Option<String>,
+    client: Option<String>,
+    dry_run: bool,
+    print_commands: bool,
+}
+
+impl<'a> Tmux<'a> {
+    pub(crate) fn new(item: &'a ProjectPath) -> Self {
+        Self {
+            path: item,
+            detach_others: false,
+            new_session_args: Vec::new(),
+            on_existing: OnExisting::Switch,
+            window_command: None,
+            shell: None,
+            client: None,
+            dry_run: false,
+            print_commands: false,
+        }
+    }
+
+    /// Print the commands which would change tmux's state instead of running
+    /// them. Read only queries such as has-session still run so the plan
+    /// matches what would really happen.
+    pub(crate) fn dry_run(mut self, dry_run: bool) -> Self {
+        self.dry_run = dry_run;
+        self
+    }
+
+    /// Print the commands which would change tmux's state, one per line and
+    /// without "tmux" in front, for control mode clients such as iTerm2's
+    /// `tmux -CC` to run. The session is always switched to, as such a
+    /// client is attached already.
+    pub(crate) fn print_commands(mut self, print_commands: bool) -> Self {
+        self.print_commands = print_commands;
+        self
+    }
+
+    fn execute(&self, cmd: TmuxCommand) -> Result<()> {
+        if self.print_commands {
+            println!("{}", cmd.command_line());
+        } else if self.dry_run {
+            println!("{}", cmd);
+        } else {
+            cmd.run()?;
+        }
+        Ok(())
+    }
+
+    /// Detach other clients when attaching, e.g. a stale client on another
+    /// machine which is keeping the session at its tiny size
+    pub(crate) fn detach_others(mut self, detach_others: bool) -> Self {
+        self.detach_others = detach_others;
+        self
+    }
+
+    /// Extra arguments passed through to new-session, e.g. `-x 250 -y 50`
+    pub(crate) fn new_session_args(mut self, args: Vec<String>) -> Self {
+        self.new_session_args = args;
+        self
+    }
+
+    pub(crate) fn on_existing(mut self, on_existing: OnExisting) -> Self {
+        self.on_existing = on_existing;
+        self
+    }
+
+    /// A shell command to run in a new window of the session, such as an
+    /// editor on a file. This takes the place of `on_existing`.
+    pub(crate) fn window_command(mut self, command: Option<String>) -> Self {
+        self.window_command = command;
+        self
+    }
+
+    /// The shell for a new session's windows and panes, instead of tmux's
+    /// default-command
+    pub(crate) fn shell(mut self, shell: Option<String>) -> Self {
+        self.shell = shell;
+        self
+    }
+
+    /// The client to switch, by its terminal, instead of the one tmux picks
+    pub(crate) fn client(mut self, client: Option<String>) -> Self {
+        self.client = client;
+        self
+    }
+
+    pub(crate) fn create(&self) -> Result<Outcome> {
+        if self.is_running() || self.print_commands {
+            self.prepare_session()?;
+            self.switch_client().wrap_err("switching client")?;
+            Ok(Outcome::Switched)
+        } else if !is_interactive() {
+            // there is no client to attach from cron, ssh commands and the
+            // like, so all we can do is make sure the session is there
+            let created = !self.session_exists()?;
+            if created {
+                self.create_session().wrap_err("creating session")?;
+            }
+            if self.window_command.is_some() {
+                self.new_window()?;
+            }
+            Ok(Outcome::Ensured { created })
+        } else {
+            self.prepare_session()?;
+            self.join().wrap_err("joining session")?;
+            Ok(Outcome::Attached)
+        }
+    }
+
+    /// Create the session, or apply the `on_existing` action to the running one
+    fn prepare_session(&self) -> Result<()> {
+        if !self.session_exists()? {
+            self.create_session().wrap_err("creating session")?;
+            if self.window_command.is_some() {
+                self.new_window()?;
+            }
+            return Ok(());
+        }
+        if self.window_command.is_some() {
+            return self.new_window();
+        }
+        match self.on_existing.resolve(&self.path.session_name)? {
+            OnExisting::NewWindow => self.new_window(),
+            _ => Ok(()),
+        }
+    }
+
+    /// Open a window in the project directory, running the window command if
+    /// there is one
+    fn new_window(&self) -> Result<()> {
+        let mut cmd = TmuxCommand::new("new-window")
+            .arg("-t")
+            .arg(format!("{}:", self.target()))
+            .args(self.start_directory());
+        if let Some(command) = &self.window_command {
+            cmd = cmd.arg(command);
+        }
+        self.execute(cmd).wrap_err("opening new window")
+    }
+
+    /// Target the session by exact name; a bare name would also match any
+    /// session that merely starts with it
+    fn target(&self) -> String {
+        format!("={}", self.path.session_name)
+    }
+
+    fn join(&self) -> Result<()> {
+        let mut attach = TmuxCommand::new("attach-session");
+        if self.detach_others {
+            attach = attach.arg("-d");
+        }
+        let attach = attach.arg("-t").arg(self.target());
+        if self.dry_run {
+            println!("{}", attach);
+            return Ok(());
+        }
+        let status = attach.status()?;
+        if !status.success() {
+            eyre::bail!("tmux attach-session failed: {}", status);
+        }
+        Ok(())
+    }
+
+    /// `-c` and the project directory, or nothing for projects on other
+    /// machines, whose shells change directory on the far side
+    fn start_directory(&self) -> Vec<String> {
+        if crate::remote::is_remote(&self.path.full_path) {
+            return Vec::new();
+        }
+        vec!["-c".to_string(), self.path.full_path.clone()]
+    }
+
+    fn create_session(&self) -> Result<()> {
+        // later windows start where -c says too, rather than in the home
+        // directory
+        self.execute(
+            TmuxCommand::new("new-session")
+                .arg("-d")
+                .args(self.start_directory())
+                .arg("-s")
+                .arg(&self.path.session_name)
+                .args(self.new_session_args.iter().cloned())
+                .args(self.shell.iter().cloned()),
+        )?;
+        // the first window runs the shell given above, later ones this
+        if let Some(shell) = &self.shell {
+            self.execute(
+                TmuxCommand::new("set-option")
+                    .arg("-t")
+                    .arg(self.target())
+                    .arg("default-command")
+                    .arg(shell),
+            )?;
+        }
+        // remember which project the session belongs to, for `project sessions`
+        self.execute(
+            TmuxCommand::new("set-option")
+                .arg("-t")
+                .arg(self.target())
+                .arg(PROJECT_PATH_OPTION)
+                .arg(&self.path.full_path),
+        )
+    }
+
+    fn session_exists(&self) -> Result<bool> {
+        let res = TmuxCommand::new("has-session")
+            .arg("-t")
+            .arg(self.target())
+            .output()
+            .wrap_err("checking if session exists")?;
+        Ok(res.status.success())
+    }
+
+    fn is_running(&self) -> bool {
+        std::env::var("TMUX").is_ok()
+    }
+
+    fn switch_client(&self) -> Result<()> {
+        self.execute(self.switch_command())
+    }
+
+    fn switch_command(&self) -> TmuxCommand {
+        let mut cmd = TmuxCommand::new("switch-client");
+        if let Some(client) = &self.client {
+            cmd = cmd.arg("-c").arg(client);
+        }
+        cmd.arg("-t").arg(self.target())
+    }
+
+    /// Kill the project's session, returning whether there was one to kill
+    pub(crate) fn kill(&self) -> Result<bool> {
+        if !self.session_exists()? {
+            return Ok(false);
+        }
+        self.execute(
+            TmuxCommand::new("kill-session")
+                .arg("-t")
+                .arg(self.target()),
+        )?;
+        Ok(true)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn command_display() {
+        let cmd = TmuxCommand::new("new-session")
+            .arg("-c")
+            .arg("/home/me/my project")
+            .arg("-s")
+            .arg("=it's");
+        assert_eq!(
+            cmd.to_string(),
+            "tmux new-session -c '/home/me/my project' -s '=it'\\''s'"
+        );
+        assert_eq!(
+            cmd.command_line(),
+            "new-session -c '/home/me/my project' -s '=it'\\''s'"
+        );
+    }
+
+    #[test]
+    fn switch_targets_client() {
+        let project = ProjectPath {
+            full_path: "/work/api".to_string(),
+            session_name: "api".to_string(),
+        };
+        assert_eq!(
+            Tmux::new(&project)
+                .client(Some("/dev/pts/4".to_string()))
+                .switch_command()
+                .to_string(),
+            "tmux switch-client -c /dev/pts/4 -t =api"
+        );
+        assert_eq!(
+            Tmux::new(&project).switch_command().to_string(),
+            "tmux switch-client -t =api"
+        );
+    }
+
+    #[test]
+    fn pane_clients() {
+        let clients = "/dev/pts/1\t%3\n/dev/pts/4\t%7\n";
+        assert_eq!(
+            client_for_pane(clients, "%7").as_deref(),
+            Some("/dev/pts/4")
+        );
+        assert_eq!(client_for_pane(clients, "%9"), None);
+    }
+
+    #[test]
+    fn session_names() {
+        assert_eq!(session_name("node.js"), "node-js");
+        assert_eq!(session_name("プロジェクト/🦀 crab"), "プロジェクト/🦀 crab");
+        assert_eq!(session_name("a\tb"), "a-b");
+    }
+
+    #[test]
+    fn secondary_names() {
+        assert_eq!(
+            secondary_session_name("api", Some("feature/v1.2"), &["api"]),
+            "api-feature/v1-2"
+        );
+        assert_eq!(
+            secondary_session_name("api", Some("main"), &["api", "api-main"]),
+            "api-2"
+        );
+        assert_eq!(
+            secondary_session_name("api", None, &["api", "api-2"]),
+            "api-3"
+        );
+    }
+}
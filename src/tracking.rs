@@ -0,0 +1,178 @@
+//! Start and end events on each switch, so the switcher can double as a time
+//! tracker feeding a log file or a tool such as timewarrior
+
+use eyre::{Result, WrapErr};
+use serde::{Deserialize, Serialize};
+use std::{io::Write, process::Command};
+
+use crate::{state::State, tilde, usage::now, Config, ProjectPath};
+
+#[derive(Debug, Serialize, Deserialize)]
+pub(crate) struct TrackingConfig {
+    /// file to append events to, one JSON object per line
+    log: Option<String>,
+    /// shell command run for each event, with PROJECT_EVENT (start or end),
+    /// PROJECT_PATH, PROJECT_NAME, PROJECT_START and, for end events,
+    /// PROJECT_END in the environment. It is also a template with the fields
+    /// of the event's project.
+    command: Option<String>,
+}
+
+/// The project being worked on, kept in the state between runs
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub(crate) struct Current {
+    pub(crate) full_path: String,
+    pub(crate) session_name: String,
+    /// seconds since the unix epoch
+    pub(crate) started_at: u64,
+}
+
+#[derive(Debug, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "lowercase")]
+enum Kind {
+    Start,
+    End,
+}
+
+#[derive(Debug, PartialEq, Eq, Serialize)]
+struct Event<'a> {
+    event: Kind,
+    project: &'a str,
+    session: &'a str,
+    start: u64,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    end: Option<u64>,
+}
+
+/// Events for moving from `previous` to `next` at time `at`, none when the
+/// project has not changed
+fn events<'a>(previous: Option<&'a Current>, next: &'a ProjectPath, at: u64) -> Vec<Event<'a>> {
+    let mut events = Vec::new();
+    if let Some(previous) = previous {
+        if previous.full_path == next.full_path {
+            return events;
+        }
+        events.push(Event {
+            event: Kind::End,
+            project: &previous.full_path,
+            session: &previous.session_name,
+            start: previous.started_at,
+            end: Some(at),
+        });
+    }
+    events.push(Event {
+        event: Kind::Start,
+        project: &next.full_path,
+        session: &next.session_name,
+        start: at,
+        end: None,
+    });
+    events
+}
+
+impl TrackingConfig {
+    pub(crate) fn command(&self) -> Option<&str> {
+        self.command.as_deref()
+    }
+
+    fn emit(&self, cfg: &Config, event: &Event) -> Result<()> {
+        if let Some(log) = &self.log {
+            let path = tilde::expand(log).into_owned();
+            let mut f = std::fs::OpenOptions::new()
+                .create(true)
+                .append(true)
+                .open(&path)
+                .wrap_err_with(|| format!("opening {}", path))?;
+            let line = serde_json::to_string(event).wrap_err("encoding event")?;
+            writeln!(f, "{}", line).wrap_err_with(|| format!("writing {}", path))?;
+        }
+        if let Some(command) = &self.command {
+            let project = ProjectPath {
+                full_path: event.project.to_string(),
+                session_name: event.session.to_string(),
+            };
+            let command = cfg.vars(&project).render_command(command)?;
+            let mut cmd = Command::new("sh");
+            cmd.arg("-c")
+                .arg(&command)
+                .env(
+                    "PROJECT_EVENT",
+                    match event.event {
+                        Kind::Start => "start",
+                        Kind::End => "end",
+                    },
+                )
+                .env("PROJECT_PATH", event.project)
+                .env("PROJECT_NAME", event.session)
+                .env("PROJECT_START", event.start.to_string());
+            if let Some(end) = event.end {
+                cmd.env("PROJECT_END", end.to_string());
+            }
+            let status = cmd
+                .status()
+                .wrap_err_with(|| format!("running {:?}", command))?;
+            if !status.success() {
+                eyre::bail!("tracking command {:?} failed: {}", command, status);
+            }
+        }
+        Ok(())
+    }
+
+    /// Record a switch to `project`, ending the previous project's stretch.
+    /// Failures are only logged as they should not stop the switch.
+    pub(crate) fn switched(&self, cfg: &Config, state: &State, project: &ProjectPath) {
+        let previous = state.current();
+        let at = now();
+        for event in events(previous.as_ref(), project, at) {
+            if let Err(e) = self.emit(cfg, &event) {
+                log::warn!("emitting tracking event: {:?}", e);
+            }
+        }
+        if previous.map_or(true, |p| p.full_path != project.full_path) {
+            state.set_current(Current {
+                full_path: project.full_path.clone(),
+                session_name: project.session_name.clone(),
+                started_at: at,
+            });
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn switch_events() {
+        let api = ProjectPath {
+            full_path: "/work/api".to_string(),
+            session_name: "api".to_string(),
+        };
+        let web = Current {
+            full_path: "/work/web".to_string(),
+            session_name: "web".to_string(),
+            started_at: 100,
+        };
+
+        let evs = events(Some(&web), &api, 160);
+        let lines: Vec<_> = evs
+            .iter()
+            .map(|e| serde_json::to_string(e).unwrap())
+            .collect();
+        assert_eq!(
+            lines,
+            vec![
+                r#"{"event":"end","project":"/work/web","session":"web","start":100,"end":160}"#,
+                r#"{"event":"start","project":"/work/api","session":"api","start":160}"#,
+            ]
+        );
+
+        assert_eq!(events(None, &api, 5).len(), 1);
+        let current = Current {
+            full_path: api.full_path.clone(),
+            session_name: api.session_name.clone(),
+            started_at: 1,
+        };
+        assert!(events(Some(&current), &api, 5).is_empty());
+    }
+}
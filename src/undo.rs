@@ -0,0 +1,123 @@
+//! `project undo`: take back the last change made to the cache or state from
+//! the picker, console or `project manage`, such as a hide from a stray key
+
+use eyre::Result;
+use serde::{Deserialize, Serialize};
+
+use crate::{state::State, Cache, CacheEntry, ProjectPath};
+
+/// How many changes can be undone
+pub(crate) const MAX_UNDO: usize = 20;
+
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub(crate) enum Change {
+    /// a project was removed from the cache, with what the cache knew of it
+    Removed(CacheEntry),
+    /// a project was hidden
+    Hidden(String),
+    /// a project's tags were set, replacing these
+    Tagged {
+        full_path: String,
+        before: Vec<String>,
+    },
+    /// a project was pinned or unpinned
+    PinToggled(String),
+}
+
+/// Changes made by one action, undone together
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub(crate) struct Mutation {
+    description: String,
+    changes: Vec<Change>,
+}
+
+impl Mutation {
+    pub(crate) fn new(description: impl Into<String>, changes: Vec<Change>) -> Self {
+        Self {
+            description: description.into(),
+            changes,
+        }
+    }
+}
+
+/// Remove `projects` from the cache, so they can be put back
+pub(crate) fn remove(cache: &Cache, state: &State, description: &str, projects: &[ProjectPath]) {
+    let changes = projects
+        .iter()
+        .filter_map(|project| cache.entry(&project.full_path))
+        .map(Change::Removed)
+        .collect();
+    for project in projects {
+        cache.remove(&project.full_path);
+    }
+    state.push_undo(Mutation::new(description, changes));
+}
+
+pub(crate) fn hide(state: &State, full_path: &str) {
+    if state.is_hidden(full_path) {
+        return;
+    }
+    state.hide(full_path);
+    state.push_undo(Mutation::new(
+        format!("hiding {}", full_path),
+        vec![Change::Hidden(full_path.to_string())],
+    ));
+}
+
+/// Set the tags of each of `full_paths`
+pub(crate) fn set_tags(state: &State, full_paths: &[&str], tags: Vec<String>) {
+    let changes = full_paths
+        .iter()
+        .map(|full_path| Change::Tagged {
+            full_path: full_path.to_string(),
+            before: state.tags(full_path),
+        })
+        .collect();
+    for full_path in full_paths {
+        state.set_tags(full_path, tags.clone());
+    }
+    state.push_undo(Mutation::new(
+        format!("tagging {} projects", full_paths.len()),
+        changes,
+    ));
+}
+
+pub(crate) fn toggle_pins(state: &State, full_paths: &[&str]) {
+    for full_path in full_paths {
+        state.toggle_pin(full_path);
+    }
+    let changes = full_paths
+        .iter()
+        .map(|full_path| Change::PinToggled(full_path.to_string()))
+        .collect();
+    state.push_undo(Mutation::new(
+        format!("pinning {} projects", full_paths.len()),
+        changes,
+    ));
+}
+
+fn revert(cache: &Cache, state: &State, change: Change) {
+    match change {
+        Change::Removed(entry) => cache.restore(entry),
+        Change::Hidden(full_path) => state.unhide(&full_path),
+        Change::Tagged { full_path, before } => state.set_tags(&full_path, before),
+        Change::PinToggled(full_path) => state.toggle_pin(&full_path),
+    }
+}
+
+pub(crate) fn run(cache: &Cache, state: &State) -> Result<()> {
+    let mutation = match state.pop_undo() {
+        Some(mutation) => mutation,
+        None => {
+            println!("nothing to undo");
+            return Ok(());
+        }
+    };
+    // latest first, in case one action changed the same thing twice
+    for change in mutation.changes.into_iter().rev() {
+        revert(cache, state, change);
+    }
+    println!("undid {}", mutation.description);
+    Ok(())
+}
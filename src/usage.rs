@@ -0,0 +1,115 @@
+use std::{
+    collections::HashMap,
+    path::Path,
+    sync::{Arc, RwLock},
+    time::{Duration, SystemTime, UNIX_EPOCH},
+};
+
+use serde::{Deserialize, Serialize};
+
+use crate::Cache;
+
+/// How long a computed size is trusted before the directory is walked again
+const MAX_AGE: Duration = Duration::from_secs(24 * 60 * 60);
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+pub(crate) struct DiskUsage {
+    pub(crate) bytes: u64,
+    /// seconds since the unix epoch
+    computed_at: u64,
+}
+
+pub(crate) fn now() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_secs())
+        .unwrap_or(0)
+}
+
+impl DiskUsage {
+    pub(crate) fn new(bytes: u64) -> Self {
+        Self {
+            bytes,
+            computed_at: now(),
+        }
+    }
+
+    pub(crate) fn is_fresh(&self) -> bool {
+        now().saturating_sub(self.computed_at) < MAX_AGE.as_secs()
+    }
+}
+
+/// Total size of the files beneath `path`, without following symlinks
+pub(crate) fn dir_size(path: &Path) -> u64 {
+    let entries = match std::fs::read_dir(path) {
+        Ok(entries) => entries,
+        Err(_) => return 0,
+    };
+    entries
+        .filter_map(|e| e.ok())
+        .map(|entry| match entry.metadata() {
+            Ok(meta) if meta.is_dir() => dir_size(&entry.path()),
+            Ok(meta) => meta.len(),
+            Err(_) => 0,
+        })
+        .sum()
+}
+
+pub(crate) fn human(bytes: u64) -> String {
+    const UNITS: [&str; 5] = ["B", "K", "M", "G", "T"];
+    let mut size = bytes as f64;
+    let mut unit = 0;
+    while size >= 1024.0 && unit < UNITS.len() - 1 {
+        size /= 1024.0;
+        unit += 1;
+    }
+    if unit == 0 {
+        format!("{}{}", bytes, UNITS[0])
+    } else {
+        format!("{:.1}{}", size, UNITS[unit])
+    }
+}
+
+pub(crate) type SizeStore = RwLock<HashMap<String, u64>>;
+
+/// Works out project sizes on a background thread for the picker column,
+/// reusing sizes from the cache where they are recent enough
+pub(crate) struct Sizer {
+    store: Arc<SizeStore>,
+    tx: crossbeam_channel::Sender<String>,
+}
+
+impl Sizer {
+    pub(crate) fn start(cache: Cache) -> Self {
+        let store = Arc::new(SizeStore::default());
+        let (tx, rx) = crossbeam_channel::unbounded::<String>();
+        let thread_store = Arc::clone(&store);
+        std::thread::spawn(move || {
+            for path in rx.iter() {
+                let bytes = cache.disk_usage(&path);
+                thread_store.write().unwrap().insert(path, bytes);
+            }
+        });
+        Self { store, tx }
+    }
+
+    pub(crate) fn request(&self, full_path: &str) {
+        let _ = self.tx.send(full_path.to_string());
+    }
+
+    pub(crate) fn store(&self) -> Arc<SizeStore> {
+        Arc::clone(&self.store)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn human_sizes() {
+        assert_eq!(human(512), "512B");
+        assert_eq!(human(2048), "2.0K");
+        assert_eq!(human(5 * 1024 * 1024 + 512 * 1024), "5.5M");
+    }
+}
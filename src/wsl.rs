@@ -0,0 +1,84 @@
+//! Windows Subsystem for Linux: roots on Windows drives can be written as
+//! Windows paths, and openers can hand Windows programs such as code.exe the
+//! Windows form of a project's path
+
+use std::{path::Path, process::Command, time::Duration};
+
+use crate::git::output_with_timeout;
+
+/// Whether we are running under WSL, where Windows programs can be started
+pub(crate) fn is_wsl() -> bool {
+    std::env::var_os("WSL_DISTRO_NAME").is_some()
+        || Path::new("/proc/sys/fs/binfmt_misc/WSLInterop").exists()
+}
+
+/// Whether `path` looks like a Windows path with a drive, e.g. `C:\Users`
+pub(crate) fn is_windows_path(path: &str) -> bool {
+    let mut chars = path.chars();
+    matches!(
+        (chars.next(), chars.next(), chars.next()),
+        (Some(drive), Some(':'), Some('\\' | '/')) if drive.is_ascii_alphabetic()
+    )
+}
+
+/// The WSL path of a Windows path on a drive, e.g. `C:\Users\me` is
+/// `/mnt/c/Users/me` where WSL mounts drives by default
+pub(crate) fn from_windows(path: &str) -> Option<String> {
+    if !is_windows_path(path) {
+        return None;
+    }
+    let drive = path[..1].to_ascii_lowercase();
+    let rest = path[2..].replace('\\', "/");
+    Some(format!("/mnt/{}{}", drive, rest.trim_end_matches('/')))
+}
+
+/// The path Windows programs know `path` by. `wslpath` handles drives mounted
+/// elsewhere and paths inside the Linux filesystem, which Windows reaches
+/// through `\\wsl$`; without it only drive paths can be translated.
+pub(crate) fn to_windows(path: &str) -> Option<String> {
+    if is_wsl() {
+        let out = output_with_timeout(
+            Command::new("wslpath").arg("-w").arg(path),
+            Duration::from_millis(500),
+        );
+        if let Some(out) = out {
+            return Some(out.trim().to_string());
+        }
+    }
+    drive_to_windows(path)
+}
+
+fn drive_to_windows(path: &str) -> Option<String> {
+    let rest = path.strip_prefix("/mnt/")?;
+    let (drive, rest) = rest.split_once('/').unwrap_or((rest, ""));
+    if drive.len() != 1 || !drive.chars().all(|c| c.is_ascii_alphabetic()) {
+        return None;
+    }
+    Some(format!(
+        "{}:\\{}",
+        drive.to_ascii_uppercase(),
+        rest.replace('/', "\\")
+    ))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn translation() {
+        assert_eq!(
+            from_windows(r"C:\Users\me\src\").as_deref(),
+            Some("/mnt/c/Users/me/src")
+        );
+        assert_eq!(from_windows("d:/work").as_deref(), Some("/mnt/d/work"));
+        assert_eq!(from_windows("~/work"), None);
+        assert_eq!(
+            drive_to_windows("/mnt/c/Users/me/src").as_deref(),
+            Some(r"C:\Users\me\src")
+        );
+        assert_eq!(drive_to_windows("/mnt/c").as_deref(), Some(r"C:\"));
+        assert_eq!(drive_to_windows("/mnt/wsl/x"), None);
+        assert_eq!(drive_to_windows("/home/me"), None);
+    }
+}